@@ -2,28 +2,146 @@ package config
 
 import (
 	"os"
+	"time"
 
 	flags "github.com/jessevdk/go-flags"
 )
 
 // Config command line flags
 type Config struct {
+	ConfigFile string `long:"config" description:"YAML file with the options keyed by their long names, the DSV_* environment variables and the flags take precedence"`
+
 	S3Region     string `short:"r" long:"s3-region" default:"eu-west-1" description:"The S3 region"`
-	S3DisableSSL string `short:"s" long:"s3-disable-ssl" default:"false" description:"Disable SSL with S3"`
+	S3DisableSSL bool   `short:"s" long:"s3-disable-ssl" description:"Disable SSL with S3"`
 	S3Endpoint   string `short:"e" long:"s3-endpoint" description:"S3 endpoint"`
 
-	BucketName    string `short:"b" long:"bucket" required:"true" description:"The bucket name to check. Use '*' to check all buckets"`
+	Profile              string   `long:"profile" description:"Profile of the shared AWS configuration to use, instead of the default credential chain"`
+	RoleARN              string   `long:"role-arn" description:"Assume this IAM role, e.g. a cleanup role in another account"`
+	ExternalID           string   `long:"external-id" description:"External ID required by the trust policy of the assumed roles"`
+	RoleSessionName      string   `long:"role-session-name" default:"delete-s3-versions" description:"Session name of the assumed roles, reported in CloudTrail"`
+	WebIdentityTokenFile string   `long:"web-identity-token-file" description:"Assume the roles with this OIDC token file (e.g. the service account token on EKS) instead of the AWS credentials"`
+	AccountRoleARNs      []string `long:"account-role-arn" description:"Run against every account by assuming each of these roles in turn (can be repeated)"`
+
+	BucketName    string `short:"b" long:"bucket" description:"The bucket name to check. Use '*' to check all buckets (required)"`
 	BucketPrefix  string `short:"p" long:"prefix" description:"The bucket prefix path"`
-	VersionsCount int    `short:"n" long:"count" required:"true" description:"How many versions to keep"`
+	VersionsCount int    `short:"n" long:"count" description:"How many versions to keep (required when deleting versions, unless --keep-days is set)"`
+	KeepDays      int    `long:"keep-days" description:"Also keep the versions noncurrent for less than this many days, only older versions beyond --count are deleted (the default --noncurrent-days of lifecycle)"`
 	Confirm       bool   `long:"confirm" description:"By default it prints details for the files to be deleted, enabling this flag leads to real S3 file changes"`
+
+	IncludeSuspended bool `long:"include-suspended" description:"Also process the buckets with versioning suspended, they keep the versions created before the suspension"`
+
+	MaxDeleteVersions int     `long:"max-delete-versions" description:"Abort when more versions are about to be deleted from a bucket"`
+	MaxDeleteBytes    string  `long:"max-delete-bytes" description:"Abort when more bytes are about to be deleted from a bucket (e.g. '50GB')"`
+	MaxDeletePercent  float64 `long:"max-delete-percent" description:"Abort when a higher percentage of the noncurrent versions of a bucket is about to be deleted"`
+	Yes               bool    `short:"y" long:"yes" description:"Don't ask for a confirmation before deleting, when stdin is a terminal"`
+
+	AbortMultipartDays int `long:"abort-multipart-days" description:"Also abort the incomplete multipart uploads initiated more than this many days ago"`
+
+	KeepTag []string `long:"keep-tag" description:"Keep the versions beyond --count having this tag, as key=value or key for any value (can be repeated)"`
+
+	Protect       []string `long:"protect" description:"Never delete versions of the keys matching this glob, '**' matches across '/' (can be repeated)"`
+	ProtectTag    []string `long:"protect-tag" description:"Never delete versions of the keys whose current version has this tag, as key=value or key for any value (can be repeated)"`
+	ProtectPolicy string   `long:"protect-policy" description:"JSON file with the protected key globs and tags, added to --protect and --protect-tag"`
+
+	BypassGovernanceRetention bool `long:"bypass-governance-retention" description:"Delete versions under an Object Lock governance retention (requires the s3:BypassGovernanceRetention permission)"`
+	CheckConcurrency          int  `long:"check-concurrency" default:"10" description:"How many Object Lock and tagging checks run concurrently"`
+
+	MFASerial string `long:"mfa-serial" description:"Serial number or ARN of the MFA device, required to delete versions from buckets with MFA Delete enabled"`
+	MFACode   string `long:"mfa-code" description:"Current code of the MFA device, new codes are prompted for (or read from stdin) when it expires"`
+
+	Lock        string        `long:"lock" choice:"s3" choice:"file" description:"Prevent concurrent runs against the same bucket with a lock object in S3 or a local lock file"`
+	LockBucket  string        `long:"lock-bucket" description:"Bucket holding the S3 lock objects, defaults to the bucket being processed"`
+	LockDir     string        `long:"lock-dir" description:"Directory of the lock files, defaults to the temporary directory"`
+	LockTTL     time.Duration `long:"lock-ttl" default:"5m" description:"How long a lock stays valid without being renewed, it is renewed every third of it"`
+	ForceUnlock bool          `long:"force-unlock" description:"Remove the existing locks of the buckets before acquiring them, when the run holding them died"`
+
+	PriceTable string `long:"price-table" description:"JSON file with S3 storage prices (USD per GB-month) by region and storage class, overriding the defaults"`
+
+	MetricsAddr     string        `long:"metrics-addr" description:"Serve Prometheus metrics on this address (e.g. ':9102') at /metrics while running"`
+	MetricsLinger   time.Duration `long:"metrics-linger" description:"Keep serving metrics for this long after the run completes (e.g. '5m')"`
+	MetricsTextfile string        `long:"metrics-textfile" description:"Write Prometheus metrics to this file at the end of the run, for the node_exporter textfile collector"`
+
+	MaxAttempts    int           `long:"max-attempts" default:"5" description:"Maximum number of attempts for S3 calls failing with throttling or transient errors"`
+	RetryBaseDelay time.Duration `long:"retry-base-delay" default:"200ms" description:"Delay before the first retry, doubled for every following retry (with jitter)"`
+	RetryMaxDelay  time.Duration `long:"retry-max-delay" default:"20s" description:"Maximum delay between retries"`
+
+	ListRPS         float64            `long:"list-rps" description:"Maximum list and other read requests per second (0 for unlimited)"`
+	DeleteRPS       float64            `long:"delete-rps" description:"Maximum delete and other write requests per second (0 for unlimited)"`
+	BucketListRPS   map[string]float64 `long:"bucket-list-rps" description:"Maximum list requests per second for a bucket, as bucket:rps (can be repeated)"`
+	BucketDeleteRPS map[string]float64 `long:"bucket-delete-rps" description:"Maximum delete requests per second for a bucket, as bucket:rps (can be repeated)"`
+
+	StateFile       string `long:"state-file" description:"Save the progress of the run to this file, so that it can be resumed with --resume (requires --confirm)"`
+	Resume          bool   `long:"resume" description:"Resume the run saved in --state-file, skipping the buckets already completed"`
+	CheckpointPages int    `long:"checkpoint-pages" default:"100" description:"How many listing pages to process between checkpoints"`
+
+	OTLPEndpoint string `long:"otlp-endpoint" description:"Export OpenTelemetry traces to this OTLP/HTTP collector endpoint (e.g. 'http://localhost:4318')"`
+
+	Stats      StatsCommand      `command:"stats" description:"Print statistics about the file versions without deleting anything"`
+	Lifecycle  LifecycleCommand  `command:"lifecycle" description:"Print the S3 lifecycle rule equivalent to the settings, and optionally apply it"`
+	Audit      AuditCommand      `command:"audit" description:"Report the noncurrent versions that the lifecycle rules of the buckets don't expire"`
+	Versioning VersioningCommand `command:"versioning" description:"Report the versioning status of the buckets, and enable or suspend it"`
+
+	// Command is the name of the subcommand to run, it is empty when deleting file versions
+	Command string
 }
 
-// GetConfig get application config
+// StatsCommand stats subcommand flags
+type StatsCommand struct {
+	TopKeys int `long:"top" default:"10" description:"How many keys with the most versions to print"`
+}
+
+// LifecycleCommand lifecycle subcommand flags
+type LifecycleCommand struct {
+	NoncurrentDays    int    `long:"noncurrent-days" description:"Expire noncurrent versions this many days after they became noncurrent"`
+	KeepDeleteMarkers bool   `long:"keep-delete-markers" description:"Don't remove the delete markers left without versions"`
+	Format            string `long:"format" choice:"json" choice:"xml" default:"json" description:"Print the lifecycle configuration as JSON (AWS CLI) or XML (S3 API)"`
+	Apply             bool   `long:"apply" description:"Apply the rule to the buckets (with --confirm), merged with their existing lifecycle rules"`
+}
+
+// AuditCommand audit subcommand flags
+type AuditCommand struct {
+	MinVersions    int `long:"min-versions" default:"1" description:"Only report the prefixes with at least this many unexpired noncurrent versions"`
+	TopPrefixes    int `long:"top" default:"20" description:"How many prefixes to report per bucket, the largest first (0 for all)"`
+	NoncurrentDays int `long:"noncurrent-days" default:"30" description:"Expiration of the suggested lifecycle rules, in days"`
+}
+
+// VersioningCommand versioning subcommand flags
+type VersioningCommand struct {
+	Enable  bool     `long:"enable" description:"Enable versioning on the buckets, only on the required ones with --require (with --confirm)"`
+	Suspend bool     `long:"suspend" description:"Suspend versioning on the buckets, except the required ones (with --confirm)"`
+	Require []string `long:"require" description:"Buckets (globs) on which versioning must be enabled, reported when it is not (can be repeated)"`
+	Format  string   `long:"format" choice:"text" choice:"json" default:"text" description:"Print the report as a table or as JSON"`
+}
+
+// GetConfig get application config, from the flags, the DSV_* environment variables and the --config file,
+// in this order of precedence
 func GetConfig() (*Config, error) {
+	return parseConfig(os.Args[1:])
+}
+
+// Default returns the configuration with the default values of the flags, for the library users
+func Default() *Config {
+	var config Config
+	parser := flags.NewParser(&config, flags.None)
+	parser.SubcommandsOptional = true
+	parser.ParseArgs([]string{})
+
+	return &config
+}
+
+func parseConfig(args []string) (*Config, error) {
 	var config Config
 	var parser = flags.NewParser(&config, flags.HelpFlag)
+	parser.SubcommandsOptional = true
+	setEnvDefaults(parser)
 
-	if _, err := parser.Parse(); err != nil {
+	if path := configFilePath(args); len(path) > 0 {
+		if err := applyConfigFile(parser, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := parser.ParseArgs(args); err != nil {
 		parser.WriteHelp(os.Stdout)
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			return nil, nil
@@ -31,5 +149,14 @@ func GetConfig() (*Config, error) {
 		return nil, err
 	}
 
+	if parser.Active != nil {
+		config.Command = parser.Active.Name
+	}
+
+	if err := config.validate(parser.FindOptionByLongName("count").IsSet()); err != nil {
+		parser.WriteHelp(os.Stdout)
+		return nil, err
+	}
+
 	return &config, nil
 }
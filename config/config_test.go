@@ -0,0 +1,172 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "config")
+	require.Nil(t, err)
+
+	path := filepath.Join(dir, "config.yaml")
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func setEnv(t *testing.T, values map[string]string) func() {
+	for key, value := range values {
+		require.Nil(t, os.Setenv(key, value))
+	}
+
+	return func() {
+		for key := range values {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestParseConfig_Precedence(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `
+bucket: file-bucket
+count: 3
+prefix: file/
+s3-disable-ssl: true
+lock-ttl: 10m
+protect: ["releases/**", "*.lock"]
+bucket-delete-rps:
+  shared: 1.5
+stats:
+  top: 5
+`)
+	defer cleanup()
+	defer setEnv(t, map[string]string{
+		"DSV_COUNT":  "4",
+		"DSV_PREFIX": "env/",
+	})()
+
+	c, err := parseConfig([]string{"--config", path, "--prefix", "flag/", "stats"})
+	require.Nil(t, err)
+
+	assert.Equal(t, "file-bucket", c.BucketName)
+	assert.Equal(t, 4, c.VersionsCount)
+	assert.Equal(t, "flag/", c.BucketPrefix)
+	assert.True(t, c.S3DisableSSL)
+	assert.Equal(t, 10*time.Minute, c.LockTTL)
+	assert.Equal(t, []string{"releases/**", "*.lock"}, c.Protect)
+	assert.Equal(t, map[string]float64{"shared": 1.5}, c.BucketDeleteRPS)
+	assert.Equal(t, "stats", c.Command)
+	assert.Equal(t, 5, c.Stats.TopKeys)
+	// Defaults are kept for the options set nowhere
+	assert.Equal(t, "eu-west-1", c.S3Region)
+}
+
+func TestParseConfig_Env(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"DSV_BUCKET":         "env-bucket",
+		"DSV_COUNT":          "2",
+		"DSV_CONFIRM":        "true",
+		"DSV_KEEP_TAG":       "keep=true,release",
+		"DSV_STATS_TOP":      "7",
+		"DSV_S3_DISABLE_SSL": "true",
+	})()
+
+	c, err := parseConfig([]string{"stats"})
+	require.Nil(t, err)
+
+	assert.Equal(t, "env-bucket", c.BucketName)
+	assert.Equal(t, 2, c.VersionsCount)
+	assert.True(t, c.Confirm)
+	assert.True(t, c.S3DisableSSL)
+	assert.Equal(t, []string{"keep=true", "release"}, c.KeepTag)
+	assert.Equal(t, 7, c.Stats.TopKeys)
+}
+
+func TestParseConfig_InvalidFile(t *testing.T) {
+	path, cleanup := writeConfigFile(t, `
+bucket: b1
+unknown: 1
+stats: 5
+lifecycle:
+  days: 3
+`)
+	defer cleanup()
+
+	_, err := parseConfig([]string{"--config", path})
+	require.NotNil(t, err)
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  "+path+": lifecycle.days: unknown option\n"+
+		"  "+path+": stats must be a mapping of the stats options\n"+
+		"  "+path+": unknown: unknown option", err.Error())
+}
+
+func TestParseConfig_Validation(t *testing.T) {
+	_, err := parseConfig([]string{"--max-delete-bytes", "lots", "--resume", "--lock-dir", "/tmp"})
+	require.NotNil(t, err)
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  --bucket is required\n"+
+		"  --count or --keep-days is required when deleting versions\n"+
+		"  --max-delete-bytes: invalid size \"lots\"\n"+
+		"  --lock-dir requires --lock file\n"+
+		"  --resume requires --state-file", err.Error())
+
+	c, err := parseConfig([]string{"--bucket", "b1", "stats"})
+	require.Nil(t, err)
+	assert.Equal(t, "b1", c.BucketName)
+
+	c, err = parseConfig([]string{"--bucket", "b1", "--keep-days", "30"})
+	require.Nil(t, err)
+	assert.Equal(t, 30, c.KeepDays)
+}
+
+func TestParseConfig_Roles(t *testing.T) {
+	_, err := parseConfig([]string{"--bucket", "*", "--role-arn", "arn:aws:iam::111111111111:role/cleanup",
+		"--account-role-arn", "arn:aws:iam::222222222222:role/cleanup", "--state-file", "state.json", "stats"})
+	require.NotNil(t, err)
+	assert.Equal(t, "Invalid configuration:\n"+
+		"  --role-arn and --account-role-arn can't be used together\n"+
+		"  --state-file can't be used with --account-role-arn", err.Error())
+
+	_, err = parseConfig([]string{"--bucket", "*", "--external-id", "id", "stats"})
+	require.NotNil(t, err)
+	assert.Equal(t, "Invalid configuration:\n  --external-id requires --role-arn or --account-role-arn", err.Error())
+
+	_, err = parseConfig([]string{"--bucket", "*", "--role-arn", "arn:aws:iam::111111111111:role/cleanup",
+		"--external-id", "id", "--web-identity-token-file", "/var/run/token", "stats"})
+	require.NotNil(t, err)
+	assert.Equal(t, "Invalid configuration:\n  --external-id can't be used with --web-identity-token-file, "+
+		"roles assumed with a web identity take no external ID", err.Error())
+
+	_, err = parseConfig([]string{"--bucket", "*", "-n", "1", "--account-role-arn", "arn:aws:iam::111111111111:role/cleanup",
+		"--account-role-arn", "arn:aws:iam::222222222222:role/cleanup", "--mfa-serial", "arn:aws:iam::111111111111:mfa/root",
+		"--mfa-code", "123456"})
+	require.NotNil(t, err)
+	assert.Equal(t, "Invalid configuration:\n  --mfa-code can't be used with several --account-role-arn, "+
+		"the accounts would reuse the same code (it is prompted for instead)", err.Error())
+
+	defer setEnv(t, map[string]string{
+		"DSV_ACCOUNT_ROLE_ARN": "arn:aws:iam::111111111111:role/cleanup,arn:aws:iam::222222222222:role/cleanup",
+	})()
+	c, err := parseConfig([]string{"--bucket", "*", "--profile", "org", "stats"})
+	require.Nil(t, err)
+	assert.Equal(t, "org", c.Profile)
+	assert.Equal(t, "delete-s3-versions", c.RoleSessionName)
+	assert.Equal(t, 2, len(c.AccountRoleARNs))
+}
+
+func TestDefault(t *testing.T) {
+	c := Default()
+
+	assert.Equal(t, "eu-west-1", c.S3Region)
+	assert.Equal(t, 10, c.CheckConcurrency)
+	assert.Equal(t, 5, c.MaxAttempts)
+	assert.Equal(t, 10, c.Stats.TopKeys)
+	assert.Empty(t, c.BucketName)
+}
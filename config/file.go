@@ -0,0 +1,194 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the environment variables of the options, e.g. DSV_BUCKET for --bucket
+const envPrefix = "DSV_"
+
+// setEnvDefaults names the environment variable of every option after its long name. The options of the
+// subcommands are prefixed with the command name, e.g. DSV_STATS_TOP for stats --top. Lists and maps are
+// comma separated.
+func setEnvDefaults(parser *flags.Parser) {
+	eachOption(parser, func(command string, option *flags.Option) {
+		name := option.LongName
+		if len(command) > 0 {
+			name = command + "-" + name
+		}
+		option.EnvDefaultKey = envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+
+		switch option.Field().Type.Kind() {
+		case reflect.Slice, reflect.Map:
+			option.EnvDefaultDelim = ","
+		}
+	})
+}
+
+func eachOption(parser *flags.Parser, fn func(command string, option *flags.Option)) {
+	for _, option := range commandOptions(parser.Command) {
+		fn("", option)
+	}
+
+	for _, command := range parser.Commands() {
+		for _, option := range commandOptions(command) {
+			fn(command.Name, option)
+		}
+	}
+}
+
+// commandOptions returns the options of the command and of its groups, without the help flag
+func commandOptions(command *flags.Command) []*flags.Option {
+	options := []*flags.Option{}
+	groups := append([]*flags.Group{command.Group}, command.Groups()...)
+	for _, group := range groups {
+		for _, option := range group.Options() {
+			if option.LongName != "help" {
+				options = append(options, option)
+			}
+		}
+	}
+
+	return options
+}
+
+// configFilePath finds --config in the arguments, or in its environment variable
+func configFilePath(args []string) string {
+	var options struct {
+		ConfigFile string `long:"config" env:"DSV_CONFIG"`
+	}
+
+	// The other options are parsed later, their errors are reported then
+	parser := flags.NewParser(&options, flags.IgnoreUnknown)
+	parser.ParseArgs(args)
+
+	return options.ConfigFile
+}
+
+// applyConfigFile reads the YAML configuration file, keyed by the long names of the options with a section
+// per subcommand. Its values become the defaults of the options, so that the flags and the environment
+// variables take precedence over them.
+func applyConfigFile(parser *flags.Parser, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{}
+	if err = yaml.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("Invalid configuration file %s: %v", path, err)
+	}
+
+	problems := validationError{}
+	for _, key := range sortedKeys(values) {
+		if command := parser.Find(key); command != nil {
+			mapping, ok := values[key].(map[interface{}]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: %s must be a mapping of the %s options", path, key, key))
+				continue
+			}
+
+			section := stringKeys(mapping)
+			for _, name := range sortedKeys(section) {
+				if err = setFileDefault(commandOptions(command), name, section[name]); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %s.%s: %v", path, key, name, err))
+				}
+			}
+			continue
+		}
+
+		if err = setFileDefault(commandOptions(parser.Command), key, values[key]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s: %v", path, key, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+func setFileDefault(options []*flags.Option, name string, value interface{}) error {
+	for _, option := range options {
+		if option.LongName != name || name == "config" {
+			continue
+		}
+
+		defaults, err := fileValues(value)
+		if err != nil {
+			return err
+		}
+		option.Default = defaults
+
+		return nil
+	}
+
+	return errors.New("unknown option")
+}
+
+// fileValues converts a YAML value to the strings of the option: one per list item, "key:value" per map entry
+func fileValues(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		values := []string{}
+		for _, item := range v {
+			if !isScalar(item) {
+				return nil, fmt.Errorf("list items must be scalars")
+			}
+			values = append(values, fmt.Sprint(item))
+		}
+		return values, nil
+	case map[interface{}]interface{}:
+		entries := stringKeys(v)
+		values := []string{}
+		for _, key := range sortedKeys(entries) {
+			if !isScalar(entries[key]) {
+				return nil, fmt.Errorf("map values must be scalars")
+			}
+			values = append(values, fmt.Sprintf("%s:%v", key, entries[key]))
+		}
+		return values, nil
+	case nil:
+		return nil, nil
+	}
+
+	return []string{fmt.Sprint(value)}, nil
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case []interface{}, map[interface{}]interface{}, nil:
+		return false
+	}
+
+	return true
+}
+
+func stringKeys(mapping map[interface{}]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	for key, value := range mapping {
+		values[fmt.Sprint(key)] = value
+	}
+
+	return values
+}
+
+// sortedKeys returns the keys of a mapping, sorted so that the problems are reported in a stable order
+func sortedKeys(values map[string]interface{}) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
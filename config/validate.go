@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// validationError lists all the problems found in the configuration
+type validationError []string
+
+func (e validationError) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// validate checks the configuration once the flags, the environment variables and the configuration file
+// are merged, reporting all the problems at once
+func (c *Config) validate(countSet bool) error {
+	problems := validationError{}
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(len(c.BucketName) > 0, "--bucket is required")
+	check(len(c.Command) > 0 || countSet || c.KeepDays > 0, "--count or --keep-days is required when deleting versions")
+	check(c.VersionsCount >= 0, "--count can't be negative")
+	check(c.KeepDays >= 0, "--keep-days can't be negative")
+
+	check(c.MaxDeleteVersions >= 0, "--max-delete-versions can't be negative")
+	if len(c.MaxDeleteBytes) > 0 {
+		_, err := humanize.ParseBytes(c.MaxDeleteBytes)
+		check(err == nil, "--max-delete-bytes: invalid size %q", c.MaxDeleteBytes)
+	}
+	check(c.MaxDeletePercent >= 0 && c.MaxDeletePercent <= 100, "--max-delete-percent must be between 0 and 100")
+	check(c.AbortMultipartDays >= 0, "--abort-multipart-days can't be negative")
+	check(c.CheckConcurrency > 0, "--check-concurrency must be at least 1")
+
+	assumesRoles := len(c.RoleARN) > 0 || len(c.AccountRoleARNs) > 0
+	check(len(c.RoleARN) == 0 || len(c.AccountRoleARNs) == 0, "--role-arn and --account-role-arn can't be used together")
+	check(len(c.ExternalID) == 0 || assumesRoles, "--external-id requires --role-arn or --account-role-arn")
+	check(len(c.WebIdentityTokenFile) == 0 || assumesRoles, "--web-identity-token-file requires --role-arn or --account-role-arn")
+	check(len(c.ExternalID) == 0 || len(c.WebIdentityTokenFile) == 0,
+		"--external-id can't be used with --web-identity-token-file, roles assumed with a web identity take no external ID")
+	check(len(c.StateFile) == 0 || len(c.AccountRoleARNs) == 0, "--state-file can't be used with --account-role-arn")
+
+	check(len(c.MFACode) == 0 || len(c.MFASerial) > 0, "--mfa-code requires --mfa-serial")
+	check(len(c.MFACode) == 0 || len(c.AccountRoleARNs) <= 1,
+		"--mfa-code can't be used with several --account-role-arn, the accounts would reuse the same code (it is prompted for instead)")
+	check(len(c.LockBucket) == 0 || c.Lock == "s3", "--lock-bucket requires --lock s3")
+	check(len(c.LockDir) == 0 || c.Lock == "file", "--lock-dir requires --lock file")
+	check(c.LockTTL >= 0, "--lock-ttl can't be negative")
+
+	check(c.MaxAttempts > 0, "--max-attempts must be at least 1")
+	check(c.ListRPS >= 0 && c.DeleteRPS >= 0, "--list-rps and --delete-rps can't be negative")
+
+	check(!c.Resume || len(c.StateFile) > 0, "--resume requires --state-file")
+	check(c.CheckpointPages > 0, "--checkpoint-pages must be at least 1")
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
@@ -16,10 +16,12 @@ require (
 	github.com/mgechev/revive v0.0.0-20191017201419-88015ccf8e97 // indirect
 	github.com/morikuni/aec v1.0.0 // indirect
 	github.com/olekukonko/tablewriter v0.0.2 // indirect
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90 // tests only, parsing the exposition format
+	github.com/prometheus/common v0.7.0 // tests only, parsing the exposition format
 	github.com/stretchr/testify v1.4.0
 	github.com/wacul/ptr v1.0.0 // indirect
 	golang.org/x/net v0.0.0-20191112182307-2180aed22343 // indirect
-	golang.org/x/sys v0.0.0-20191120155948-bd437916bb0e // indirect
+	golang.org/x/sys v0.0.0-20191120155948-bd437916bb0e
 	golang.org/x/tools v0.0.0-20191120221951-8fd459516a27 // indirect
-	gopkg.in/yaml.v2 v2.2.7 // indirect
+	gopkg.in/yaml.v2 v2.2.7
 )
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/croman/delete-s3-versions/config"
+	"github.com/croman/delete-s3-versions/tracing"
 	"github.com/croman/delete-s3-versions/versions"
 )
 
@@ -19,10 +25,74 @@ func main() {
 		os.Exit(0)
 	}
 
-	s3Versions := versions.New(c)
-	err = s3Versions.Delete()
+	tracer := versions.NewTracer(c)
+	s3Versions := versions.NewWithOptions(versions.WithConfig(c), versions.WithTracer(tracer))
+
+	if len(c.MetricsAddr) > 0 {
+		go serveMetrics(c.MetricsAddr, s3Versions.Metrics().Handler())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnSignal(cancel)
+
+	// The spans are children of the span of the caller, e.g. a CI job, when it sets TRACEPARENT
+	if traceparent := os.Getenv("TRACEPARENT"); len(traceparent) > 0 && tracer != nil {
+		if ctx, err = tracing.ContextWithTraceparent(ctx, traceparent); err != nil {
+			log.Println("Ignoring TRACEPARENT:", err)
+		}
+	}
+
+	switch c.Command {
+	case "stats":
+		err = s3Versions.StatsWithContext(ctx)
+	case "lifecycle":
+		err = s3Versions.LifecycleWithContext(ctx)
+	case "audit":
+		err = s3Versions.AuditWithContext(ctx)
+	case "versioning":
+		err = s3Versions.VersioningWithContext(ctx)
+	default:
+		err = s3Versions.DeleteWithContext(ctx)
+	}
+
+	if len(c.MetricsTextfile) > 0 {
+		if metricsErr := s3Versions.Metrics().WriteTextfile(c.MetricsTextfile); metricsErr != nil {
+			log.Println("Failed to write metrics:", metricsErr)
+		}
+	}
+
+	if tracerErr := tracer.Shutdown(context.Background()); tracerErr != nil {
+		log.Println("Failed to export traces:", tracerErr)
+	}
+
+	if len(c.MetricsAddr) > 0 && c.MetricsLinger > 0 {
+		log.Printf("Serving metrics on %s for %s ...", c.MetricsAddr, c.MetricsLinger)
+		time.Sleep(c.MetricsLinger)
+	}
+
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 }
+
+func serveMetrics(addr string, handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("Metrics server failed:", err)
+	}
+}
+
+// cancelOnSignal cancels the run on SIGINT or SIGTERM, a second signal terminates the process immediately
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Printf("Received %s, finishing the in-flight requests (send it again to exit immediately) ...", sig)
+	signal.Stop(signals)
+	cancel()
+}
@@ -0,0 +1,309 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// DefaultLatencyBuckets histogram buckets (in seconds) suited for S3 API calls
+var DefaultLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics and exposes them in the Prometheus text format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// NewRegistry create a new empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, "counter", labelNames)}
+	r.register(c)
+	return c
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, "gauge", labelNames)}
+	r.register(g)
+	return g
+}
+
+// NewHistogram registers a histogram with the given upper bounds and label names
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+
+	h := &Histogram{
+		vec:        newVec(name, help, "histogram", labelNames),
+		buckets:    sortedBuckets,
+		histograms: map[string]*histogramValue{},
+	}
+	r.register(h)
+	return h
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns an HTTP handler serving the metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// WriteTextfile writes the metrics to a file for the node_exporter textfile collector.
+// The file is written to a temporary file first and renamed, so the collector never reads partial content.
+func (r *Registry) WriteTextfile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = r.Write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// vec holds the values of a metric for every combination of label values
+type vec struct {
+	mu         sync.Mutex
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	labels     map[string][]string
+	values     map[string]float64
+}
+
+// newVec panics when the names can't be parsed in the text exposition format
+func newVec(name string, help string, metricType string, labelNames []string) *vec {
+	if !metricNamePattern.MatchString(name) {
+		panic(fmt.Sprintf("invalid metric name %q", name))
+	}
+	for _, labelName := range labelNames {
+		if !labelNamePattern.MatchString(labelName) || strings.HasPrefix(labelName, "__") ||
+			(metricType == "histogram" && labelName == "le") {
+			panic(fmt.Sprintf("invalid label name %q for metric %s", labelName, name))
+		}
+	}
+
+	return &vec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		labels:     map[string][]string{},
+		values:     map[string]float64{},
+	}
+}
+
+func (v *vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := v.labels[key]; !ok {
+		v.labels[key] = append([]string{}, labelValues...)
+	}
+
+	return key
+}
+
+func (v *vec) sortedKeys() []string {
+	keys := []string{}
+	for key := range v.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.metricType)
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w)
+	for _, key := range v.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, v.labels[key]), formatValue(v.values[key]))
+	}
+}
+
+// Counter a metric that only goes up
+type Counter struct {
+	*vec
+}
+
+// Add adds the given value to the counter
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[c.key(labelValues)] += value
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge a metric that can go up and down
+type Gauge struct {
+	*vec
+}
+
+// Set sets the gauge value
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.values[g.key(labelValues)] = value
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram a metric counting observations in buckets
+type Histogram struct {
+	*vec
+	buckets    []float64
+	histograms map[string]*histogramValue
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := h.key(labelValues)
+	hv, ok := h.histograms[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hv
+	}
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	labelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, key := range h.sortedKeys() {
+		hv := h.histograms[key]
+		labelValues := h.labels[key]
+
+		for i, upperBound := range h.buckets {
+			bucketLabels := append(append([]string{}, labelValues...), formatValue(upperBound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labelNames, bucketLabels), hv.counts[i])
+		}
+		infLabels := append(append([]string{}, labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(labelNames, infLabels), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labelNames, labelValues), formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labelNames, labelValues), hv.count)
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter", "bucket")
+	g := r.NewGauge("test_gauge", "A gauge")
+	h := r.NewHistogram("test_seconds", "A histogram", []float64{1, 0.1}, "op")
+
+	c.Inc("b2")
+	c.Add(2.5, "b1")
+	c.Inc(`we"ird`)
+	g.Set(42)
+	h.Observe(0.05, "list")
+	h.Observe(0.5, "list")
+	h.Observe(5, "list")
+
+	out := &bytes.Buffer{}
+	require.Nil(t, r.Write(out))
+
+	assert.Equal(t, `# HELP test_total A counter
+# TYPE test_total counter
+test_total{bucket="b1"} 2.5
+test_total{bucket="b2"} 1
+test_total{bucket="we\"ird"} 1
+# HELP test_gauge A gauge
+# TYPE test_gauge gauge
+test_gauge 42
+# HELP test_seconds A histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{op="list",le="0.1"} 1
+test_seconds_bucket{op="list",le="1"} 2
+test_seconds_bucket{op="list",le="+Inf"} 3
+test_seconds_sum{op="list"} 5.55
+test_seconds_count{op="list"} 3
+`, out.String())
+}
+
+func TestLabelValuesMismatch(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter", "bucket", "region")
+
+	assert.Panics(t, func() { c.Inc("b1") })
+}
+
+func TestInvalidNames(t *testing.T) {
+	r := NewRegistry()
+
+	assert.Panics(t, func() { r.NewCounter("test-total", "A counter") })
+	assert.Panics(t, func() { r.NewGauge("test_gauge", "A gauge", "bucket name") })
+	assert.Panics(t, func() { r.NewGauge("test_gauge", "A gauge", "__reserved") })
+	assert.Panics(t, func() { r.NewHistogram("test_seconds", "A histogram", DefaultLatencyBuckets, "le") })
+	assert.NotPanics(t, func() { r.NewCounter("test:ratio_total", "A counter", "bucket", "_region") })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter").Inc()
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+	assert.Contains(t, recorder.Body.String(), "test_total 1\n")
+}
+
+func TestWriteTextfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter").Inc()
+
+	path := filepath.Join(dir, "delete_s3_versions.prom")
+	require.Nil(t, r.WriteTextfile(path))
+
+	content, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	assert.Contains(t, string(content), "test_total 1\n")
+
+	files, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+// parse reads the metrics written by the registry with the Prometheus text parser
+func parse(t *testing.T, r *Registry) map[string]*dto.MetricFamily {
+	out := &bytes.Buffer{}
+	require.Nil(t, r.Write(out))
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(out)
+	require.Nil(t, err, out.String())
+
+	return families
+}
+
+func labels(metric *dto.Metric) map[string]string {
+	result := map[string]string{}
+	for _, pair := range metric.GetLabel() {
+		result[pair.GetName()] = pair.GetValue()
+	}
+
+	return result
+}
+
+func TestWrite_ParsedByPrometheus(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "A counter\nwith a \\ backslash", "bucket", "region")
+	g := r.NewGauge("test_gauge", "A gauge")
+	h := r.NewHistogram("test_seconds", "A histogram", []float64{0.1, 1}, "op")
+	r.NewCounter("test_unused_total", "Never incremented", "bucket")
+
+	c.Add(2, `quote"d`, "eu-west-1")
+	c.Add(3, "back\\slash\nnew line", "")
+	c.Inc("b1", "eu-west-1")
+	g.Set(math.Inf(-1))
+	h.Observe(0.05, "list")
+	h.Observe(5, "list")
+
+	// The parser leaves out the families without samples
+	families := parse(t, r)
+	require.Equal(t, 3, len(families))
+
+	counter := families["test_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, counter.GetType())
+	assert.Equal(t, "A counter\nwith a \\ backslash", counter.GetHelp())
+	require.Equal(t, 3, len(counter.GetMetric()))
+	values := map[string]float64{}
+	for _, metric := range counter.GetMetric() {
+		values[labels(metric)["bucket"]] = metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{`quote"d`: 2, "back\\slash\nnew line": 3, "b1": 1}, values)
+
+	assert.Equal(t, math.Inf(-1), families["test_gauge"].GetMetric()[0].GetGauge().GetValue())
+
+	histogram := families["test_seconds"].GetMetric()[0].GetHistogram()
+	assert.Equal(t, dto.MetricType_HISTOGRAM, families["test_seconds"].GetType())
+	assert.Equal(t, uint64(2), histogram.GetSampleCount())
+	assert.Equal(t, 5.05, histogram.GetSampleSum())
+	require.Equal(t, 3, len(histogram.GetBucket()))
+	assert.Equal(t, uint64(1), histogram.GetBucket()[0].GetCumulativeCount())
+	assert.Equal(t, uint64(1), histogram.GetBucket()[1].GetCumulativeCount())
+	assert.Equal(t, math.Inf(1), histogram.GetBucket()[2].GetUpperBound())
+	assert.Equal(t, uint64(2), histogram.GetBucket()[2].GetCumulativeCount())
+}
+
+func TestHandler_ParsedByPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "A counter", "bucket").Inc("b1")
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	format := expfmt.ResponseFormat(recorder.Header())
+	assert.Equal(t, expfmt.FmtText, format)
+
+	decoder := expfmt.NewDecoder(recorder.Body, format)
+	family := &dto.MetricFamily{}
+	require.Nil(t, decoder.Decode(family))
+	assert.Equal(t, "test_total", family.GetName())
+	assert.Equal(t, 1.0, family.GetMetric()[0].GetCounter().GetValue())
+}
@@ -0,0 +1,303 @@
+package s3api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// RateLimits request rates in requests per second, zero means unlimited. The list limits apply to all the
+// requests reading from S3, the delete limits to all the requests writing to it.
+type RateLimits struct {
+	ListRPS   float64
+	DeleteRPS float64
+	// BucketListRPS and BucketDeleteRPS limit the requests of specific buckets, on top of the global limits
+	BucketListRPS   map[string]float64
+	BucketDeleteRPS map[string]float64
+}
+
+// tokenBucket a token bucket allowing bursts of up to one second of requests
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it. Tokens can be borrowed
+// from the future, so concurrent callers are served in order.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// RateLimited limits the rate of the requests sent to S3
+type RateLimited struct {
+	S3API
+	list         *tokenBucket
+	delete       *tokenBucket
+	bucketList   map[string]*tokenBucket
+	bucketDelete map[string]*tokenBucket
+
+	mu       sync.Mutex
+	waitTime time.Duration
+}
+
+// NewRateLimited wraps the API to respect the given rate limits
+func NewRateLimited(api S3API, limits RateLimits) *RateLimited {
+	return &RateLimited{
+		S3API:        api,
+		list:         newLimiter(limits.ListRPS),
+		delete:       newLimiter(limits.DeleteRPS),
+		bucketList:   newBucketLimiters(limits.BucketListRPS),
+		bucketDelete: newBucketLimiters(limits.BucketDeleteRPS),
+	}
+}
+
+func newLimiter(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return newTokenBucket(rate)
+}
+
+func newBucketLimiters(rates map[string]float64) map[string]*tokenBucket {
+	limiters := map[string]*tokenBucket{}
+	for bucket, rate := range rates {
+		if limiter := newLimiter(rate); limiter != nil {
+			limiters[bucket] = limiter
+		}
+	}
+
+	return limiters
+}
+
+// WaitTime returns the total time spent waiting for the rate limits
+func (r *RateLimited) WaitTime() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.waitTime
+}
+
+func (r *RateLimited) wait(ctx aws.Context, limiters ...*tokenBucket) error {
+	now := time.Now()
+
+	var delay time.Duration
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if d := limiter.reserve(now); d > delay {
+			delay = d
+		}
+	}
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		r.addWaitTime(time.Since(now))
+		return ctx.Err()
+	case <-timer.C:
+		r.addWaitTime(delay)
+		return nil
+	}
+}
+
+func (r *RateLimited) addWaitTime(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.waitTime += d
+}
+
+func (r *RateLimited) read(ctx aws.Context, bucket *string) error {
+	return r.wait(ctx, r.list, r.bucketList[aws.StringValue(bucket)])
+}
+
+func (r *RateLimited) write(ctx aws.Context, bucket *string) error {
+	return r.wait(ctx, r.delete, r.bucketDelete[aws.StringValue(bucket)])
+}
+
+func (r *RateLimited) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput, opts ...request.Option) (*s3.ListBucketsOutput, error) {
+	if err := r.wait(ctx, r.list); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.ListBucketsWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) ListObjectVersionsWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, opts ...request.Option) (*s3.ListObjectVersionsOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.ListObjectVersionsWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	if err := r.write(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.DeleteObjectsWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.ListMultipartUploadsWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.ListPartsWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	if err := r.write(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.AbortMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.HeadBucketWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetBucketLocationWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, opts ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetBucketVersioningWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) PutBucketVersioningWithContext(ctx aws.Context, input *s3.PutBucketVersioningInput, opts ...request.Option) (*s3.PutBucketVersioningOutput, error) {
+	if err := r.write(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.PutBucketVersioningWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetObjectLockConfigurationWithContext(ctx aws.Context, input *s3.GetObjectLockConfigurationInput, opts ...request.Option) (*s3.GetObjectLockConfigurationOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetObjectLockConfigurationWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetObjectRetentionWithContext(ctx aws.Context, input *s3.GetObjectRetentionInput, opts ...request.Option) (*s3.GetObjectRetentionOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetObjectRetentionWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetObjectLegalHoldWithContext(ctx aws.Context, input *s3.GetObjectLegalHoldInput, opts ...request.Option) (*s3.GetObjectLegalHoldOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetObjectLegalHoldWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetObjectTaggingWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := r.write(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.PutObjectWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if err := r.read(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.GetBucketLifecycleConfigurationWithContext(ctx, input, opts...)
+}
+
+func (r *RateLimited) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	if err := r.write(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+
+	return r.S3API.PutBucketLifecycleConfigurationWithContext(ctx, input, opts...)
+}
@@ -0,0 +1,120 @@
+package s3api
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2)
+
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve(now))
+	assert.Equal(t, time.Second, bucket.reserve(now))
+
+	// Tokens refill with time, up to the burst
+	assert.Equal(t, time.Duration(0), bucket.reserve(now.Add(10*time.Second)))
+	assert.Equal(t, time.Duration(0), bucket.reserve(now.Add(10*time.Second)))
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve(now.Add(10*time.Second)))
+}
+
+func TestTokenBucket_SlowRate(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(0.5)
+
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	assert.Equal(t, 2*time.Second, bucket.reserve(now))
+}
+
+func TestRateLimited(t *testing.T) {
+	api := NewRateLimited(&failingS3{}, RateLimits{
+		ListRPS:       1000,
+		BucketListRPS: map[string]float64{"slow-bucket": 20},
+	})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, err := api.ListObjectVersionsWithContext(context.Background(), &s3.ListObjectVersionsInput{Bucket: aws.String("fast-bucket")})
+		assert.Nil(t, err)
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+	assert.Equal(t, time.Duration(0), api.WaitTime())
+
+	// The 20 first requests use the burst, the 2 next ones wait 50ms each
+	var wg sync.WaitGroup
+	for i := 0; i < 22; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			api.ListObjectVersionsWithContext(context.Background(), &s3.ListObjectVersionsInput{Bucket: aws.String("slow-bucket")})
+		}()
+	}
+	wg.Wait()
+
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.True(t, api.WaitTime() >= 140*time.Millisecond)
+}
+
+func TestRateLimited_Cancelled(t *testing.T) {
+	api := NewRateLimited(&failingS3{}, RateLimits{ListRPS: 0.001})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	_, err := api.ListObjectVersionsWithContext(ctx, &s3.ListObjectVersionsInput{})
+	assert.Nil(t, err)
+
+	cancel()
+	_, err = api.ListObjectVersionsWithContext(ctx, &s3.ListObjectVersionsInput{})
+	assert.Equal(t, context.Canceled, err)
+	// Only the time actually spent waiting is counted
+	assert.True(t, api.WaitTime() < time.Second)
+}
+
+// recordingS3 records the tagging and lifecycle requests
+type recordingS3 struct {
+	S3API
+	calls int
+}
+
+func (r *recordingS3) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	r.calls++
+	return &s3.GetObjectTaggingOutput{}, nil
+}
+
+func (r *recordingS3) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	r.calls++
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func TestRateLimited_AllRequests(t *testing.T) {
+	recording := &recordingS3{}
+	api := NewRateLimited(recording, RateLimits{
+		BucketListRPS:   map[string]float64{"b1": 0.001},
+		BucketDeleteRPS: map[string]float64{"b1": 0.001},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The reads and writes take the tokens of the list and delete limits
+	_, err := api.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String("b1")})
+	assert.Nil(t, err)
+	_, err = api.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{Bucket: aws.String("b1")})
+	assert.Nil(t, err)
+
+	cancel()
+	_, err = api.ListObjectVersionsWithContext(ctx, &s3.ListObjectVersionsInput{Bucket: aws.String("b1")})
+	assert.Equal(t, context.Canceled, err)
+	_, err = api.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{Bucket: aws.String("b1")})
+	assert.Equal(t, context.Canceled, err)
+	_, err = api.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String("b2")})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, recording.calls)
+}
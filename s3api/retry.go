@@ -0,0 +1,337 @@
+package s3api
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultThrottlingCodes error codes returned when S3 throttles the requests
+var DefaultThrottlingCodes = map[string]bool{
+	"SlowDown":             true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestLimitExceeded": true,
+	"TooManyRequests":      true,
+}
+
+// DefaultTransientCodes error codes of failures that usually succeed when retried
+var DefaultTransientCodes = map[string]bool{
+	"ServiceUnavailable": true,
+	"InternalError":      true,
+	"RequestTimeout":     true,
+	"RequestError":       true,
+	"OperationAborted":   true,
+}
+
+// RetryPolicy configures how failed S3 calls are retried
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of calls, including the first one
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for every following retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries
+	MaxDelay time.Duration
+	// ThrottlingCodes are the error codes signalling throttling, they are always retried
+	ThrottlingCodes map[string]bool
+	// TransientCodes are the other error codes to retry
+	TransientCodes map[string]bool
+	// OnRetry is called before waiting for a retry
+	OnRetry func(operation string, err error, attempt int, delay time.Duration)
+}
+
+// DefaultRetryPolicy returns the policy used when none is configured
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     5,
+		BaseDelay:       200 * time.Millisecond,
+		MaxDelay:        20 * time.Second,
+		ThrottlingCodes: DefaultThrottlingCodes,
+		TransientCodes:  DefaultTransientCodes,
+	}
+}
+
+// IsThrottling reports whether the error is a throttling response
+func (p RetryPolicy) IsThrottling(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok && p.ThrottlingCodes[awsErr.Code()] {
+		return true
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusServiceUnavailable {
+		return true
+	}
+
+	return false
+}
+
+// IsRetryable reports whether the call failing with the error should be retried
+func (p RetryPolicy) IsRetryable(err error) bool {
+	if p.IsThrottling(err) {
+		return true
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		if awsErr.Code() == request.CanceledErrorCode {
+			return false
+		}
+		if p.TransientCodes[awsErr.Code()] {
+			return true
+		}
+	}
+
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+
+	return false
+}
+
+// isRetryableCode reports whether an error code reported for a key of DeleteObjects should be retried
+func (p RetryPolicy) isRetryableCode(code string) bool {
+	return p.ThrottlingCodes[code] || p.TransientCodes[code]
+}
+
+// delay returns the jittered delay before the given retry (starting at 1)
+func (p RetryPolicy) delay(retry int) time.Duration {
+	backoff := p.BaseDelay << uint(retry-1)
+	if backoff <= 0 || backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+
+	// Full jitter: spread the retries of concurrent callers over the whole backoff window
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryingS3 retries the S3 calls used to find and delete file versions. PutObject is not retried here,
+// its body can't be read again. The S3 client must not retry on its own (MaxRetries set to 0), the retries
+// would multiply and the throttling would be absorbed before reaching OnRetry.
+type retryingS3 struct {
+	S3API
+	policy RetryPolicy
+}
+
+// NewRetrying wraps the API to retry throttled and transient failures with exponential backoff
+func NewRetrying(api S3API, policy RetryPolicy) S3API {
+	return &retryingS3{
+		S3API:  api,
+		policy: policy,
+	}
+}
+
+func (r *retryingS3) retry(ctx aws.Context, operation string, call func() error) error {
+	attempt := 1
+	for {
+		err := call()
+		if err == nil || attempt >= r.policy.MaxAttempts || !r.policy.IsRetryable(err) {
+			return err
+		}
+
+		if !r.wait(ctx, operation, err, attempt) {
+			return err
+		}
+		attempt++
+	}
+}
+
+// wait waits before retrying, it returns false when the context is done first
+func (r *retryingS3) wait(ctx aws.Context, operation string, err error, attempt int) bool {
+	delay := r.policy.delay(attempt)
+	if r.policy.OnRetry != nil {
+		r.policy.OnRetry(operation, err, attempt, delay)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *retryingS3) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput, opts ...request.Option) (output *s3.ListBucketsOutput, err error) {
+	err = r.retry(ctx, "ListBuckets", func() error {
+		output, err = r.S3API.ListBucketsWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (output *s3.HeadBucketOutput, err error) {
+	err = r.retry(ctx, "HeadBucket", func() error {
+		output, err = r.S3API.HeadBucketWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (output *s3.GetBucketLocationOutput, err error) {
+	err = r.retry(ctx, "GetBucketLocation", func() error {
+		output, err = r.S3API.GetBucketLocationWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, opts ...request.Option) (output *s3.GetBucketVersioningOutput, err error) {
+	err = r.retry(ctx, "GetBucketVersioning", func() error {
+		output, err = r.S3API.GetBucketVersioningWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) ListObjectVersionsWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, opts ...request.Option) (output *s3.ListObjectVersionsOutput, err error) {
+	err = r.retry(ctx, "ListObjectVersions", func() error {
+		output, err = r.S3API.ListObjectVersionsWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+// DeleteObjectsWithContext also retries the keys S3 failed to delete with a throttling or transient error code,
+// which are reported in a successful response. The keys still failing once the attempts are exhausted are
+// returned with their last error.
+func (r *retryingS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	output := &s3.DeleteObjectsOutput{}
+	pending := input
+	var retrying []*s3.Error
+
+	for attempt := 1; ; attempt++ {
+		var response *s3.DeleteObjectsOutput
+		err := r.retry(ctx, "DeleteObjects", func() (err error) {
+			response, err = r.S3API.DeleteObjectsWithContext(ctx, pending, opts...)
+			return err
+		})
+		if err != nil {
+			if attempt == 1 {
+				return nil, err
+			}
+			output.Errors = append(output.Errors, retrying...)
+			return output, nil
+		}
+
+		output.Deleted = append(output.Deleted, response.Deleted...)
+		retrying = nil
+		for _, keyErr := range response.Errors {
+			if r.policy.isRetryableCode(aws.StringValue(keyErr.Code)) {
+				retrying = append(retrying, keyErr)
+			} else {
+				output.Errors = append(output.Errors, keyErr)
+			}
+		}
+
+		if len(retrying) == 0 || attempt >= r.policy.MaxAttempts {
+			output.Errors = append(output.Errors, retrying...)
+			return output, nil
+		}
+
+		keysErr := awserr.New(aws.StringValue(retrying[0].Code), fmt.Sprintf("%d keys failed to delete", len(retrying)), nil)
+		if !r.wait(ctx, "DeleteObjects", keysErr, attempt) {
+			output.Errors = append(output.Errors, retrying...)
+			return output, nil
+		}
+
+		retry := *input
+		retry.Delete = &s3.Delete{Quiet: input.Delete.Quiet}
+		for _, keyErr := range retrying {
+			retry.Delete.Objects = append(retry.Delete.Objects, &s3.ObjectIdentifier{Key: keyErr.Key, VersionId: keyErr.VersionId})
+		}
+		pending = &retry
+	}
+}
+
+func (r *retryingS3) GetObjectLockConfigurationWithContext(ctx aws.Context, input *s3.GetObjectLockConfigurationInput, opts ...request.Option) (output *s3.GetObjectLockConfigurationOutput, err error) {
+	err = r.retry(ctx, "GetObjectLockConfiguration", func() error {
+		output, err = r.S3API.GetObjectLockConfigurationWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetObjectRetentionWithContext(ctx aws.Context, input *s3.GetObjectRetentionInput, opts ...request.Option) (output *s3.GetObjectRetentionOutput, err error) {
+	err = r.retry(ctx, "GetObjectRetention", func() error {
+		output, err = r.S3API.GetObjectRetentionWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetObjectLegalHoldWithContext(ctx aws.Context, input *s3.GetObjectLegalHoldInput, opts ...request.Option) (output *s3.GetObjectLegalHoldOutput, err error) {
+	err = r.retry(ctx, "GetObjectLegalHold", func() error {
+		output, err = r.S3API.GetObjectLegalHoldWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (output *s3.GetObjectTaggingOutput, err error) {
+	err = r.retry(ctx, "GetObjectTagging", func() error {
+		output, err = r.S3API.GetObjectTaggingWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (output *s3.GetObjectOutput, err error) {
+	err = r.retry(ctx, "GetObject", func() error {
+		output, err = r.S3API.GetObjectWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, opts ...request.Option) (output *s3.GetBucketLifecycleConfigurationOutput, err error) {
+	err = r.retry(ctx, "GetBucketLifecycleConfiguration", func() error {
+		output, err = r.S3API.GetBucketLifecycleConfigurationWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (output *s3.PutBucketLifecycleConfigurationOutput, err error) {
+	err = r.retry(ctx, "PutBucketLifecycleConfiguration", func() error {
+		output, err = r.S3API.PutBucketLifecycleConfigurationWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (output *s3.ListMultipartUploadsOutput, err error) {
+	err = r.retry(ctx, "ListMultipartUploads", func() error {
+		output, err = r.S3API.ListMultipartUploadsWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (output *s3.ListPartsOutput, err error) {
+	err = r.retry(ctx, "ListParts", func() error {
+		output, err = r.S3API.ListPartsWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (output *s3.AbortMultipartUploadOutput, err error) {
+	err = r.retry(ctx, "AbortMultipartUpload", func() error {
+		output, err = r.S3API.AbortMultipartUploadWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
+
+func (r *retryingS3) PutBucketVersioningWithContext(ctx aws.Context, input *s3.PutBucketVersioningInput, opts ...request.Option) (output *s3.PutBucketVersioningOutput, err error) {
+	err = r.retry(ctx, "PutBucketVersioning", func() error {
+		output, err = r.S3API.PutBucketVersioningWithContext(ctx, input, opts...)
+		return err
+	})
+	return output, err
+}
@@ -0,0 +1,215 @@
+package s3api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type failingS3 struct {
+	S3API
+	mu     sync.Mutex
+	errors []error
+	calls  int
+}
+
+func (f *failingS3) ListObjectVersionsWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, opts ...request.Option) (*s3.ListObjectVersionsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if len(f.errors) > 0 {
+		err := f.errors[0]
+		f.errors = f.errors[1:]
+		return nil, err
+	}
+
+	return &s3.ListObjectVersionsOutput{}, nil
+}
+
+func testRetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	policy.MaxDelay = 2 * time.Millisecond
+	return policy
+}
+
+func TestRetryPolicy_Classification(t *testing.T) {
+	policy := DefaultRetryPolicy()
+
+	assert.True(t, policy.IsThrottling(awserr.New("SlowDown", "", nil)))
+	assert.True(t, policy.IsThrottling(awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, "id")))
+	assert.False(t, policy.IsThrottling(awserr.New("InternalError", "", nil)))
+
+	assert.True(t, policy.IsRetryable(awserr.New("SlowDown", "", nil)))
+	assert.True(t, policy.IsRetryable(awserr.New("InternalError", "", nil)))
+	assert.True(t, policy.IsRetryable(awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 502, "id")))
+	assert.False(t, policy.IsRetryable(awserr.New("AccessDenied", "", nil)))
+	assert.False(t, policy.IsRetryable(awserr.New(request.CanceledErrorCode, "", nil)))
+	assert.False(t, policy.IsRetryable(errors.New("not an AWS error")))
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, policy.delay(1) <= 10*time.Millisecond)
+		assert.True(t, policy.delay(3) <= 40*time.Millisecond)
+		assert.True(t, policy.delay(10) <= 50*time.Millisecond)
+		assert.True(t, policy.delay(100) <= 50*time.Millisecond)
+	}
+}
+
+func TestRetrying(t *testing.T) {
+	api := &failingS3{errors: []error{awserr.New("SlowDown", "", nil), awserr.New("InternalError", "", nil)}}
+	retries := []string{}
+	policy := testRetryPolicy()
+	policy.OnRetry = func(operation string, err error, attempt int, delay time.Duration) {
+		retries = append(retries, operation+" "+err.(awserr.Error).Code())
+	}
+
+	_, err := NewRetrying(api, policy).ListObjectVersionsWithContext(context.Background(), &s3.ListObjectVersionsInput{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, api.calls)
+	assert.Equal(t, []string{"ListObjectVersions SlowDown", "ListObjectVersions InternalError"}, retries)
+}
+
+func TestRetrying_MaxAttempts(t *testing.T) {
+	api := &failingS3{errors: []error{awserr.New("SlowDown", "", nil), awserr.New("SlowDown", "", nil), awserr.New("SlowDown", "", nil)}}
+	policy := testRetryPolicy()
+	policy.MaxAttempts = 2
+
+	_, err := NewRetrying(api, policy).ListObjectVersionsWithContext(context.Background(), &s3.ListObjectVersionsInput{})
+	assert.Equal(t, "SlowDown", err.(awserr.Error).Code())
+	assert.Equal(t, 2, api.calls)
+}
+
+func TestRetrying_NotRetryable(t *testing.T) {
+	api := &failingS3{errors: []error{awserr.New("AccessDenied", "", nil)}}
+
+	_, err := NewRetrying(api, testRetryPolicy()).ListObjectVersionsWithContext(context.Background(), &s3.ListObjectVersionsInput{})
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+	assert.Equal(t, 1, api.calls)
+}
+
+func TestRetrying_Cancelled(t *testing.T) {
+	api := &failingS3{errors: []error{awserr.New("SlowDown", "", nil)}}
+	policy := testRetryPolicy()
+	policy.BaseDelay = time.Hour
+	policy.MaxDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	policy.OnRetry = func(operation string, err error, attempt int, delay time.Duration) {
+		cancel()
+	}
+
+	_, err := NewRetrying(api, policy).ListObjectVersionsWithContext(ctx, &s3.ListObjectVersionsInput{})
+	assert.Equal(t, "SlowDown", err.(awserr.Error).Code())
+	assert.Equal(t, 1, api.calls)
+}
+
+// keyFailingS3 fails to delete the keys with the error codes given for each call, the other keys are deleted
+type keyFailingS3 struct {
+	S3API
+	codes  []map[string]string
+	inputs [][]string
+}
+
+func (f *keyFailingS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	codes := map[string]string{}
+	if len(f.codes) > 0 {
+		codes = f.codes[0]
+		f.codes = f.codes[1:]
+	}
+
+	keys := []string{}
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		key := aws.StringValue(object.Key)
+		keys = append(keys, key)
+		if code, ok := codes[key]; ok {
+			output.Errors = append(output.Errors, &s3.Error{Key: object.Key, VersionId: object.VersionId, Code: aws.String(code)})
+		} else {
+			output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: object.Key, VersionId: object.VersionId})
+		}
+	}
+	f.inputs = append(f.inputs, keys)
+
+	return output, nil
+}
+
+func deleteInput(keys ...string) *s3.DeleteObjectsInput {
+	input := &s3.DeleteObjectsInput{Bucket: aws.String("b1"), Delete: &s3.Delete{Quiet: aws.Bool(true)}}
+	for _, key := range keys {
+		input.Delete.Objects = append(input.Delete.Objects, &s3.ObjectIdentifier{Key: aws.String(key), VersionId: aws.String("v1")})
+	}
+
+	return input
+}
+
+func errorKeys(output *s3.DeleteObjectsOutput) []string {
+	keys := []string{}
+	for _, keyErr := range output.Errors {
+		keys = append(keys, aws.StringValue(keyErr.Key)+" "+aws.StringValue(keyErr.Code))
+	}
+
+	return keys
+}
+
+func TestRetrying_DeleteObjectsKeyErrors(t *testing.T) {
+	api := &keyFailingS3{codes: []map[string]string{
+		{"k2": "SlowDown", "k3": "AccessDenied", "k4": "InternalError"},
+		{"k4": "InternalError"},
+	}}
+	retries := []string{}
+	policy := testRetryPolicy()
+	policy.OnRetry = func(operation string, err error, attempt int, delay time.Duration) {
+		retries = append(retries, operation+" "+err.(awserr.Error).Code())
+	}
+
+	output, err := NewRetrying(api, policy).DeleteObjectsWithContext(context.Background(), deleteInput("k1", "k2", "k3", "k4"))
+	assert.Nil(t, err)
+	// Only the keys failing with a retryable code are sent again
+	assert.Equal(t, [][]string{{"k1", "k2", "k3", "k4"}, {"k2", "k4"}, {"k4"}}, api.inputs)
+	assert.Equal(t, []string{"DeleteObjects SlowDown", "DeleteObjects InternalError"}, retries)
+	assert.Equal(t, 3, len(output.Deleted))
+	assert.Equal(t, []string{"k3 AccessDenied"}, errorKeys(output))
+}
+
+func TestRetrying_DeleteObjectsKeyErrorsMaxAttempts(t *testing.T) {
+	api := &keyFailingS3{codes: []map[string]string{{"k2": "SlowDown"}, {"k2": "SlowDown"}, {"k2": "SlowDown"}}}
+	policy := testRetryPolicy()
+	policy.MaxAttempts = 2
+
+	output, err := NewRetrying(api, policy).DeleteObjectsWithContext(context.Background(), deleteInput("k1", "k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(api.inputs))
+	assert.Equal(t, 1, len(output.Deleted))
+	assert.Equal(t, []string{"k2 SlowDown"}, errorKeys(output))
+}
+
+func TestRetrying_DeleteObjectsKeyErrorsCancelled(t *testing.T) {
+	api := &keyFailingS3{codes: []map[string]string{{"k2": "SlowDown"}}}
+	policy := testRetryPolicy()
+	policy.BaseDelay = time.Hour
+	policy.MaxDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	policy.OnRetry = func(operation string, err error, attempt int, delay time.Duration) {
+		cancel()
+	}
+
+	output, err := NewRetrying(api, policy).DeleteObjectsWithContext(ctx, deleteInput("k1", "k2"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(api.inputs))
+	assert.Equal(t, []string{"k2 SlowDown"}, errorKeys(output))
+}
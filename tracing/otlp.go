@@ -0,0 +1,319 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const otlpTracesPath = "/v1/traces"
+const defaultBatchSize = 256
+const defaultMaxQueueSize = 2048
+const defaultFlushInterval = 5 * time.Second
+const instrumentationScope = "github.com/croman/delete-s3-versions"
+
+// Span status codes defined by OTLP
+const (
+	statusCodeOk    = 1
+	statusCodeError = 2
+)
+
+const spanKindInternal = 1
+
+// OTLPExporter exports spans to an OpenTelemetry collector using OTLP over HTTP with JSON encoding. The spans
+// are queued and sent in batches by a background goroutine, ending a span never waits for the collector.
+type OTLPExporter struct {
+	mu           sync.Mutex
+	url          string
+	serviceName  string
+	client       *http.Client
+	batchSize    int
+	maxQueueSize int
+	pending      []*Span
+	dropped      int
+	err          error
+
+	flush    chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewOTLPExporter create a new exporter sending spans to the given collector endpoint (e.g. http://localhost:4318)
+func NewOTLPExporter(endpoint string, serviceName string) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, otlpTracesPath) {
+		url += otlpTracesPath
+	}
+
+	e := &OTLPExporter{
+		url:          url,
+		serviceName:  serviceName,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		batchSize:    defaultBatchSize,
+		maxQueueSize: defaultMaxQueueSize,
+		flush:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go e.run(defaultFlushInterval)
+
+	return e
+}
+
+// Export queues the spans, the background goroutine is woken up once a batch is full. The spans are dropped
+// when the queue is full, the collector being too slow or unreachable.
+func (e *OTLPExporter) Export(spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, span := range spans {
+		if len(e.pending) >= e.maxQueueSize {
+			e.dropped++
+			continue
+		}
+		e.pending = append(e.pending, span)
+	}
+
+	if len(e.pending) >= e.batchSize {
+		select {
+		case e.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// run sends the queued spans when a batch is full and at every interval, until the exporter is shut down
+func (e *OTLPExporter) run(interval time.Duration) {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-e.flush:
+		case <-ticker.C:
+		}
+
+		if err := e.sendPending(context.Background()); err != nil {
+			e.mu.Lock()
+			e.err = err
+			e.mu.Unlock()
+		}
+	}
+}
+
+// sendPending sends the queued spans, by batches
+func (e *OTLPExporter) sendPending(ctx context.Context) error {
+	for {
+		e.mu.Lock()
+		batch := e.pending
+		if len(batch) > e.batchSize {
+			batch = batch[:e.batchSize]
+		}
+		e.pending = e.pending[len(batch):]
+		e.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := e.send(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Flush sends the queued spans to the collector, the exporter keeps running. It returns the last export error,
+// and an error when spans were dropped since the previous flush.
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	if err := e.sendPending(ctx); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err, dropped := e.err, e.dropped
+	e.err, e.dropped = nil, 0
+	if err != nil {
+		return err
+	}
+	if dropped > 0 {
+		return fmt.Errorf("%d spans were dropped, the OTLP export queue was full", dropped)
+	}
+
+	return nil
+}
+
+// Shutdown stops the background goroutine and flushes the queued spans
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.stopOnce.Do(func() { close(e.done) })
+	select {
+	case <-e.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return e.Flush(ctx)
+}
+
+func (e *OTLPExporter) send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP export to %s failed: %s", e.url, resp.Status)
+	}
+
+	return nil
+}
+
+// OTLP JSON payload, see https://github.com/open-telemetry/opentelemetry-proto
+
+type otlpPayload struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func (e *OTLPExporter) payload(spans []*Span) *otlpPayload {
+	otlpSpans := []otlpSpan{}
+	for _, span := range spans {
+		otlpSpans = append(otlpSpans, toOTLPSpan(span))
+	}
+
+	return &otlpPayload{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpAttribute{toOTLPAttribute(String("service.name", e.serviceName))},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: instrumentationScope},
+						Spans: otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func toOTLPSpan(span *Span) otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	attributes := []otlpAttribute{}
+	for _, attribute := range span.Attributes {
+		attributes = append(attributes, toOTLPAttribute(attribute))
+	}
+
+	status := otlpStatus{Code: statusCodeOk}
+	if span.Err != nil {
+		status = otlpStatus{Code: statusCodeError, Message: span.Err.Error()}
+	}
+
+	return otlpSpan{
+		TraceID:           span.TraceID,
+		SpanID:            span.SpanID,
+		ParentSpanID:      span.ParentSpanID,
+		Name:              span.Name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		Attributes:        attributes,
+		Status:            status,
+	}
+}
+
+func toOTLPAttribute(attribute Attribute) otlpAttribute {
+	value := otlpValue{}
+
+	switch v := attribute.Value.(type) {
+	case string:
+		value.StringValue = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	case int:
+		s := strconv.Itoa(v)
+		value.IntValue = &s
+	case bool:
+		value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+
+	return otlpAttribute{Key: attribute.Key, Value: value}
+}
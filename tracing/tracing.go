@@ -0,0 +1,213 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type spanContextKey struct{}
+type remoteParentKey struct{}
+
+// Attribute a key/value pair describing a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String creates a string attribute
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Int creates an integer attribute
+func Int(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Exporter sends ended spans to a tracing backend
+type Exporter interface {
+	Export(spans []*Span) error
+	// Flush sends the spans exported so far, the exporter can still be used afterwards
+	Flush(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+// SpanContext identifies a span started by a caller, e.g. with OpenTelemetry or in another process. The IDs
+// are hexadecimal, 32 digits for the trace and 16 for the span.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// IsValid reports whether the IDs have the right length and aren't all zeros
+func (sc SpanContext) IsValid() bool {
+	return isValidID(sc.TraceID, 16) && isValidID(sc.SpanID, 8)
+}
+
+func isValidID(id string, size int) bool {
+	decoded, err := hex.DecodeString(id)
+	if err != nil || len(decoded) != size || strings.ToLower(id) != id {
+		return false
+	}
+	for _, b := range decoded {
+		if b != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContextWithRemoteParent returns a context whose spans are children of the given span, when the context
+// has no span of this package. An invalid span context is ignored.
+func ContextWithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	if !parent.IsValid() {
+		return ctx
+	}
+
+	return context.WithValue(ctx, remoteParentKey{}, parent)
+}
+
+// ContextWithTraceparent is ContextWithRemoteParent with the parent of a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ContextWithTraceparent(ctx context.Context, traceparent string) (context.Context, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return ctx, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+
+	parent := SpanContext{TraceID: parts[1], SpanID: parts[2]}
+	if !parent.IsValid() {
+		return ctx, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+
+	return ContextWithRemoteParent(ctx, parent), nil
+}
+
+// Tracer creates spans and exports them when they end. A nil Tracer creates no spans.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer create a new Tracer exporting spans with the given exporter
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{
+		exporter: exporter,
+	}
+}
+
+// Start starts a span, child of the span found in the context if any, or of the remote parent of the context
+func (t *Tracer) Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:    t,
+		Name:      name,
+		StartTime: time.Now(),
+	}
+	span.SetAttributes(attributes...)
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else if parent, ok := ctx.Value(remoteParentKey{}).(SpanContext); ok {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = randomID(16)
+	}
+	span.SpanID = randomID(8)
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Flush exports the pending spans, the tracer can still be used afterwards
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.exporter.Flush(ctx)
+}
+
+// Shutdown exports the pending spans and stops the exporter, the spans ended afterwards are never exported
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.exporter.Shutdown(ctx)
+}
+
+// SpanFromContext returns the current span, or nil when the context has none
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// Span a timed operation. All methods are safe to call on a nil Span.
+type Span struct {
+	mu           sync.Mutex
+	tracer       *Tracer
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   []Attribute
+	Err          error
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Attributes = append(s.Attributes, attributes...)
+}
+
+// RecordError marks the span as failed
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Err = err
+}
+
+// End ends the span and hands it to the exporter
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.exporter.Export([]*Span{s})
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("cannot generate a trace id: %v", err))
+	}
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop")
+	span.SetAttributes(String("key", "value"))
+	span.RecordError(errors.New("ignored"))
+	span.End()
+
+	assert.Nil(t, span)
+	assert.Nil(t, SpanFromContext(ctx))
+	assert.Nil(t, tracer.Shutdown(context.Background()))
+}
+
+func TestSpanHierarchy(t *testing.T) {
+	tracer := NewTracer(NewOTLPExporter("http://localhost:0", "test"))
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	_, child := tracer.Start(ctx, "child")
+
+	assert.Equal(t, parent, SpanFromContext(ctx))
+	assert.Equal(t, 32, len(parent.TraceID))
+	assert.Equal(t, 16, len(parent.SpanID))
+	assert.Equal(t, "", parent.ParentSpanID)
+	assert.Equal(t, parent.TraceID, child.TraceID)
+	assert.Equal(t, parent.SpanID, child.ParentSpanID)
+	assert.NotEqual(t, parent.SpanID, child.SpanID)
+}
+
+func TestOTLPExport(t *testing.T) {
+	var payload map[string]interface{}
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(NewOTLPExporter(collector.URL, "test-service"))
+	ctx, parent := tracer.Start(context.Background(), "parent", String("bucket", "b1"))
+	_, child := tracer.Start(ctx, "child", Int("page", 2))
+	child.RecordError(errors.New("SlowDown"))
+	child.End()
+	parent.End()
+
+	assert.Nil(t, payload)
+	require.Nil(t, tracer.Shutdown(context.Background()))
+
+	assert.Equal(t, "/v1/traces", path)
+	resourceSpans := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})
+	assert.Equal(t, "test-service", resource["attributes"].([]interface{})[0].(map[string]interface{})["value"].(map[string]interface{})["stringValue"])
+
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	require.Equal(t, 2, len(spans))
+
+	childSpan := spans[0].(map[string]interface{})
+	assert.Equal(t, "child", childSpan["name"])
+	assert.Equal(t, parent.SpanID, childSpan["parentSpanId"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "SlowDown"}, childSpan["status"])
+	assert.Equal(t, "2", childSpan["attributes"].([]interface{})[0].(map[string]interface{})["value"].(map[string]interface{})["intValue"])
+
+	parentSpan := spans[1].(map[string]interface{})
+	assert.Equal(t, "parent", parentSpan["name"])
+	assert.Nil(t, parentSpan["parentSpanId"])
+}
+
+func TestOTLPExport_CollectorError(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	tracer := NewTracer(NewOTLPExporter(collector.URL+"/v1/traces", "test-service"))
+	_, span := tracer.Start(context.Background(), "span")
+	span.End()
+
+	assert.NotNil(t, tracer.Shutdown(context.Background()))
+}
+
+func TestOTLPExport_EndDoesNotWait(t *testing.T) {
+	received := make(chan int, 10)
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var payload otlpPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		received <- len(payload.ResourceSpans[0].ScopeSpans[0].Spans)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "test-service")
+	exporter.batchSize = 2
+	tracer := NewTracer(exporter)
+
+	// The collector doesn't answer, the full batches are sent in the background
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		_, span := tracer.Start(context.Background(), "span")
+		span.End()
+	}
+	assert.True(t, time.Since(start) < time.Second)
+
+	close(release)
+	require.Nil(t, tracer.Shutdown(context.Background()))
+	close(received)
+
+	total := 0
+	for count := range received {
+		assert.True(t, count <= 2)
+		total += count
+	}
+	assert.Equal(t, 5, total)
+}
+
+func TestOTLPExport_QueueFull(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "test-service")
+	exporter.maxQueueSize = 2
+	tracer := NewTracer(exporter)
+	for i := 0; i < 3; i++ {
+		_, span := tracer.Start(context.Background(), "span")
+		span.End()
+	}
+
+	err := tracer.Shutdown(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "1 spans were dropped, the OTLP export queue was full", err.Error())
+}
+
+func TestRemoteParent(t *testing.T) {
+	tracer := NewTracer(NewOTLPExporter("http://localhost:0", "test"))
+	parent := SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+
+	ctx, span := tracer.Start(ContextWithRemoteParent(context.Background(), parent), "span")
+	assert.Equal(t, parent.TraceID, span.TraceID)
+	assert.Equal(t, parent.SpanID, span.ParentSpanID)
+
+	// The spans of this package take precedence
+	_, child := tracer.Start(ContextWithRemoteParent(ctx, SpanContext{TraceID: "1bf92f3577b34da6a3ce929d0e0e4736", SpanID: "10f067aa0ba902b7"}), "child")
+	assert.Equal(t, span.SpanID, child.ParentSpanID)
+
+	// Invalid parents are ignored
+	_, root := tracer.Start(ContextWithRemoteParent(context.Background(), SpanContext{TraceID: "00000000000000000000000000000000", SpanID: "00f067aa0ba902b7"}), "root")
+	assert.Equal(t, "", root.ParentSpanID)
+}
+
+func TestContextWithTraceparent(t *testing.T) {
+	tracer := NewTracer(NewOTLPExporter("http://localhost:0", "test"))
+
+	ctx, err := ContextWithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Nil(t, err)
+	_, span := tracer.Start(ctx, "span")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", span.ParentSpanID)
+
+	for _, traceparent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+	} {
+		_, err := ContextWithTraceparent(context.Background(), traceparent)
+		assert.NotNil(t, err, traceparent)
+	}
+}
+
+func TestOTLPExport_Flush(t *testing.T) {
+	received := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload otlpPayload
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+		for _, span := range payload.ResourceSpans[0].ScopeSpans[0].Spans {
+			received <- span.Name
+		}
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "test-service")
+	exporter.maxQueueSize = 1
+	tracer := NewTracer(exporter)
+
+	// The exporter keeps running after a flush, the next spans are still exported
+	for _, name := range []string{"first", "second"} {
+		_, span := tracer.Start(context.Background(), name)
+		span.End()
+		require.Nil(t, tracer.Flush(context.Background()))
+		assert.Equal(t, name, <-received)
+	}
+
+	_, span := tracer.Start(context.Background(), "exported")
+	span.End()
+	_, span = tracer.Start(context.Background(), "dropped")
+	span.End()
+	err := tracer.Flush(context.Background())
+	require.NotNil(t, err)
+	assert.Equal(t, "1 spans were dropped, the OTLP export queue was full", err.Error())
+	assert.Equal(t, "exported", <-received)
+
+	// The dropped spans are reported once
+	require.Nil(t, tracer.Shutdown(context.Background()))
+}
@@ -0,0 +1,123 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/croman/delete-s3-versions/metrics"
+)
+
+var errAccountsPlan = errors.New("Plan and Execute don't support --account-role-arn, create an instance per account with --role-arn")
+
+// accountsVersions runs the commands against several accounts, by assuming a role in each of them in turn
+type accountsVersions struct {
+	roleARNs []string
+	accounts []S3Versions
+	metrics  *runMetrics
+	logger   Logger
+}
+
+func newAccountsVersions(o *options) *accountsVersions {
+	// The accounts share the metrics, their buckets are labelled by name, and the prompts
+	m := newRunMetrics()
+	prompt := o.prompter
+	if prompt == nil {
+		prompt = newTerminalPrompter()
+	}
+	accounts := []S3Versions{}
+	for _, roleARN := range o.config.AccountRoleARNs {
+		account := *o.config
+		account.RoleARN = roleARN
+		account.AccountRoleARNs = nil
+
+		accountOptions := *o
+		accountOptions.config = &account
+		accountOptions.prompter = prompt
+		accounts = append(accounts, newS3Versions(&accountOptions, m))
+	}
+
+	return &accountsVersions{
+		roleARNs: o.config.AccountRoleARNs,
+		accounts: accounts,
+		metrics:  m,
+		logger:   o.logger,
+	}
+}
+
+// each runs the command against every account. A failing account doesn't stop the others, unless the
+// context is cancelled.
+func (a *accountsVersions) each(ctx context.Context, command func(S3Versions) error) error {
+	failed := 0
+	for i, account := range a.accounts {
+		a.logger.Printf("Assuming %s (account %d of %d)", a.roleARNs[i], i+1, len(a.accounts))
+		if err := command(account); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			a.logger.Printf("Failed with %s: %v", a.roleARNs[i], err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed in %d of %d accounts", failed, len(a.accounts))
+	}
+
+	return nil
+}
+
+func (a *accountsVersions) Delete() error {
+	return a.DeleteWithContext(context.Background())
+}
+
+func (a *accountsVersions) DeleteWithContext(ctx context.Context) error {
+	return a.each(ctx, func(account S3Versions) error { return account.DeleteWithContext(ctx) })
+}
+
+func (a *accountsVersions) Stats() error {
+	return a.StatsWithContext(context.Background())
+}
+
+func (a *accountsVersions) StatsWithContext(ctx context.Context) error {
+	return a.each(ctx, func(account S3Versions) error { return account.StatsWithContext(ctx) })
+}
+
+func (a *accountsVersions) Lifecycle() error {
+	return a.LifecycleWithContext(context.Background())
+}
+
+func (a *accountsVersions) LifecycleWithContext(ctx context.Context) error {
+	return a.each(ctx, func(account S3Versions) error { return account.LifecycleWithContext(ctx) })
+}
+
+func (a *accountsVersions) Audit() error {
+	return a.AuditWithContext(context.Background())
+}
+
+func (a *accountsVersions) AuditWithContext(ctx context.Context) error {
+	return a.each(ctx, func(account S3Versions) error { return account.AuditWithContext(ctx) })
+}
+
+func (a *accountsVersions) Versioning() error {
+	return a.VersioningWithContext(context.Background())
+}
+
+func (a *accountsVersions) VersioningWithContext(ctx context.Context) error {
+	return a.each(ctx, func(account S3Versions) error { return account.VersioningWithContext(ctx) })
+}
+
+// Metrics returns the metrics recorded in all the accounts
+func (a *accountsVersions) Metrics() *metrics.Registry {
+	return a.metrics.registry
+}
+
+// Plan isn't supported with several accounts, the plan of each account must be executed with its role
+func (a *accountsVersions) Plan(ctx context.Context) (*Plan, error) {
+	return nil, errAccountsPlan
+}
+
+// Execute isn't supported with several accounts, see Plan
+func (a *accountsVersions) Execute(ctx context.Context, plan *Plan) (*Result, error) {
+	return nil, errAccountsPlan
+}
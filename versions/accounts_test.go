@@ -0,0 +1,116 @@
+package versions
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/croman/delete-s3-versions/config"
+)
+
+// fakeAccount records the commands run against an account
+type fakeAccount struct {
+	S3Versions
+	commands []string
+	err      error
+	cancel   context.CancelFunc
+}
+
+func (a *fakeAccount) StatsWithContext(ctx context.Context) error {
+	a.commands = append(a.commands, "stats")
+	if a.cancel != nil {
+		a.cancel()
+	}
+
+	return a.err
+}
+
+func newFakeAccounts(accounts ...*fakeAccount) *accountsVersions {
+	a := &accountsVersions{metrics: newRunMetrics(), logger: stdLogger{}}
+	for i, account := range accounts {
+		a.roleARNs = append(a.roleARNs, fmt.Sprintf("arn:aws:iam::%012d:role/cleanup", i+1))
+		a.accounts = append(a.accounts, account)
+	}
+
+	return a
+}
+
+func TestNew_Accounts(t *testing.T) {
+	c := &config.Config{
+		S3Region:        "eu-west-1",
+		AccountRoleARNs: []string{"arn:aws:iam::111111111111:role/cleanup", "arn:aws:iam::222222222222:role/cleanup"},
+	}
+
+	a, ok := New(c).(*accountsVersions)
+	require.True(t, ok)
+	require.Equal(t, 2, len(a.accounts))
+
+	second := a.accounts[1].(*s3Versions)
+	assert.Equal(t, "arn:aws:iam::222222222222:role/cleanup", second.config.RoleARN)
+	assert.Nil(t, second.config.AccountRoleARNs)
+	assert.Equal(t, a.metrics, second.metrics)
+	// The configuration of the run is unchanged
+	assert.Equal(t, 2, len(c.AccountRoleARNs))
+	assert.Empty(t, c.RoleARN)
+}
+
+func TestNew_AccountsSharePrompter(t *testing.T) {
+	c := &config.Config{
+		S3Region:        "eu-west-1",
+		MFASerial:       "arn:aws:iam::111111111111:mfa/user",
+		AccountRoleARNs: []string{"arn:aws:iam::111111111111:role/cleanup", "arn:aws:iam::222222222222:role/cleanup"},
+	}
+
+	a, ok := New(c).(*accountsVersions)
+	require.True(t, ok)
+	assert.True(t, a.accounts[0].(*s3Versions).prompter == a.accounts[1].(*s3Versions).prompter)
+}
+
+func TestAccounts_PipedMFACodes(t *testing.T) {
+	c := &config.Config{
+		S3Region:        "eu-west-1",
+		MFASerial:       "arn:aws:iam::111111111111:mfa/user",
+		AccountRoleARNs: []string{"arn:aws:iam::111111111111:role/cleanup", "arn:aws:iam::222222222222:role/cleanup"},
+	}
+	stdin := &terminalPrompter{in: bufio.NewReader(strings.NewReader("111111\n222222\n")), out: ioutil.Discard}
+	a := newAccountsVersions(&options{config: c, logger: stdLogger{}, prompter: stdin})
+
+	// Each account reads the next code, the first one doesn't buffer the code of the second
+	for i, code := range []string{"111111", "222222"} {
+		header, err := a.accounts[i].(*s3Versions).mfa.header()
+		require.Nil(t, err)
+		assert.Equal(t, "arn:aws:iam::111111111111:mfa/user "+code, header)
+	}
+}
+
+func TestAccounts_ContinueOnError(t *testing.T) {
+	first := &fakeAccount{err: errors.New("AccessDenied")}
+	second := &fakeAccount{}
+	a := newFakeAccounts(first, second)
+
+	err := a.Stats()
+	require.NotNil(t, err)
+	assert.Equal(t, "Failed in 1 of 2 accounts", err.Error())
+	assert.Equal(t, []string{"stats"}, first.commands)
+	assert.Equal(t, []string{"stats"}, second.commands)
+}
+
+func TestAccounts_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first := &fakeAccount{err: context.Canceled, cancel: cancel}
+	second := &fakeAccount{}
+	a := newFakeAccounts(first, second)
+
+	err := a.StatsWithContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Empty(t, second.commands)
+}
@@ -0,0 +1,270 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dustin/go-humanize"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+// lifecycleGracePeriod is how late S3 can be when applying lifecycle rules, they are evaluated asynchronously
+const lifecycleGracePeriod = 2 * 24 * time.Hour
+
+// auditHotspot groups the noncurrent versions of a prefix that no lifecycle rule expires
+type auditHotspot struct {
+	prefix   string
+	keys     int
+	versions int
+	bytes    int64
+	oldest   time.Duration
+	// rule is the rule that should already have expired the versions, nil when the prefix isn't covered
+	rule *s3.LifecycleRule
+	// disabledRule is a disabled rule that would expire the versions of an uncovered prefix
+	disabledRule *s3.LifecycleRule
+}
+
+// Audit reports the noncurrent versions that the lifecycle rules of the buckets don't expire
+func (v *s3Versions) Audit() error {
+	return v.AuditWithContext(context.Background())
+}
+
+// AuditWithContext reports the noncurrent versions that the lifecycle rules of the buckets don't expire
+func (v *s3Versions) AuditWithContext(ctx context.Context) error {
+	ctx, span := v.tracer.Start(ctx, "Audit", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	buckets, err := v.getBuckets(ctx)
+	if err != nil {
+		return err
+	}
+
+	buckets, err = v.filterBucketsByVersioningEnabled(ctx, buckets)
+	if err != nil {
+		return err
+	}
+	v.logger.Println("Found these buckets with versioning enabled", buckets)
+
+	for _, bucket := range buckets {
+		rules, err := v.getLifecycleRules(ctx, bucket)
+		if err != nil {
+			return err
+		}
+
+		fileVersions, err := v.getFileVersions(ctx, bucket)
+		if err != nil {
+			return err
+		}
+
+		hotspots := auditLifecycleRules(fileVersions, rules, v.now(), v.config.Audit.MinVersions)
+		v.printAudit(bucket, rules, hotspots)
+	}
+	v.printRateLimitWaitTime()
+
+	return nil
+}
+
+// auditLifecycleRules finds the noncurrent versions which are not covered by any enabled rule, or which are
+// older than the expiration of the rule covering them, grouped by the "directory" of their key
+func auditLifecycleRules(fileVersions map[string][]*fileVersion, rules []*s3.LifecycleRule, now time.Time, minVersions int) []*auditHotspot {
+	groups := map[string]*auditHotspot{}
+
+	for key, versions := range fileVersions {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].LastModified.After(versions[j].LastModified)
+		})
+
+		rule := expiringRule(rules, key)
+		var maxAge time.Duration
+		if rule != nil {
+			maxAge = time.Duration(aws.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays))*24*time.Hour + lifecycleGracePeriod
+		}
+
+		var hotspot *auditHotspot
+		for i, version := range versions {
+			if version.IsLatest {
+				continue
+			}
+
+			age := now.Sub(noncurrentSince(versions, i))
+			if rule != nil && age <= maxAge {
+				continue
+			}
+
+			if hotspot == nil {
+				prefix := keyDirectory(key)
+				group := prefix + "\x00" + aws.StringValue(ruleID(rule))
+				hotspot = groups[group]
+				if hotspot == nil {
+					hotspot = &auditHotspot{prefix: prefix, rule: rule}
+					if rule == nil {
+						hotspot.disabledRule = disabledExpiringRule(rules, prefix)
+					}
+					groups[group] = hotspot
+				}
+				hotspot.keys++
+			}
+
+			hotspot.versions++
+			hotspot.bytes += version.Size
+			if age > hotspot.oldest {
+				hotspot.oldest = age
+			}
+		}
+	}
+
+	hotspots := []*auditHotspot{}
+	for _, hotspot := range groups {
+		if hotspot.versions >= minVersions {
+			hotspots = append(hotspots, hotspot)
+		}
+	}
+	sort.Slice(hotspots, func(i, j int) bool {
+		if hotspots[i].bytes == hotspots[j].bytes {
+			return hotspots[i].prefix < hotspots[j].prefix
+		}
+		return hotspots[i].bytes > hotspots[j].bytes
+	})
+
+	return hotspots
+}
+
+// keyDirectory returns the key up to its last "/"
+func keyDirectory(key string) string {
+	return key[:strings.LastIndex(key, "/")+1]
+}
+
+func ruleID(rule *s3.LifecycleRule) *string {
+	if rule == nil {
+		return nil
+	}
+
+	return rule.ID
+}
+
+// expiresNoncurrentVersions tells whether the rule expires noncurrent versions of all the objects of its prefix.
+// Rules filtering on tags only apply to some objects, they don't cover a prefix.
+func expiresNoncurrentVersions(rule *s3.LifecycleRule) bool {
+	if rule.NoncurrentVersionExpiration == nil || aws.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays) <= 0 {
+		return false
+	}
+
+	return !isTagScoped(rule)
+}
+
+// isTagScoped tells whether the rule only applies to the tagged objects. An And filter without tags only
+// filters on the prefix.
+func isTagScoped(rule *s3.LifecycleRule) bool {
+	if rule.Filter == nil {
+		return false
+	}
+
+	return rule.Filter.Tag != nil || (rule.Filter.And != nil && len(rule.Filter.And.Tags) > 0)
+}
+
+// expiringRule returns the enabled rule expiring the noncurrent versions of the key the earliest
+func expiringRule(rules []*s3.LifecycleRule, key string) *s3.LifecycleRule {
+	var found *s3.LifecycleRule
+	for _, rule := range rules {
+		if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled || !expiresNoncurrentVersions(rule) ||
+			!strings.HasPrefix(key, lifecycleRulePrefix(rule)) {
+			continue
+		}
+
+		if found == nil || aws.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays) <
+			aws.Int64Value(found.NoncurrentVersionExpiration.NoncurrentDays) {
+			found = rule
+		}
+	}
+
+	return found
+}
+
+func disabledExpiringRule(rules []*s3.LifecycleRule, prefix string) *s3.LifecycleRule {
+	for _, rule := range rules {
+		if aws.StringValue(rule.Status) != s3.ExpirationStatusEnabled && expiresNoncurrentVersions(rule) &&
+			strings.HasPrefix(prefix, lifecycleRulePrefix(rule)) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func describeLifecycleRule(rule *s3.LifecycleRule) string {
+	description := fmt.Sprintf("%s (prefix %q, %s)", aws.StringValue(rule.ID), lifecycleRulePrefix(rule), strings.ToLower(aws.StringValue(rule.Status)))
+	if rule.NoncurrentVersionExpiration != nil && aws.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays) > 0 {
+		description += fmt.Sprintf(": noncurrent versions expire after %d days", aws.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays))
+	} else {
+		description += ": no noncurrent versions expiration"
+	}
+	if isTagScoped(rule) {
+		description += ", only for tagged objects"
+	}
+
+	return description
+}
+
+func (v *s3Versions) printAudit(bucket string, rules []*s3.LifecycleRule, hotspots []*auditHotspot) {
+	w := v.out
+	fmt.Fprintf(w, "Lifecycle audit for %s\n", bucket)
+
+	fmt.Fprintf(w, "  Rules:\n")
+	if len(rules) == 0 {
+		fmt.Fprintf(w, "    none\n")
+	}
+	for _, rule := range rules {
+		fmt.Fprintf(w, "    %s\n", describeLifecycleRule(rule))
+	}
+
+	fmt.Fprintf(w, "  Hotspots:\n")
+	if len(hotspots) == 0 {
+		fmt.Fprintf(w, "    none, the lifecycle rules expire the noncurrent versions\n")
+	}
+
+	top := v.config.Audit.TopPrefixes
+	if top > 0 && top < len(hotspots) {
+		hotspots = hotspots[:top]
+	}
+	for _, hotspot := range hotspots {
+		v.printAuditHotspot(w, bucket, hotspot)
+	}
+}
+
+func (v *s3Versions) printAuditHotspot(w io.Writer, bucket string, hotspot *auditHotspot) {
+	prefix := hotspot.prefix
+	if len(prefix) == 0 {
+		prefix = "(root)"
+	}
+
+	status := "not covered by any rule"
+	if hotspot.rule != nil {
+		status = fmt.Sprintf("older than the %d days of %s", aws.Int64Value(hotspot.rule.NoncurrentVersionExpiration.NoncurrentDays),
+			aws.StringValue(hotspot.rule.ID))
+	}
+	fmt.Fprintf(w, "    %s: %d noncurrent versions of %d keys (%s), oldest noncurrent for %d days, %s\n",
+		prefix, hotspot.versions, hotspot.keys, humanize.Bytes(uint64(hotspot.bytes)), int(hotspot.oldest.Hours()/24), status)
+
+	switch {
+	case hotspot.rule != nil:
+		fmt.Fprintf(w, "      Suggestion: %s should already have expired them, check that it wasn't added in the last days\n",
+			aws.StringValue(hotspot.rule.ID))
+	case hotspot.disabledRule != nil:
+		fmt.Fprintf(w, "      Suggestion: enable the rule %s\n", aws.StringValue(hotspot.disabledRule.ID))
+	default:
+		command := "delete-s3-versions --bucket " + bucket
+		if len(hotspot.prefix) > 0 {
+			command += fmt.Sprintf(" --prefix %q", hotspot.prefix)
+		}
+		fmt.Fprintf(w, "      Suggestion: add a rule with %s lifecycle --noncurrent-days %d --apply --confirm\n",
+			command, v.config.Audit.NoncurrentDays)
+	}
+}
@@ -0,0 +1,140 @@
+package versions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func noncurrentExpirationRule(id string, prefix string, days int64, status string) *s3.LifecycleRule {
+	return &s3.LifecycleRule{
+		ID:     aws.String(id),
+		Status: aws.String(status),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+		NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int64(days),
+		},
+	}
+}
+
+func TestAuditLifecycleRules(t *testing.T) {
+	now := time.Now()
+	days := func(n int) time.Time {
+		return now.Add(-time.Duration(n) * 24 * time.Hour)
+	}
+	fileVersions := map[string][]*fileVersion{
+		// Covered by the 30 days rule, only v1 is overdue
+		"logs/app/a.log": []*fileVersion{
+			&fileVersion{Key: "logs/app/a.log", VersionID: "v1", Size: 100, LastModified: days(90)},
+			&fileVersion{Key: "logs/app/a.log", VersionID: "v2", Size: 100, LastModified: days(40)},
+			&fileVersion{Key: "logs/app/a.log", VersionID: "v3", Size: 100, LastModified: days(10), IsLatest: true},
+		},
+		// Covered and within the expiration
+		"logs/web/b.log": []*fileVersion{
+			&fileVersion{Key: "logs/web/b.log", VersionID: "v1", Size: 100, LastModified: days(20)},
+			&fileVersion{Key: "logs/web/b.log", VersionID: "v2", Size: 100, LastModified: days(5), IsLatest: true},
+		},
+		// Covered by the disabled rule only
+		"images/c.png": []*fileVersion{
+			&fileVersion{Key: "images/c.png", VersionID: "v1", Size: 1000, LastModified: days(3)},
+			&fileVersion{Key: "images/c.png", VersionID: "v2", Size: 1000, LastModified: days(2), IsLatest: true},
+		},
+		// Not covered at all
+		"d.txt": []*fileVersion{
+			&fileVersion{Key: "d.txt", VersionID: "v1", Size: 10, LastModified: days(3)},
+			&fileVersion{Key: "d.txt", VersionID: "v2", Size: 10, LastModified: days(2)},
+			&fileVersion{Key: "d.txt", VersionID: "v3", Size: 10, LastModified: days(1), IsLatest: true},
+		},
+	}
+	tagged := noncurrentExpirationRule("tagged", "", 1, s3.ExpirationStatusEnabled)
+	tagged.Filter = &s3.LifecycleRuleFilter{Tag: &s3.Tag{Key: aws.String("tmp"), Value: aws.String("true")}}
+	rules := []*s3.LifecycleRule{
+		noncurrentExpirationRule("logs", "logs/", 30, s3.ExpirationStatusEnabled),
+		noncurrentExpirationRule("images", "images/", 7, s3.ExpirationStatusDisabled),
+		tagged,
+	}
+
+	hotspots := auditLifecycleRules(fileVersions, rules, now, 1)
+
+	require.Equal(t, 3, len(hotspots))
+	assert.Equal(t, "images/", hotspots[0].prefix)
+	assert.Nil(t, hotspots[0].rule)
+	assert.Equal(t, "images", *hotspots[0].disabledRule.ID)
+
+	assert.Equal(t, "logs/app/", hotspots[1].prefix)
+	assert.Equal(t, "logs", *hotspots[1].rule.ID)
+	assert.Equal(t, 1, hotspots[1].keys)
+	assert.Equal(t, 1, hotspots[1].versions)
+	// v1 became noncurrent when v2 was created
+	assert.Equal(t, 40*24*time.Hour, hotspots[1].oldest)
+
+	assert.Equal(t, "", hotspots[2].prefix)
+	assert.Nil(t, hotspots[2].rule)
+	assert.Nil(t, hotspots[2].disabledRule)
+	assert.Equal(t, 2, hotspots[2].versions)
+	assert.Equal(t, int64(20), hotspots[2].bytes)
+
+	hotspots = auditLifecycleRules(fileVersions, rules, now, 2)
+	require.Equal(t, 1, len(hotspots))
+	assert.Equal(t, "", hotspots[0].prefix)
+}
+
+func TestExpiresNoncurrentVersions(t *testing.T) {
+	rule := noncurrentExpirationRule("logs", "logs/", 30, s3.ExpirationStatusEnabled)
+	assert.True(t, expiresNoncurrentVersions(rule))
+
+	rule.Filter = &s3.LifecycleRuleFilter{Tag: &s3.Tag{Key: aws.String("tmp"), Value: aws.String("true")}}
+	assert.False(t, expiresNoncurrentVersions(rule))
+
+	// An And filter only narrows the rule to some objects when it has tags
+	rule.Filter = &s3.LifecycleRuleFilter{And: &s3.LifecycleRuleAndOperator{Prefix: aws.String("logs/")}}
+	assert.True(t, expiresNoncurrentVersions(rule))
+
+	rule.Filter.And.Tags = []*s3.Tag{&s3.Tag{Key: aws.String("tmp"), Value: aws.String("true")}}
+	assert.False(t, expiresNoncurrentVersions(rule))
+
+	rule.Filter = nil
+	rule.Prefix = aws.String("logs/")
+	assert.True(t, expiresNoncurrentVersions(rule))
+
+	rule.NoncurrentVersionExpiration = nil
+	assert.False(t, expiresNoncurrentVersions(rule))
+}
+
+func TestDescribeLifecycleRule(t *testing.T) {
+	rule := noncurrentExpirationRule("logs", "logs/", 30, s3.ExpirationStatusEnabled)
+	rule.Filter = &s3.LifecycleRuleFilter{And: &s3.LifecycleRuleAndOperator{Prefix: aws.String("logs/")}}
+	assert.Equal(t, `logs (prefix "logs/", enabled): noncurrent versions expire after 30 days`, describeLifecycleRule(rule))
+
+	rule.Filter.And.Tags = []*s3.Tag{&s3.Tag{Key: aws.String("tmp"), Value: aws.String("true")}}
+	assert.Equal(t, `logs (prefix "logs/", enabled): noncurrent versions expire after 30 days, only for tagged objects`, describeLifecycleRule(rule))
+}
+
+func TestAudit(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].LifecycleRules = []*s3.LifecycleRule{
+		noncurrentExpirationRule("other", "other/", 30, s3.ExpirationStatusEnabled),
+	}
+	s := getBasicTestService(fakeBuckets)
+	out := &bytes.Buffer{}
+	s.out = out
+	s.config.Audit.MinVersions = 1
+	s.config.Audit.NoncurrentDays = 30
+
+	err := s.Audit()
+	require.Nil(t, err)
+
+	assert.Contains(t, out.String(), "Lifecycle audit for b1")
+	assert.Contains(t, out.String(), `other (prefix "other/", enabled): noncurrent versions expire after 30 days`)
+	// The fake versions aren't flagged as latest, all of them are noncurrent
+	assert.Contains(t, out.String(), "(root): 7 noncurrent versions of 2 keys (0 B), oldest noncurrent for 0 days, not covered by any rule")
+	assert.Contains(t, out.String(), "Suggestion: add a rule with delete-s3-versions --bucket b1 lifecycle --noncurrent-days 30 --apply --confirm")
+	// Nothing is deleted
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
@@ -0,0 +1,182 @@
+package versions
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// runState is the progress of a run, persisted so that an interrupted run can be resumed
+type runState struct {
+	Prefix  string                       `json:"prefix"`
+	Buckets map[string]*bucketCheckpoint `json:"buckets"`
+}
+
+// bucketCheckpoint is the progress of a bucket: all keys up to KeyMarker were fully processed
+type bucketCheckpoint struct {
+	KeyMarker        string `json:"keyMarker,omitempty"`
+	BatchesCommitted int    `json:"batchesCommitted"`
+	VersionsDeleted  int    `json:"versionsDeleted"`
+	BytesDeleted     int64  `json:"bytesDeleted"`
+	Completed        bool   `json:"completed"`
+}
+
+func newRunState(prefix string) *runState {
+	return &runState{
+		Prefix:  prefix,
+		Buckets: map[string]*bucketCheckpoint{},
+	}
+}
+
+func loadRunState(path string) (*runState, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &runState{}
+	if err = json.Unmarshal(content, state); err != nil {
+		return nil, err
+	}
+	if state.Buckets == nil {
+		state.Buckets = map[string]*bucketCheckpoint{}
+	}
+
+	return state, nil
+}
+
+// save writes the state to a temporary file renamed afterwards, so a crash never leaves a partial state file
+func (s *runState) save(path string) error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// initState prepares the checkpoints of a run, loading the previous state when resuming
+func (v *s3Versions) initState() error {
+	v.state = nil
+	if !v.checkpointsEnabled() {
+		return nil
+	}
+
+	if v.config.Resume {
+		state, err := loadRunState(v.config.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if state != nil && state.Prefix == v.config.BucketPrefix {
+			v.logger.Printf("Resuming the run saved in %s", v.config.StateFile)
+			v.state = state
+			for _, checkpoint := range state.Buckets {
+				v.summary.add(checkpoint.VersionsDeleted, checkpoint.BytesDeleted, 0)
+			}
+			return nil
+		}
+
+		if state != nil {
+			v.logger.Printf("The run saved in %s has a different prefix, starting from the beginning", v.config.StateFile)
+		} else {
+			v.logger.Printf("No state found in %s, starting from the beginning", v.config.StateFile)
+		}
+	}
+
+	v.state = newRunState(v.config.BucketPrefix)
+
+	return v.state.save(v.config.StateFile)
+}
+
+// clearState removes the state file once all buckets are processed
+func (v *s3Versions) clearState() error {
+	if v.state == nil {
+		return nil
+	}
+
+	err := os.Remove(v.config.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (v *s3Versions) checkpointsEnabled() bool {
+	return len(v.config.StateFile) > 0 && v.config.Confirm
+}
+
+// checkpointPages returns how many pages are listed before deleting the versions found and saving a checkpoint
+func (v *s3Versions) checkpointPages() int {
+	if v.state == nil {
+		return 0
+	}
+
+	return v.config.CheckpointPages
+}
+
+func (v *s3Versions) bucketCheckpoint(bucket string) *bucketCheckpoint {
+	if v.state == nil {
+		return nil
+	}
+
+	checkpoint, ok := v.state.Buckets[bucket]
+	if !ok {
+		checkpoint = &bucketCheckpoint{}
+		v.state.Buckets[bucket] = checkpoint
+	}
+
+	return checkpoint
+}
+
+func (v *s3Versions) saveCheckpoint(bucket string, keyMarker string) error {
+	checkpoint := v.bucketCheckpoint(bucket)
+	if checkpoint == nil {
+		return nil
+	}
+
+	checkpoint.KeyMarker = keyMarker
+
+	return v.state.save(v.config.StateFile)
+}
+
+func (v *s3Versions) saveBatchCheckpoint(bucket string, versionsDeleted int, bytesDeleted int64) error {
+	checkpoint := v.bucketCheckpoint(bucket)
+	if checkpoint == nil {
+		return nil
+	}
+
+	checkpoint.BatchesCommitted++
+	checkpoint.VersionsDeleted += versionsDeleted
+	checkpoint.BytesDeleted += bytesDeleted
+
+	return v.state.save(v.config.StateFile)
+}
+
+func (v *s3Versions) completeCheckpoint(bucket string) error {
+	checkpoint := v.bucketCheckpoint(bucket)
+	if checkpoint == nil {
+		return nil
+	}
+
+	checkpoint.Completed = true
+
+	return v.state.save(v.config.StateFile)
+}
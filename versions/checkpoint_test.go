@@ -0,0 +1,178 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func getCheckpointTestService(t *testing.T, fakeBuckets map[string]*fakeBucket) (*s3Versions, func()) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.Nil(t, err)
+
+	s := getBasicTestService(fakeBuckets)
+	s.config.StateFile = filepath.Join(dir, "state.json")
+	s.config.CheckpointPages = 1
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestListFileVersions_MaxPages(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+
+	// The first page has 3 of the 4 key1 versions, key1 is never split
+	fileVersions, keyMarker, err := s.listFileVersions(context.Background(), "b1", nil, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 4, len(fileVersions["key1"]))
+	assert.Equal(t, 0, len(fileVersions["key2"]))
+	assert.Equal(t, "key1", *keyMarker)
+
+	fileVersions, keyMarker, err = s.listFileVersions(context.Background(), "b1", keyMarker, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(fileVersions["key1"]))
+	assert.Equal(t, 3, len(fileVersions["key2"]))
+	assert.Nil(t, keyMarker)
+}
+
+func TestListFileVersions_MaxPagesSummary(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	logs := &bytes.Buffer{}
+	s.logger = log.New(logs, "", 0)
+
+	// The 2 key2 versions of the second page are held back, they are neither logged nor counted
+	_, keyMarker, err := s.listFileVersions(context.Background(), "b1", nil, 1)
+	require.Nil(t, err)
+	assert.Contains(t, logs.String(), "Summary: 4 file versions for 1 files")
+
+	_, _, err = s.listFileVersions(context.Background(), "b1", keyMarker, 1)
+	require.Nil(t, err)
+	assert.Contains(t, logs.String(), "Summary: 3 file versions for 1 files")
+
+	out := &bytes.Buffer{}
+	require.Nil(t, s.Metrics().Write(out))
+	assert.Contains(t, out.String(), `delete_s3_versions_versions_scanned_total{bucket="b1",region="eu-west-1"} 7`)
+}
+
+func TestCheckpoint_CompletedRun(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s, cleanup := getCheckpointTestService(t, fakeBuckets)
+	defer cleanup()
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+
+	_, err = os.Stat(s.config.StateFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCheckpoint_Resume(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b2"].VersioningStatus = fakeBuckets["b1"].VersioningStatus
+	s, cleanup := getCheckpointTestService(t, fakeBuckets)
+	defer cleanup()
+
+	state := newRunState("")
+	state.Buckets["b1"] = &bucketCheckpoint{KeyMarker: "key1", BatchesCommitted: 1, VersionsDeleted: 3, BytesDeleted: 10}
+	state.Buckets["b2"] = &bucketCheckpoint{Completed: true}
+	require.Nil(t, state.save(s.config.StateFile))
+
+	s.config.Resume = true
+	err := s.Delete()
+	require.Nil(t, err)
+
+	// key1 was already processed and b2 completed
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+	assert.Equal(t, 2, len(fakeBuckets["b2"].Objects["key1"]))
+	assert.Equal(t, 5, s.summary.versionsDeleted)
+}
+
+func TestCheckpoint_InterruptedRun(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s, cleanup := getCheckpointTestService(t, fakeBuckets)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mock := s.s3.(*s3apiMock)
+	mock.onDeleteObjects = func(input *s3.DeleteObjectsInput) {
+		cancel()
+	}
+
+	err := s.DeleteWithContext(ctx)
+	require.NotNil(t, err)
+
+	state, err := loadRunState(s.config.StateFile)
+	require.Nil(t, err)
+	assert.Equal(t, &bucketCheckpoint{KeyMarker: "key1", BatchesCommitted: 1, VersionsDeleted: 3}, state.Buckets["b1"])
+
+	mock.onDeleteObjects = nil
+	s.config.Resume = true
+	err = s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestCheckpoint_LimitsCoverTheBucket(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s, cleanup := getCheckpointTestService(t, fakeBuckets)
+	defer cleanup()
+	s.config.MaxDeleteVersions = 4
+
+	// The first segment deletes 3 versions, the limit is exceeded by the bucket before deleting them
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Equal(t, "Aborting b1: 5 versions to delete exceed --max-delete-versions 4", err.Error())
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestCheckpoint_PercentOfTheBucket(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s, cleanup := getCheckpointTestService(t, fakeBuckets)
+	defer cleanup()
+	prompter := &fakePrompter{answers: []string{"y"}, tty: true}
+	s.prompter = prompter
+
+	// 75% of the first segment, 71.4% of the bucket
+	s.config.MaxDeletePercent = 72
+	err := s.Delete()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"Delete 5 versions (0 B, 71.4% of the noncurrent versions) from b1? [y/N] "}, prompter.prompts)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestCheckpoint_ResumedTotals(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s, cleanup := getCheckpointTestService(t, fakeBuckets)
+	defer cleanup()
+
+	state := newRunState("")
+	state.Buckets["b1"] = &bucketCheckpoint{KeyMarker: "key1", BatchesCommitted: 1, VersionsDeleted: 3}
+	require.Nil(t, state.save(s.config.StateFile))
+
+	// The versions deleted by the previous run count against the limits
+	s.config.Resume = true
+	s.config.MaxDeleteVersions = 4
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Equal(t, "Aborting b1: 5 versions to delete exceed --max-delete-versions 4", err.Error())
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+}
@@ -0,0 +1,51 @@
+package versions
+
+import "sync"
+
+const defaultCheckConcurrency = 10
+
+// forEachVersion calls fn for every version, running up to concurrency calls at a time.
+// After the first error, the remaining versions are skipped and the error is returned.
+func forEachVersion(versions []*fileVersion, concurrency int, fn func(version *fileVersion) error) error {
+	if concurrency <= 0 {
+		concurrency = defaultCheckConcurrency
+	}
+
+	jobs := make(chan *fileVersion)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for version := range jobs {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					continue
+				}
+
+				if err := fn(version); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, version := range versions {
+		jobs <- version
+	}
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,232 @@
+package versions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const anyRegion = "*"
+const bytesPerGB = 1 << 30
+const daysPerMonth = 30
+
+// priceTable holds storage prices in USD per GB-month, indexed by region and storage class.
+// The "*" region is used for regions that are not listed explicitly.
+type priceTable map[string]map[string]float64
+
+var defaultPriceTable = priceTable{
+	anyRegion: {
+		s3.StorageClassStandard:           0.023,
+		s3.StorageClassReducedRedundancy:  0.024,
+		s3.StorageClassStandardIa:         0.0125,
+		s3.StorageClassOnezoneIa:          0.01,
+		s3.StorageClassIntelligentTiering: 0.023,
+		s3.StorageClassGlacier:            0.004,
+		s3.StorageClassDeepArchive:        0.00099,
+	},
+	"eu-west-1": {
+		s3.StorageClassStandard:           0.023,
+		s3.StorageClassReducedRedundancy:  0.024,
+		s3.StorageClassStandardIa:         0.0125,
+		s3.StorageClassOnezoneIa:          0.01,
+		s3.StorageClassIntelligentTiering: 0.023,
+		s3.StorageClassGlacier:            0.0036,
+		s3.StorageClassDeepArchive:        0.00099,
+	},
+	"eu-central-1": {
+		s3.StorageClassStandard:           0.0245,
+		s3.StorageClassReducedRedundancy:  0.0264,
+		s3.StorageClassStandardIa:         0.0135,
+		s3.StorageClassOnezoneIa:          0.0108,
+		s3.StorageClassIntelligentTiering: 0.0245,
+		s3.StorageClassGlacier:            0.0045,
+		s3.StorageClassDeepArchive:        0.0018,
+	},
+	"us-west-1": {
+		s3.StorageClassStandard:           0.026,
+		s3.StorageClassReducedRedundancy:  0.0264,
+		s3.StorageClassStandardIa:         0.0144,
+		s3.StorageClassOnezoneIa:          0.01152,
+		s3.StorageClassIntelligentTiering: 0.026,
+		s3.StorageClassGlacier:            0.005,
+		s3.StorageClassDeepArchive:        0.002,
+	},
+}
+
+// Minimum storage durations (in days) charged when deleting objects early
+var minStorageDays = map[string]int{
+	s3.StorageClassStandardIa:         30,
+	s3.StorageClassOnezoneIa:          30,
+	s3.StorageClassIntelligentTiering: 30,
+	s3.StorageClassGlacier:            90,
+	s3.StorageClassDeepArchive:        180,
+}
+
+// loadPriceTable returns the default prices overridden by the ones found in the given JSON file
+func loadPriceTable(path string) (priceTable, error) {
+	prices := priceTable{}
+	for region, classes := range defaultPriceTable {
+		prices[region] = map[string]float64{}
+		for class, price := range classes {
+			prices[region][class] = price
+		}
+	}
+
+	if len(path) == 0 {
+		return prices, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	filePrices := priceTable{}
+	if err = json.Unmarshal(content, &filePrices); err != nil {
+		return nil, fmt.Errorf("Invalid price table %s: %v", path, err)
+	}
+
+	for region, classes := range filePrices {
+		if _, ok := prices[region]; !ok {
+			prices[region] = map[string]float64{}
+		}
+		for class, price := range classes {
+			prices[region][class] = price
+		}
+	}
+
+	return prices, nil
+}
+
+// regionCache caches the regions of the buckets, the S3 calls of the concurrent checks read it to label
+// their metrics
+type regionCache struct {
+	mu      sync.Mutex
+	regions map[string]string
+}
+
+func newRegionCache() *regionCache {
+	return &regionCache{
+		regions: map[string]string{},
+	}
+}
+
+func (c *regionCache) get(bucket string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	region, ok := c.regions[bucket]
+	return region, ok
+}
+
+func (c *regionCache) put(bucket string, region string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.regions[bucket] = region
+}
+
+// bucketRegion returns the region of the bucket, to label its metrics and price its storage. When it can't
+// be found (e.g. with an S3 compatible store), --s3-region is used.
+func (v *s3Versions) bucketRegion(ctx context.Context, bucket string) string {
+	if region, ok := v.regions.get(bucket); ok {
+		return region
+	}
+
+	region := v.region()
+	response, err := v.s3.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		v.logger.Printf("Warning: failed to get the region of %s, its metrics and costs use %s: %v", bucket, region, err)
+	} else {
+		region = s3.NormalizeBucketLocation(aws.StringValue(response.LocationConstraint))
+	}
+	v.regions.put(bucket, region)
+
+	return region
+}
+
+func (p priceTable) price(region string, storageClass string) float64 {
+	if price, ok := p[region][storageClass]; ok {
+		return price
+	}
+
+	return p[anyRegion][storageClass]
+}
+
+// costEstimate accumulates the storage costs of the versions to delete
+type costEstimate struct {
+	bytesByClass      map[string]int64
+	monthlySavings    float64
+	earlyDeletions    int
+	earlyDeletionFees float64
+}
+
+func newCostEstimate() *costEstimate {
+	return &costEstimate{
+		bytesByClass: map[string]int64{},
+	}
+}
+
+// add records a version about to be deleted and reports whether the deletion happens before
+// the minimum storage duration of its storage class
+func (c *costEstimate) add(prices priceTable, region string, version *fileVersion, now time.Time) bool {
+	if version.IsDeleteMarker {
+		return false
+	}
+
+	storageClass := version.StorageClass
+	price := prices.price(region, storageClass)
+	sizeGB := float64(version.Size) / bytesPerGB
+	c.addStorage(prices, region, storageClass, version.Size)
+
+	minDays, ok := minStorageDays[storageClass]
+	if !ok {
+		return false
+	}
+
+	ageDays := int(now.Sub(version.LastModified).Hours() / 24)
+	if ageDays >= minDays {
+		return false
+	}
+
+	c.earlyDeletions++
+	c.earlyDeletionFees += sizeGB * price * float64(minDays-ageDays) / daysPerMonth
+
+	return true
+}
+
+// addStorage records the storage about to be freed, without any early deletion charge
+func (c *costEstimate) addStorage(prices priceTable, region string, storageClass string, size int64) {
+	c.bytesByClass[storageClass] += size
+	c.monthlySavings += float64(size) / bytesPerGB * prices.price(region, storageClass)
+}
+
+func (c *costEstimate) merge(other *costEstimate) {
+	for class, size := range other.bytesByClass {
+		c.bytesByClass[class] += size
+	}
+	c.monthlySavings += other.monthlySavings
+	c.earlyDeletions += other.earlyDeletions
+	c.earlyDeletionFees += other.earlyDeletionFees
+}
+
+func (c *costEstimate) storageClasses() []string {
+	classes := []string{}
+	for class := range c.bytesByClass {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	return classes
+}
+
+func formatDollars(amount float64) string {
+	return fmt.Sprintf("$%.2f", amount)
+}
@@ -0,0 +1,138 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestLoadPriceTable_Defaults(t *testing.T) {
+	prices, err := loadPriceTable("")
+	require.Nil(t, err)
+
+	assert.Equal(t, 0.0036, prices.price("eu-west-1", s3.StorageClassGlacier))
+	assert.Equal(t, 0.004, prices.price("ap-south-1", s3.StorageClassGlacier))
+	assert.Equal(t, 0.0, prices.price("eu-west-1", "UNKNOWN"))
+}
+
+func TestLoadPriceTable_File(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prices")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "prices.json")
+	content := `{"eu-west-1": {"STANDARD": 0.5}, "ap-south-1": {"GLACIER": 0.1}}`
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+
+	prices, err := loadPriceTable(path)
+	require.Nil(t, err)
+
+	assert.Equal(t, 0.5, prices.price("eu-west-1", s3.StorageClassStandard))
+	assert.Equal(t, 0.0125, prices.price("eu-west-1", s3.StorageClassStandardIa))
+	assert.Equal(t, 0.1, prices.price("ap-south-1", s3.StorageClassGlacier))
+
+	require.Nil(t, ioutil.WriteFile(path, []byte("not json"), 0644))
+	_, err = loadPriceTable(path)
+	assert.NotNil(t, err)
+}
+
+func TestCostEstimate(t *testing.T) {
+	prices := priceTable{
+		anyRegion: {
+			s3.StorageClassStandard: 1,
+			s3.StorageClassGlacier:  0.5,
+		},
+	}
+	now := time.Now()
+	costs := newCostEstimate()
+
+	assert.False(t, costs.add(prices, "eu-west-1", &fileVersion{
+		Size:         2 * bytesPerGB,
+		StorageClass: s3.StorageClassStandard,
+		LastModified: now.Add(-24 * time.Hour),
+	}, now))
+	assert.False(t, costs.add(prices, "eu-west-1", &fileVersion{
+		IsDeleteMarker: true,
+		LastModified:   now.Add(-24 * time.Hour),
+	}, now))
+	assert.True(t, costs.add(prices, "eu-west-1", &fileVersion{
+		Size:         bytesPerGB,
+		StorageClass: s3.StorageClassGlacier,
+		LastModified: now.Add(-30 * 24 * time.Hour),
+	}, now))
+
+	assert.Equal(t, 2.5, costs.monthlySavings)
+	assert.Equal(t, 1, costs.earlyDeletions)
+	assert.Equal(t, 1.0, costs.earlyDeletionFees)
+	assert.Equal(t, []string{s3.StorageClassGlacier, s3.StorageClassStandard}, costs.storageClasses())
+
+	total := newCostEstimate()
+	total.merge(costs)
+	total.merge(costs)
+	assert.Equal(t, 5.0, total.monthlySavings)
+	assert.Equal(t, int64(4*bytesPerGB), total.bytesByClass[s3.StorageClassStandard])
+}
+
+func getRegionCostTestService(t *testing.T, region string) (*s3Versions, *bytes.Buffer) {
+	dir, err := ioutil.TempDir("", "prices")
+	require.Nil(t, err)
+	path := filepath.Join(dir, "prices.json")
+	content := `{"eu-west-1": {"STANDARD": 1}, "us-east-1": {"STANDARD": 2}}`
+	require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].Region = region
+	for _, versions := range fakeBuckets["b1"].Objects {
+		for _, version := range versions {
+			version.Size = bytesPerGB
+			version.StorageClass = s3.StorageClassStandard
+		}
+	}
+
+	s := getBasicTestService(fakeBuckets)
+	s.config.PriceTable = path
+	logs := &bytes.Buffer{}
+	s.logger = log.New(logs, "", 0)
+
+	return s, logs
+}
+
+func TestCostEstimate_BucketRegion(t *testing.T) {
+	// The client is in eu-west-1, b1 in us-east-1
+	s, _ := getRegionCostTestService(t, "us-east-1")
+	defer os.RemoveAll(filepath.Dir(s.config.PriceTable))
+
+	require.Nil(t, s.Delete())
+	// 3 versions of 1GB are deleted, the delete markers have no size
+	assert.Equal(t, 6.0, s.costs.monthlySavings)
+	region, _ := s.regions.get("b1")
+	assert.Equal(t, "us-east-1", region)
+}
+
+func TestCostEstimate_BucketRegionUnknown(t *testing.T) {
+	s, logs := getRegionCostTestService(t, "us-east-1")
+	defer os.RemoveAll(filepath.Dir(s.config.PriceTable))
+	s.config.BucketName = "b1"
+	s.s3.(*s3apiMock).injectedErrors["GetBucketLocation"] = []error{awserr.New("AccessDenied", "Access Denied", nil)}
+
+	require.Nil(t, s.Delete())
+	assert.Equal(t, 3.0, s.costs.monthlySavings)
+	assert.Contains(t, logs.String(), "Warning: failed to get the region of b1, its metrics and costs use eu-west-1")
+}
+
+func TestBucketRegion_Normalized(t *testing.T) {
+	s := getBasicTestService(map[string]*fakeBucket{"b1": {Region: "EU"}})
+
+	assert.Equal(t, "eu-west-1", s.bucketRegion(context.Background(), "b1"))
+}
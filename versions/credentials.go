@@ -0,0 +1,61 @@
+package versions
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	"github.com/croman/delete-s3-versions/config"
+)
+
+// getSession returns the AWS session of the run, with the credentials of the --profile (or of the default
+// chain), and those of the --role-arn assumed with them. New can't fail, so a session error is returned by
+// the first S3 call instead.
+func getSession(c *config.Config, region string) *session.Session {
+	sess, err := newSession(c, region)
+	if err != nil {
+		return session.New(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: credentials.NewCredentials(credentials.ErrorProvider{Err: err, ProviderName: "session"}),
+		})
+	}
+
+	return sess
+}
+
+func newSession(c *config.Config, region string) (*session.Session, error) {
+	// The S3 endpoint isn't set here, the role is assumed with STS
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(region)},
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.RoleARN) == 0 {
+		return sess, nil
+	}
+
+	return sess.Copy(&aws.Config{Credentials: roleCredentials(sess, c)}), nil
+}
+
+// roleCredentials assumes the --role-arn with the web identity token file when set, with the session
+// credentials otherwise
+func roleCredentials(sess client.ConfigProvider, c *config.Config) *credentials.Credentials {
+	if len(c.WebIdentityTokenFile) > 0 {
+		return stscreds.NewWebIdentityCredentials(sess, c.RoleARN, c.RoleSessionName, c.WebIdentityTokenFile)
+	}
+
+	return stscreds.NewCredentials(sess, c.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		if len(c.RoleSessionName) > 0 {
+			p.RoleSessionName = c.RoleSessionName
+		}
+		if len(c.ExternalID) > 0 {
+			p.ExternalID = aws.String(c.ExternalID)
+		}
+	})
+}
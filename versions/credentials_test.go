@@ -0,0 +1,71 @@
+package versions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+
+	"github.com/croman/delete-s3-versions/config"
+)
+
+func setupSharedConfig(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "credentials")
+	require.Nil(t, err)
+
+	path := filepath.Join(dir, "credentials")
+	require.Nil(t, ioutil.WriteFile(path, []byte("[cleanup]\naws_access_key_id = AKIDCLEANUP\naws_secret_access_key = secret\n"), 0600))
+
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", path)
+	os.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	return func() {
+		os.Unsetenv("AWS_SHARED_CREDENTIALS_FILE")
+		os.Unsetenv("AWS_CONFIG_FILE")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetSession_Profile(t *testing.T) {
+	defer setupSharedConfig(t)()
+
+	sess := getSession(&config.Config{Profile: "cleanup"}, "eu-west-1")
+	value, err := sess.Config.Credentials.Get()
+	require.Nil(t, err)
+	assert.Equal(t, "AKIDCLEANUP", value.AccessKeyID)
+	assert.Equal(t, "eu-west-1", *sess.Config.Region)
+}
+
+func TestGetSession_Error(t *testing.T) {
+	os.Setenv("AWS_CA_BUNDLE", "/nonexistent/ca.pem")
+	defer os.Unsetenv("AWS_CA_BUNDLE")
+
+	// The error is returned by the first S3 call
+	sess := getSession(&config.Config{}, "eu-west-1")
+	_, err := sess.Config.Credentials.Get()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "/nonexistent/ca.pem")
+}
+
+func TestGetSession_WebIdentity(t *testing.T) {
+	defer setupSharedConfig(t)()
+
+	sess := getSession(&config.Config{
+		Profile:              "cleanup",
+		RoleARN:              "arn:aws:iam::123456789012:role/cleanup",
+		RoleSessionName:      "delete-s3-versions",
+		WebIdentityTokenFile: "/nonexistent/token",
+	}, "eu-west-1")
+
+	// The token file is read before calling STS
+	_, err := sess.Config.Credentials.Get()
+	require.NotNil(t, err)
+	awsErr, ok := err.(awserr.Error)
+	require.True(t, ok)
+	assert.Equal(t, stscreds.ErrCodeWebIdentity, awsErr.Code())
+}
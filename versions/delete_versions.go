@@ -1,25 +1,34 @@
 package versions
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
 	"math"
 	"sort"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/dustin/go-humanize"
 
 	"github.com/croman/delete-s3-versions/config"
+	"github.com/croman/delete-s3-versions/metrics"
 	"github.com/croman/delete-s3-versions/s3api"
+	"github.com/croman/delete-s3-versions/tracing"
 )
 
 const defaultS3Region = "eu-west-1"
 const defaultMaxKeys = 10000
 
+// maxDeleteObjects is the most keys a DeleteObjects request takes
+const maxDeleteObjects = 1000
+const serviceName = "delete-s3-versions"
+
+// nullVersionID is the version ID of the objects written while versioning was disabled or suspended
+const nullVersionID = "null"
+
 type fileVersion struct {
 	Key            string
 	VersionID      string
@@ -27,59 +36,260 @@ type fileVersion struct {
 	LastModified   time.Time
 	Size           int64
 	IsDeleteMarker bool
+	StorageClass   string
+	// SkipReason is set when the version can't be deleted, e.g. because of an Object Lock retention
+	SkipReason string
+	// KeepReason and DeleteReason are the decision of the retention policy, KeepReason is also set for the
+	// versions pinned by a tag
+	KeepReason   string
+	DeleteReason string
 }
 
 // S3Versions exposes functionality for dealing with S3 files versions
 type S3Versions interface {
 	Delete() error
+	DeleteWithContext(ctx context.Context) error
+	Stats() error
+	StatsWithContext(ctx context.Context) error
+	Lifecycle() error
+	LifecycleWithContext(ctx context.Context) error
+	Audit() error
+	AuditWithContext(ctx context.Context) error
+	Versioning() error
+	VersioningWithContext(ctx context.Context) error
+	Plan(ctx context.Context) (*Plan, error)
+	Execute(ctx context.Context, plan *Plan) (*Result, error)
+	Metrics() *metrics.Registry
 }
 
 type s3Versions struct {
-	config *config.Config
-	s3     s3api.S3API
+	config  *config.Config
+	s3      s3api.S3API
+	out     io.Writer
+	logger  Logger
+	now     func() time.Time
+	metrics *runMetrics
+	tracer  *tracing.Tracer
+	prices  priceTable
+	costs   *costEstimate
+	summary *deletionSummary
+	state   *runState
+	pacer   *pacer
+	limiter *s3api.RateLimited
+	locks   *lockCache
+	tags    *tagCache
+
+	deleteLimits *deletionLimits
+	protection   *protectionRules
+	keepTags     []tagCondition
+
+	// retention is the policy of the options, or the one of the configuration when there is none
+	customRetention RetentionPolicy
+	retention       RetentionPolicy
+	minVersions     int
+
+	prompter  prompter
+	mfa       *mfaCode
+	mfaDelete map[string]bool
+	suspended map[string]bool
+
+	// regions caches the regions of the buckets, used to label their metrics and price their storage
+	regions *regionCache
+
+	lockOwner string
+
+	// observer notifies the observers of the options
+	observer observers
 }
 
-// New create a new S3Versions instance
+// New create a new S3Versions instance. With --account-role-arn, it runs against every account in turn.
 func New(c *config.Config) S3Versions {
+	return NewWithOptions(WithConfig(c))
+}
+
+func newS3Versions(o *options, m *runMetrics) *s3Versions {
+	c := o.config
 	s3Config := getS3Config(c)
-	svc := s3.New(session.New(), s3Config)
+	svc := o.s3
+	if svc == nil {
+		svc = s3.New(getSession(c, *s3Config.Region), s3Config)
+	}
+	p := &pacer{}
+
+	// Every attempt is rate limited and instrumented
+	regions := newRegionCache()
+	api := newInstrumentedS3(svc, m, *s3Config.Region, regions)
+	limits := getRateLimits(c)
+	var limiter *s3api.RateLimited
+	if limits != nil {
+		limiter = s3api.NewRateLimited(api, *limits)
+		api = limiter
+	}
+
+	policy := getRetryPolicy(c)
+	if o.retryPolicy != nil {
+		policy = *o.retryPolicy
+	}
+
+	prompt := o.prompter
+	if prompt == nil {
+		prompt = newTerminalPrompter()
+	}
+	var mfa *mfaCode
+	if len(c.MFASerial) > 0 {
+		mfa = newMFACode(c.MFASerial, c.MFACode, prompt)
+	}
 
 	return &s3Versions{
 		config: c,
-		s3:     svc,
+		s3:     s3api.NewRetrying(api, pacedRetryPolicy(policy, p, o.logger)),
+		out:    o.out,
+		logger: o.logger,
+		now:    o.now,
+
+		metrics: m,
+		tracer:  o.tracer,
+		pacer:   p,
+		limiter: limiter,
+		locks:   newLockCache(),
+		tags:    newTagCache(),
+		regions: regions,
+
+		prompter: prompt,
+		mfa:      mfa,
+
+		customRetention: o.retention,
+
+		lockOwner: newLockOwner(),
+
+		observer: o.observers,
 	}
 }
 
-// DeleteOldFileVersions delete older versions of S3 files
+// Metrics returns the metrics recorded while finding and deleting file versions
+func (v *s3Versions) Metrics() *metrics.Registry {
+	return v.metrics.registry
+}
+
+// Delete delete older versions of S3 files
 func (v *s3Versions) Delete() error {
-	buckets, err := v.getBuckets()
+	return v.DeleteWithContext(context.Background())
+}
+
+// DeleteWithContext delete older versions of S3 files. When the context is cancelled, the in-flight
+// deletion batch completes, a partial summary is printed and the context error is returned.
+func (v *s3Versions) DeleteWithContext(ctx context.Context) error {
+	ctx, span := v.tracer.Start(ctx, "Delete", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	err := v.prepareDeletion()
+	if err != nil {
+		return err
+	}
+
+	if err = v.initState(); err != nil {
+		return err
+	}
+
+	buckets, err := v.getBuckets(ctx)
 	if err != nil {
 		return err
 	}
-	log.Println("Found these buckets", buckets)
+	v.logger.Println("Found these buckets", buckets)
 
-	buckets, err = v.filterBucketsByVersioningEnabled(buckets)
+	buckets, err = v.filterBucketsByVersioningEnabled(ctx, buckets)
 	if err != nil {
 		return err
 	}
-	log.Println("Found these buckets with versioning enabled", buckets)
+	v.logger.Println("Found these buckets with versioning enabled", buckets)
+
+	if err = v.checkMFA(buckets); err != nil {
+		return err
+	}
 
 	for _, bucket := range buckets {
-		err = v.findAndRemoveVersions(bucket)
+		start := *v.summary
+		v.observer.OnBucketStart(bucket)
+
+		bucketCtx, release := ctx, func() error { return nil }
+		if v.config.Confirm {
+			if bucketCtx, release, err = v.lockBucket(ctx, bucket); err != nil {
+				v.observer.OnError(bucket, err)
+				return err
+			}
+		}
+
+		err = v.findAndRemoveVersions(bucketCtx, bucket)
+		if lockErr := release(); lockErr != nil {
+			err = lockErr
+		}
 		if err != nil {
+			span.RecordError(err)
+			v.observer.OnError(bucket, err)
+			if ctx.Err() != nil {
+				v.logger.Printf("Interrupted while processing %s, partial summary:", bucket)
+				v.summary.print(v.logger)
+				return fmt.Errorf("Interrupted: %v", ctx.Err())
+			}
 			return err
 		}
+		v.summary.buckets++
+		if v.suspended[bucket] {
+			v.summary.suspendedBuckets++
+		}
+		v.observer.OnBucketDone(bucket, v.summary.bucketSummary(start))
 	}
 
+	v.printCostEstimate("all buckets", v.costs)
+	if v.config.Confirm {
+		v.summary.print(v.logger)
+	} else {
+		v.summary.printSkipped(v.logger)
+	}
+	v.printRateLimitWaitTime()
+	v.metrics.lastRun.Set(float64(v.now().Unix()), v.region())
+
+	return v.clearState()
+}
+
+// prepareDeletion loads the prices, limits and protection rules used to decide and delete the versions,
+// and resets the totals of the run
+func (v *s3Versions) prepareDeletion() error {
+	prices, err := loadPriceTable(v.config.PriceTable)
+	if err != nil {
+		return err
+	}
+	v.prices = prices
+
+	v.deleteLimits, err = getDeletionLimits(v.config)
+	if err != nil {
+		return err
+	}
+
+	v.protection, err = loadProtectionRules(v.config)
+	if err != nil {
+		return err
+	}
+	v.keepTags = parseKeepTags(v.config.KeepTag)
+
+	v.retention, v.minVersions = defaultRetentionPolicy(v.config)
+	if v.customRetention != nil {
+		v.retention, v.minVersions = v.customRetention, 0
+	}
+
+	v.costs = newCostEstimate()
+	v.summary = &deletionSummary{}
+
 	return nil
 }
 
-func (v *s3Versions) getBuckets() ([]string, error) {
+func (v *s3Versions) getBuckets(ctx context.Context) ([]string, error) {
 	if v.config.BucketName == "*" {
-		return v.getAllBuckets()
+		return v.getAllBuckets(ctx)
 	}
 
-	exists, err := v.existsBucket(v.config.BucketName)
+	exists, err := v.existsBucket(ctx, v.config.BucketName)
 	if err != nil {
 		return nil, err
 	} else if !exists {
@@ -89,11 +299,11 @@ func (v *s3Versions) getBuckets() ([]string, error) {
 	return []string{v.config.BucketName}, nil
 }
 
-func (v *s3Versions) getAllBuckets() ([]string, error) {
-	log.Println("List all buckets ...")
+func (v *s3Versions) getAllBuckets(ctx context.Context) ([]string, error) {
+	v.logger.Println("List all buckets ...")
 
 	input := &s3.ListBucketsInput{}
-	response, err := v.s3.ListBuckets(input)
+	response, err := v.s3.ListBucketsWithContext(ctx, input)
 	if err != nil {
 		return nil, err
 	}
@@ -106,12 +316,12 @@ func (v *s3Versions) getAllBuckets() ([]string, error) {
 	return bucketNames, nil
 }
 
-func (v *s3Versions) existsBucket(name string) (bool, error) {
+func (v *s3Versions) existsBucket(ctx context.Context, name string) (bool, error) {
 	input := &s3.HeadBucketInput{
 		Bucket: aws.String(name),
 	}
 
-	_, err := v.s3.HeadBucket(input)
+	_, err := v.s3.HeadBucketWithContext(ctx, input)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NotFound" {
 			return false, nil
@@ -123,101 +333,263 @@ func (v *s3Versions) existsBucket(name string) (bool, error) {
 	return true, nil
 }
 
-func (v *s3Versions) filterBucketsByVersioningEnabled(buckets []string) ([]string, error) {
+// filterBucketsByVersioningEnabled keeps the buckets with versioning enabled, and the buckets with versioning
+// suspended when --include-suspended is set
+func (v *s3Versions) filterBucketsByVersioningEnabled(ctx context.Context, buckets []string) ([]string, error) {
 	bucketsWithVersioning := []string{}
+	v.mfaDelete = map[string]bool{}
+	v.suspended = map[string]bool{}
 
 	for _, bucket := range buckets {
-		versioningEnabled, err := v.isVersioningEnabled(bucket)
+		// The region labels the metrics of the calls to the bucket from now on
+		v.bucketRegion(ctx, bucket)
+		status, mfaDelete, err := v.getVersioningStatus(ctx, bucket)
 		if err != nil {
 			return nil, err
 		}
 
-		if versioningEnabled {
+		switch {
+		case status == s3.BucketVersioningStatusEnabled:
+			bucketsWithVersioning = append(bucketsWithVersioning, bucket)
+		case status == s3.BucketVersioningStatusSuspended && v.config.IncludeSuspended:
+			v.logger.Printf("Bucket %s has versioning suspended, processing the versions created before", bucket)
 			bucketsWithVersioning = append(bucketsWithVersioning, bucket)
+			v.suspended[bucket] = true
+		case status == s3.BucketVersioningStatusSuspended:
+			v.logger.Printf("Skipping %s, versioning is suspended (see --include-suspended)", bucket)
+		}
+		if mfaDelete {
+			v.logger.Printf("Bucket %s has MFA Delete enabled", bucket)
+			v.mfaDelete[bucket] = true
 		}
 	}
 
 	return bucketsWithVersioning, nil
 }
 
-func (v *s3Versions) isVersioningEnabled(bucket string) (bool, error) {
+// getVersioningStatus returns the versioning status of the bucket (empty when versioning was never enabled)
+// and whether it has MFA Delete enabled
+func (v *s3Versions) getVersioningStatus(ctx context.Context, bucket string) (string, bool, error) {
 	input := &s3.GetBucketVersioningInput{
 		Bucket: aws.String(bucket),
 	}
 
-	response, err := v.s3.GetBucketVersioning(input)
+	response, err := v.s3.GetBucketVersioningWithContext(ctx, input)
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "BucketRegionError" {
-			return false, nil
+			return "", false, nil
 		}
 
-		return false, err
+		return "", false, err
 	}
 
-	isEnabled := response.Status != nil && *response.Status == s3.BucketVersioningStatusEnabled
+	mfaDelete := aws.StringValue(response.MFADelete) == s3.MFADeleteStatusEnabled
 
-	return isEnabled, nil
+	return aws.StringValue(response.Status), mfaDelete, nil
 }
 
-func (v *s3Versions) findAndRemoveVersions(bucket string) error {
-	fileVersions, err := v.getFileVersions(bucket)
+func (v *s3Versions) findAndRemoveVersions(ctx context.Context, bucket string) (err error) {
+	ctx, span := v.tracer.Start(ctx, "Bucket", tracing.String("bucket", bucket))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	checkpoint := v.bucketCheckpoint(bucket)
+	if checkpoint != nil && checkpoint.Completed {
+		v.logger.Printf("Skipping %s, it was completed by a previous run", bucket)
+		return nil
+	}
+
+	var keyMarker *string
+	if checkpoint != nil && len(checkpoint.KeyMarker) > 0 {
+		v.logger.Printf("Resuming %s after %s", bucket, checkpoint.KeyMarker)
+		keyMarker = aws.String(checkpoint.KeyMarker)
+	}
+
+	objectLock, err := v.isObjectLockEnabled(ctx, bucket)
 	if err != nil {
 		return err
 	}
 
-	ignoreFilesWithFewerVersions(fileVersions, v.config.VersionsCount)
+	uploads, err := v.findStaleMultipartUploads(ctx, bucket)
+	if err != nil {
+		return err
+	}
 
-	versionsToDelete := v.computeAndPrintVersionsInfo(bucket, fileVersions)
-	if v.config.Confirm {
-		return v.deleteS3Versions(bucket, versionsToDelete)
+	// The versions deleted by a previous run and the multipart uploads to abort count against the limits, and
+	// the bucket is deleted in segments with checkpoints: the limits and the confirmation are checked once
+	// on the totals of the whole bucket
+	totals := resumedTotals(checkpoint)
+	totals.addUploads(uploads)
+	segmented := v.checkpointPages() > 0
+	if segmented && (v.deleteLimits.enabled() || v.confirmationNeeded()) {
+		if err = v.countBucketDeletions(ctx, bucket, keyMarker, objectLock, totals); err != nil {
+			return err
+		}
+		if err = v.checkDeletionLimits(bucket, totals); err != nil {
+			return err
+		}
+		if !totals.empty() {
+			if err = v.confirmDeletion(bucket, totals); err != nil {
+				return err
+			}
+		}
 	}
 
-	return nil
+	for {
+		fileVersions, resumeKeyMarker, err := v.listFileVersions(ctx, bucket, keyMarker, v.checkpointPages())
+		if err != nil {
+			return err
+		}
+
+		_, computeSpan := v.tracer.Start(ctx, "ComputeVersions")
+		noncurrent := countNoncurrentVersions(fileVersions)
+		ignoreFilesWithFewerVersions(fileVersions, v.minVersions)
+		versionsToDelete, err := v.computeAndPrintVersionsInfo(ctx, bucket, fileVersions, objectLock)
+		if err != nil {
+			computeSpan.RecordError(err)
+			computeSpan.End()
+			return err
+		}
+		computeSpan.SetAttributes(tracing.Int("versions_to_delete", int64(len(versionsToDelete))))
+		computeSpan.End()
+
+		// Without checkpoints the whole bucket is listed at once, the limits are checked before deleting anything
+		if !segmented {
+			totals.add(versionsToDelete, noncurrent)
+			if err = v.checkDeletionLimits(bucket, totals); err != nil {
+				if v.config.Confirm {
+					return err
+				}
+				v.logger.Printf("Warning: %v", err)
+			}
+			if v.config.Confirm && !totals.empty() {
+				if err = v.confirmDeletion(bucket, totals); err != nil {
+					return err
+				}
+			}
+		}
+
+		if v.config.Confirm {
+			if err = v.deleteS3Versions(ctx, bucket, versionsToDelete, nil); err != nil {
+				return err
+			}
+		}
+
+		if resumeKeyMarker == nil {
+			break
+		}
+
+		if err = v.saveCheckpoint(bucket, *resumeKeyMarker); err != nil {
+			return err
+		}
+		keyMarker = resumeKeyMarker
+	}
+
+	if err = v.abortMultipartUploads(ctx, bucket, uploads); err != nil {
+		return err
+	}
+
+	return v.completeCheckpoint(bucket)
 }
 
-func (v *s3Versions) getFileVersions(bucket string) (map[string][]*fileVersion, error) {
-	log.Printf("Get file versions for %s/%s", bucket, v.config.BucketPrefix)
+func (v *s3Versions) getFileVersions(ctx context.Context, bucket string) (map[string][]*fileVersion, error) {
+	fileVersions, _, err := v.listFileVersions(ctx, bucket, nil, 0)
+	return fileVersions, err
+}
+
+// listFileVersions lists the file versions after the given key. When maxPages is reached, the listing stops
+// and the versions of the last key (which may have more versions on the next page) are left out,
+// the returned key marker is the last key fully listed.
+func (v *s3Versions) listFileVersions(ctx context.Context, bucket string, keyMarker *string, maxPages int) (map[string][]*fileVersion, *string, error) {
+	v.logger.Printf("Get file versions for %s/%s", bucket, v.config.BucketPrefix)
 	fileVersions := map[string][]*fileVersion{}
 
 	var totalSize int64
 
-	var keyMarker *string
+	var versionIDMarker *string
 	pageNumber := 1
 	versionCount := 0
 
 	for {
 		input := &s3.ListObjectVersionsInput{
-			Bucket:    aws.String(bucket),
-			Prefix:    aws.String(v.config.BucketPrefix),
-			KeyMarker: keyMarker,
-			MaxKeys:   aws.Int64(defaultMaxKeys),
+			Bucket:          aws.String(bucket),
+			Prefix:          aws.String(v.config.BucketPrefix),
+			KeyMarker:       keyMarker,
+			VersionIdMarker: versionIDMarker,
+			MaxKeys:         aws.Int64(defaultMaxKeys),
 		}
 
-		response, err := v.s3.ListObjectVersions(input)
+		pageCtx, pageSpan := v.tracer.Start(ctx, "ListObjectVersions", tracing.String("bucket", bucket), tracing.Int("page", int64(pageNumber)))
+		response, err := v.s3.ListObjectVersionsWithContext(pageCtx, input)
 		if err != nil {
-			return nil, err
+			pageSpan.RecordError(err)
+			pageSpan.End()
+			return nil, nil, err
 		}
 
 		pageVersionCount := len(response.Versions) + len(response.DeleteMarkers)
+		pageSpan.SetAttributes(tracing.Int("versions", int64(pageVersionCount)))
+		pageSpan.End()
 
-		log.Printf("\tGot %d versions for page %d", pageVersionCount, pageNumber)
+		v.logger.Printf("\tGot %d versions for page %d", pageVersionCount, pageNumber)
+		v.observer.OnPage(bucket, pageNumber, pageVersionCount)
+		v.metrics.listPages.Inc(bucket, v.bucketRegion(ctx, bucket))
 
 		totalSize += appendFileVersions(fileVersions, response.Versions)
 		appendDeleteMarkers(fileVersions, response.DeleteMarkers)
+		removeLockKeys(fileVersions)
 
 		versionCount += pageVersionCount
 
 		keyMarker = response.NextKeyMarker
+		versionIDMarker = response.NextVersionIdMarker
 		if keyMarker == nil || len(*keyMarker) == 0 {
 			break
 		}
 
+		if maxPages > 0 && pageNumber >= maxPages && len(fileVersions) > 1 {
+			// The versions of the key held back are listed again with the next pages
+			for _, version := range fileVersions[*keyMarker] {
+				versionCount--
+				totalSize -= version.Size
+			}
+			delete(fileVersions, *keyMarker)
+			v.metrics.versionsScanned.Add(float64(versionCount), bucket, v.bucketRegion(ctx, bucket))
+			v.logger.Printf("Summary: %d file versions for %d files (total size: %s), more to come", versionCount, len(fileVersions), humanize.Bytes(uint64(totalSize)))
+
+			return fileVersions, lastKey(fileVersions), nil
+		}
+
 		pageNumber++
 	}
 
-	log.Printf("Summary: %d file versions for %d files (total size: %s)", versionCount, len(fileVersions), humanize.Bytes(uint64(totalSize)))
+	v.metrics.versionsScanned.Add(float64(versionCount), bucket, v.bucketRegion(ctx, bucket))
+	v.logger.Printf("Summary: %d file versions for %d files (total size: %s)", versionCount, len(fileVersions), humanize.Bytes(uint64(totalSize)))
+
+	return fileVersions, nil, nil
+}
+
+func lastKey(fileVersions map[string][]*fileVersion) *string {
+	var last *string
+	for key := range fileVersions {
+		if last == nil || key > *last {
+			last = aws.String(key)
+		}
+	}
+
+	return last
+}
+
+// versionID returns the ID of a listed version. Some S3 compatible stores omit the null version ID,
+// deleting these versions without an ID would add a delete marker instead.
+func versionID(id *string) string {
+	if len(aws.StringValue(id)) == 0 {
+		return nullVersionID
+	}
 
-	return fileVersions, nil
+	return *id
 }
 
 func appendFileVersions(fileVersions map[string][]*fileVersion, additionalVersions []*s3.ObjectVersion) int64 {
@@ -226,11 +598,16 @@ func appendFileVersions(fileVersions map[string][]*fileVersion, additionalVersio
 	for _, version := range additionalVersions {
 		fv := &fileVersion{
 			Key:            *version.Key,
-			VersionID:      *version.VersionId,
+			VersionID:      versionID(version.VersionId),
 			IsLatest:       *version.IsLatest,
 			LastModified:   *version.LastModified,
 			Size:           *version.Size,
 			IsDeleteMarker: false,
+			StorageClass:   aws.StringValue(version.StorageClass),
+		}
+
+		if len(fv.StorageClass) == 0 {
+			fv.StorageClass = s3.StorageClassStandard
 		}
 
 		if _, ok := fileVersions[fv.Key]; ok {
@@ -249,7 +626,7 @@ func appendDeleteMarkers(fileVersions map[string][]*fileVersion, deleteMarkers [
 	for _, marker := range deleteMarkers {
 		fv := &fileVersion{
 			Key:            *marker.Key,
-			VersionID:      *marker.VersionId,
+			VersionID:      versionID(marker.VersionId),
 			IsLatest:       *marker.IsLatest,
 			LastModified:   *marker.LastModified,
 			Size:           0,
@@ -264,6 +641,15 @@ func appendDeleteMarkers(fileVersions map[string][]*fileVersion, deleteMarkers [
 	}
 }
 
+// removeLockKeys leaves out the lock objects of the runs
+func removeLockKeys(fileVersions map[string][]*fileVersion) {
+	for key := range fileVersions {
+		if isLockKey(key) {
+			delete(fileVersions, key)
+		}
+	}
+}
+
 func ignoreFilesWithFewerVersions(fileVersions map[string][]*fileVersion, versionsCount int) {
 	for key := range fileVersions {
 		if len(fileVersions[key]) <= versionsCount {
@@ -272,77 +658,384 @@ func ignoreFilesWithFewerVersions(fileVersions map[string][]*fileVersion, versio
 	}
 }
 
-func (v *s3Versions) computeAndPrintVersionsInfo(bucket string, fileVersions map[string][]*fileVersion) []*s3.ObjectIdentifier {
-	var spaceRecovered int64
+// versionDecisions are the decisions about the versions listed in a bucket
+type versionDecisions struct {
+	keys []string
+	// candidates are the versions the retention policy deletes, by key
+	candidates map[string][]*fileVersion
+	pinned     map[*fileVersion]string
+	protected  map[string]string
+	// toDelete are the candidates neither protected nor locked
+	toDelete []*fileVersion
+}
 
-	versionsToDelete := []*s3.ObjectIdentifier{}
+// computeVersionsToDelete decides which versions to delete, leaving out the versions of protected keys and
+// the versions protected by Object Lock when the bucket has it enabled. Versions pinned by a --keep-tag tag
+// are kept and not counted in the versions to keep. It prints nothing.
+func (v *s3Versions) computeVersionsToDelete(ctx context.Context, bucket string, fileVersions map[string][]*fileVersion, objectLock bool) (*versionDecisions, error) {
+	keys := []string{}
+	allCandidates := []*fileVersion{}
 
 	for key, versions := range fileVersions {
 		sort.Slice(versions, func(i, j int) bool {
 			return versions[i].LastModified.After(versions[j].LastModified)
 		})
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// The tags are only fetched for the versions the retention policy deletes. The pinned ones are left out
+	// and the policy is applied again, until no new version to delete has to be checked.
+	now := v.now()
+	pinned := map[*fileVersion]string{}
+	checked := map[*fileVersion]bool{}
+	var candidates map[string][]*fileVersion
+	for {
+		candidates = map[string][]*fileVersion{}
+		unchecked := map[string][]*fileVersion{}
+		for _, key := range keys {
+			retained := []*fileVersion{}
+			for _, version := range fileVersions[key] {
+				if tag, ok := pinned[version]; ok {
+					version.KeepReason = "pinned by the tag " + tag
+					version.DeleteReason = ""
+					continue
+				}
+				retained = append(retained, version)
+			}
+
+			toDelete, err := v.decideRetention(key, retained, now)
+			if err != nil {
+				return nil, err
+			}
+			if len(toDelete) > 0 {
+				candidates[key] = toDelete
+			}
+			for _, version := range toDelete {
+				if !checked[version] {
+					unchecked[key] = append(unchecked[key], version)
+				}
+			}
+		}
+
+		if len(v.keepTags) == 0 || len(unchecked) == 0 {
+			break
+		}
+
+		newlyPinned, err := v.pinnedVersions(ctx, bucket, unchecked)
+		if err != nil {
+			return nil, err
+		}
+		for _, versions := range unchecked {
+			for _, version := range versions {
+				checked[version] = true
+			}
+		}
+		if len(newlyPinned) == 0 {
+			break
+		}
+		for version, tag := range newlyPinned {
+			pinned[version] = tag
+		}
+	}
+
+	protected, err := v.protectedKeys(ctx, bucket, fileVersions, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if reason, ok := protected[key]; ok {
+			for _, version := range candidates[key] {
+				version.SkipReason = "protected key, " + reason
+			}
+			continue
+		}
+		allCandidates = append(allCandidates, candidates[key]...)
+	}
+
+	if objectLock {
+		if err := v.checkObjectLocks(ctx, bucket, allCandidates); err != nil {
+			return nil, err
+		}
+	}
+
+	toDelete := []*fileVersion{}
+	for _, version := range allCandidates {
+		if len(version.SkipReason) == 0 {
+			toDelete = append(toDelete, version)
+		}
+	}
+
+	return &versionDecisions{
+		keys:       keys,
+		candidates: candidates,
+		pinned:     pinned,
+		protected:  protected,
+		toDelete:   toDelete,
+	}, nil
+}
+
+// computeAndPrintVersionsInfo returns the versions to delete, printing the decisions and the cost estimate
+func (v *s3Versions) computeAndPrintVersionsInfo(ctx context.Context, bucket string, fileVersions map[string][]*fileVersion, objectLock bool) ([]*fileVersion, error) {
+	decisions, err := v.computeVersionsToDelete(ctx, bucket, fileVersions, objectLock)
+	if err != nil {
+		return nil, err
+	}
+	keys, candidates, pinned, protected := decisions.keys, decisions.candidates, decisions.pinned, decisions.protected
+
+	var spaceRecovered int64
+	now := v.now()
+	versionsToDelete := []*fileVersion{}
+	lockSkipped := 0
+	protectedSkipped := 0
+	costs := newCostEstimate()
+
+	for _, key := range keys {
+		if reason, ok := protected[key]; ok {
+			v.logger.Printf("Versions to delete for %s: none, the key is protected (%s, %d versions kept)", key, reason, len(candidates[key]))
+			protectedSkipped += len(candidates[key])
+			continue
+		}
 
-		log.Printf("Versions to delete for %s (count = %d):", key, len(versions)-v.config.VersionsCount)
-		versionCount := 0
-		for _, version := range versions {
-			if versionCount >= v.config.VersionsCount {
-				log.Printf("\t %s (%s)", version.VersionID, humanize.Bytes(uint64(version.Size)))
-				spaceRecovered += version.Size
-
-				versionsToDelete = append(versionsToDelete, &s3.ObjectIdentifier{
-					Key:       aws.String(version.Key),
-					VersionId: aws.String(version.VersionID),
-				})
+		v.logger.Printf("Versions to delete for %s (count = %d):", key, len(candidates[key]))
+		for _, version := range fileVersions[key] {
+			if tag, ok := pinned[version]; ok {
+				v.logger.Printf("\t %s pinned (tagged %s)", version.VersionID, tag)
+			}
+		}
+		for _, version := range candidates[key] {
+			if len(version.SkipReason) > 0 {
+				v.logger.Printf("\t %s skipped (%s)", version.VersionID, version.SkipReason)
+				lockSkipped++
+				continue
 			}
 
-			if !version.IsDeleteMarker {
-				versionCount++
+			earlyDeletion := costs.add(v.prices, v.bucketRegion(ctx, bucket), version, now)
+			if earlyDeletion {
+				v.logger.Printf("\t %s (%s, %s, before minimum storage duration)", version.VersionID, humanize.Bytes(uint64(version.Size)), version.StorageClass)
+			} else if version.IsDeleteMarker {
+				v.logger.Printf("\t %s (%s)", version.VersionID, humanize.Bytes(uint64(version.Size)))
+			} else {
+				v.logger.Printf("\t %s (%s, %s)", version.VersionID, humanize.Bytes(uint64(version.Size)), version.StorageClass)
 			}
+			spaceRecovered += version.Size
+
+			versionsToDelete = append(versionsToDelete, version)
 		}
 	}
 
-	log.Printf("Total space recovered for %s: %s", bucket, humanize.Bytes(uint64(spaceRecovered)))
-	log.Printf("Total versions to delete for %s: %d", bucket, len(versionsToDelete))
+	v.logger.Printf("Total space recovered for %s: %s", bucket, humanize.Bytes(uint64(spaceRecovered)))
+	v.logger.Printf("Total versions to delete for %s: %d", bucket, len(versionsToDelete))
+	if len(pinned) > 0 {
+		v.logger.Printf("Versions pinned by tags for %s: %d", bucket, len(pinned))
+	}
+	if protectedSkipped > 0 {
+		v.logger.Printf("Versions of protected keys skipped for %s: %d", bucket, protectedSkipped)
+	}
+	if lockSkipped > 0 {
+		v.logger.Printf("Versions skipped due to object locks for %s: %d", bucket, lockSkipped)
+	}
+	v.printCostEstimate(bucket, costs)
+	v.costs.merge(costs)
 
-	return versionsToDelete
+	if len(v.observer) > 0 {
+		deleting := versionSet(versionsToDelete)
+		for _, key := range keys {
+			v.observer.OnKeyDecision(bucket, key, v.keyDecisions(fileVersions[key], deleting))
+		}
+	}
+	v.summary.lockSkipped += lockSkipped
+	v.summary.protectedSkipped += protectedSkipped
+
+	return versionsToDelete, nil
+}
+
+func (v *s3Versions) printCostEstimate(name string, costs *costEstimate) {
+	for _, class := range costs.storageClasses() {
+		v.logger.Printf("\t%s: %s", class, humanize.Bytes(uint64(costs.bytesByClass[class])))
+	}
+	v.logger.Printf("Estimated monthly savings for %s: %s", name, formatDollars(costs.monthlySavings))
+
+	if costs.earlyDeletions > 0 {
+		v.logger.Printf("Warning: %d versions for %s are deleted before the minimum storage duration of their storage class (estimated early deletion charge: %s)",
+			costs.earlyDeletions, name, formatDollars(costs.earlyDeletionFees))
+	}
 }
 
-func (v *s3Versions) deleteS3Versions(bucket string, versionsToDelete []*s3.ObjectIdentifier) error {
-	log.Printf("Deleting %d file versions for %s/%s ...", len(versionsToDelete), bucket, v.config.BucketPrefix)
+// deleteS3Versions deletes the versions in batches. The result, when not nil, records the versions deleted
+// and those that failed.
+func (v *s3Versions) deleteS3Versions(ctx context.Context, bucket string, versionsToDelete []*fileVersion, result *BucketResult) error {
+	// Last line of defence: whatever computed the versions, protected ones are never sent to S3
+	allowed := []*fileVersion{}
+	for _, version := range versionsToDelete {
+		if v.isProtected(version) {
+			v.logger.Printf("\tRefusing to delete the protected version %s (%s)", version.Key, version.VersionID)
+			continue
+		}
+		allowed = append(allowed, version)
+	}
+	versionsToDelete = allowed
+
+	v.logger.Printf("Deleting %d file versions for %s/%s ...", len(versionsToDelete), bucket, v.config.BucketPrefix)
 	beginIndex := 0
 
 	for beginIndex < len(versionsToDelete) {
-		endIndex := int(math.Min(float64(beginIndex+1000), float64(len(versionsToDelete))))
+		if err := v.pacer.wait(ctx); err != nil {
+			return err
+		}
+
+		endIndex := int(math.Min(float64(beginIndex+maxDeleteObjects), float64(len(versionsToDelete))))
+		batch := versionsToDelete[beginIndex:endIndex]
+
+		objects := []*s3.ObjectIdentifier{}
+		sent := map[string]*fileVersion{}
+		for _, version := range batch {
+			objects = append(objects, &s3.ObjectIdentifier{
+				Key:       aws.String(version.Key),
+				VersionId: aws.String(version.VersionID),
+			})
+			sent[version.Key+"\x00"+version.VersionID] = version
+		}
+
 		input := &s3.DeleteObjectsInput{
 			Bucket: aws.String(bucket),
 			Delete: &s3.Delete{
-				Objects: versionsToDelete[beginIndex:endIndex],
+				Objects: objects,
 			},
 		}
+		if v.config.BypassGovernanceRetention {
+			input.BypassGovernanceRetention = aws.Bool(true)
+		}
 
-		response, err := v.s3.DeleteObjects(input)
+		// The batch is not cancelled with the context so that an interrupted run knows what was deleted
+		batchCtx, batchSpan := v.tracer.Start(detach(ctx), "DeleteObjects", tracing.String("bucket", bucket), tracing.Int("versions", int64(len(objects))))
+		response, err := v.deleteObjects(batchCtx, bucket, input)
 		if err != nil {
+			v.metrics.deleteErrors.Inc(bucket, v.bucketRegion(ctx, bucket))
+			batchSpan.RecordError(err)
+			batchSpan.End()
 			return err
 		}
+		batchSpan.SetAttributes(tracing.Int("deleted", int64(len(response.Deleted))), tracing.Int("errors", int64(len(response.Errors))))
+		batchSpan.End()
+		v.pacer.succeeded()
 
 		beginIndex = endIndex
 
-		log.Printf("\tDeleted %d versions", len(response.Deleted))
+		var deletedSize int64
+		batchDeleted := []*DeletedVersion{}
+		for _, deleted := range response.Deleted {
+			batchDeleted = append(batchDeleted, newDeletedVersion(deleted, sent))
+			deletedSize += batchDeleted[len(batchDeleted)-1].Size
+		}
+		batchFailed := []*FailedVersion{}
+		for _, deleteErr := range response.Errors {
+			v.logger.Printf("\tFailed to delete %s (%s): %s", aws.StringValue(deleteErr.Key), aws.StringValue(deleteErr.VersionId), aws.StringValue(deleteErr.Message))
+			batchFailed = append(batchFailed, newFailedVersion(deleteErr))
+		}
+		if result != nil {
+			result.Deleted = append(result.Deleted, batchDeleted...)
+			result.Failed = append(result.Failed, batchFailed...)
+		}
+		v.observer.OnBatchDeleted(bucket, batchDeleted, batchFailed)
+		region := v.bucketRegion(ctx, bucket)
+		v.metrics.versionsDeleted.Add(float64(len(response.Deleted)), bucket, region)
+		v.metrics.bytesReclaimed.Add(float64(deletedSize), bucket, region)
+		v.metrics.deleteErrors.Add(float64(len(response.Errors)), bucket, region)
+		v.summary.add(len(response.Deleted), deletedSize, len(response.Errors))
+		if v.suspended[bucket] {
+			v.summary.addSuspended(len(response.Deleted), deletedSize)
+		}
+		if err = v.saveBatchCheckpoint(bucket, len(response.Deleted), deletedSize); err != nil {
+			return err
+		}
+
+		v.logger.Printf("\tDeleted %d versions", len(response.Deleted))
 	}
 
 	return nil
 }
 
+// flushTraces exports the spans of the command, the tracer is still used by the next ones
+func (v *s3Versions) flushTraces() {
+	if err := v.tracer.Flush(context.Background()); err != nil {
+		v.logger.Println("Failed to export traces:", err)
+	}
+}
+
+func (v *s3Versions) region() string {
+	if len(v.config.S3Region) == 0 {
+		return defaultS3Region
+	}
+
+	return v.config.S3Region
+}
+
+// getRateLimits returns the rate limits configured with the command line flags, nil when there are none
+func getRateLimits(c *config.Config) *s3api.RateLimits {
+	if c.ListRPS <= 0 && c.DeleteRPS <= 0 && len(c.BucketListRPS) == 0 && len(c.BucketDeleteRPS) == 0 {
+		return nil
+	}
+
+	return &s3api.RateLimits{
+		ListRPS:         c.ListRPS,
+		DeleteRPS:       c.DeleteRPS,
+		BucketListRPS:   c.BucketListRPS,
+		BucketDeleteRPS: c.BucketDeleteRPS,
+	}
+}
+
+func (v *s3Versions) printRateLimitWaitTime() {
+	if v.limiter != nil {
+		v.logger.Printf("Time spent waiting for rate limits: %s", v.limiter.WaitTime().Round(time.Millisecond))
+	}
+}
+
+// getRetryPolicy returns the retry policy configured with the command line flags
+func getRetryPolicy(c *config.Config) s3api.RetryPolicy {
+	policy := s3api.DefaultRetryPolicy()
+	if c.MaxAttempts > 0 {
+		policy.MaxAttempts = c.MaxAttempts
+	}
+	if c.RetryBaseDelay > 0 {
+		policy.BaseDelay = c.RetryBaseDelay
+	}
+	if c.RetryMaxDelay > 0 {
+		policy.MaxDelay = c.RetryMaxDelay
+	}
+
+	return policy
+}
+
+// pacedRetryPolicy logs the retries of the policy and slows down the pacer when throttled
+func pacedRetryPolicy(policy s3api.RetryPolicy, p *pacer, logger Logger) s3api.RetryPolicy {
+	onRetry := policy.OnRetry
+	policy.OnRetry = func(operation string, err error, attempt int, delay time.Duration) {
+		logger.Printf("\t%s failed (attempt %d), retrying in %s: %v", operation, attempt, delay, err)
+		if policy.IsThrottling(err) {
+			p.throttled()
+		}
+		if onRetry != nil {
+			onRetry(operation, err, attempt, delay)
+		}
+	}
+
+	return policy
+}
+
 func getS3Config(c *config.Config) *aws.Config {
 	region := c.S3Region
 	if len(region) == 0 {
 		region = defaultS3Region
 	}
 
+	// The calls are retried by s3api.NewRetrying only
 	return &aws.Config{
-		DisableSSL:       aws.Bool(c.S3DisableSSL == "true"),
+		DisableSSL:       aws.Bool(c.S3DisableSSL),
 		Endpoint:         aws.String(c.S3Endpoint),
 		Region:           aws.String(region),
 		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
 	}
 }
@@ -1,8 +1,11 @@
 package versions
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -98,7 +101,7 @@ func getBasicTestService(fakeBuckets map[string]*fakeBucket) *s3Versions {
 	return &s3Versions{
 		config: &config.Config{
 			S3Region:     "eu-west-1",
-			S3DisableSSL: os.Getenv("S3_DISABLE_SSL"),
+			S3DisableSSL: os.Getenv("S3_DISABLE_SSL") == "true",
 			S3Endpoint:   os.Getenv("S3_ENDPOINT"),
 
 			BucketName:    "*",
@@ -106,7 +109,15 @@ func getBasicTestService(fakeBuckets map[string]*fakeBucket) *s3Versions {
 			VersionsCount: 1,
 			Confirm:       true,
 		},
-		s3: newS3ApiMock(fakeBuckets, 3),
+		s3:      newS3ApiMock(fakeBuckets, 3),
+		out:     ioutil.Discard,
+		logger:  stdLogger{},
+		now:     time.Now,
+		metrics: newRunMetrics(),
+		pacer:   &pacer{},
+		locks:   newLockCache(),
+		tags:    newTagCache(),
+		regions: newRegionCache(),
 	}
 }
 
@@ -114,7 +125,7 @@ func TestGetBuckets(t *testing.T) {
 	fakeBuckets := setupBucketsAndObjects()
 	s := getBasicTestService(fakeBuckets)
 
-	buckets, err := s.getBuckets()
+	buckets, err := s.getBuckets(context.Background())
 	require.Nil(t, err)
 	sort.Strings(buckets)
 	assert.Equal(t, []string{"b1", "b2", "bucket-in-wrong-region"}, buckets)
@@ -125,7 +136,7 @@ func TestGetBuckets_OneBucketConfig(t *testing.T) {
 	s := getBasicTestService(fakeBuckets)
 	s.config.BucketName = "b1"
 
-	buckets, err := s.getBuckets()
+	buckets, err := s.getBuckets(context.Background())
 	require.Nil(t, err)
 	assert.Equal(t, []string{"b1"}, buckets)
 }
@@ -134,7 +145,7 @@ func TestGetBuckets_MissingBucketConfig(t *testing.T) {
 	s := getBasicTestService(fakeBuckets)
 	s.config.BucketName = "missing-bucket"
 
-	_, err := s.getBuckets()
+	_, err := s.getBuckets(context.Background())
 	assert.True(t, strings.Index(err.Error(), "Bucket doesn't exist") > -1)
 }
 
@@ -142,10 +153,10 @@ func TestVersioningEnabled(t *testing.T) {
 	fakeBuckets := setupBucketsAndObjects()
 	s := getBasicTestService(fakeBuckets)
 
-	buckets, err := s.getBuckets()
+	buckets, err := s.getBuckets(context.Background())
 	require.Nil(t, err)
 
-	buckets, err = s.filterBucketsByVersioningEnabled(buckets)
+	buckets, err = s.filterBucketsByVersioningEnabled(context.Background(), buckets)
 	assert.Equal(t, []string{"b1"}, buckets)
 }
 
@@ -177,7 +188,7 @@ func TestSkipDelete(t *testing.T) {
 func TestS3Config(t *testing.T) {
 	c := &config.Config{
 		S3Region:     "eu-west-2",
-		S3DisableSSL: "true",
+		S3DisableSSL: true,
 		S3Endpoint:   "http://localhost:1234",
 	}
 
@@ -186,10 +197,11 @@ func TestS3Config(t *testing.T) {
 		Endpoint:         aws.String("http://localhost:1234"),
 		Region:           aws.String("eu-west-2"),
 		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
 	})
 
 	c = &config.Config{
-		S3DisableSSL: "true",
+		S3DisableSSL: true,
 		S3Endpoint:   "http://localhost:1234",
 	}
 
@@ -198,5 +210,126 @@ func TestS3Config(t *testing.T) {
 		Endpoint:         aws.String("http://localhost:1234"),
 		Region:           aws.String("eu-west-1"),
 		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
 	})
 }
+
+func TestDeleteWithContext_Cancelled(t *testing.T) {
+	versions := []*fakeVersion{}
+	for i := 0; i < 1500; i++ {
+		versions = append(versions, &fakeVersion{
+			VersionID:    "v" + strconv.Itoa(i),
+			LastModified: time.Now().Add(time.Duration(-i) * time.Minute),
+		})
+	}
+	fakeBuckets := map[string]*fakeBucket{
+		"b1": &fakeBucket{
+			VersioningStatus: aws.String(s3.BucketVersioningStatusEnabled),
+			Objects:          map[string][]*fakeVersion{"key1": versions},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := getBasicTestService(fakeBuckets)
+	mock := newS3ApiMock(fakeBuckets, 2000).(*s3apiMock)
+	mock.onDeleteObjects = func(input *s3.DeleteObjectsInput) {
+		cancel()
+	}
+	s.s3 = mock
+
+	err := s.DeleteWithContext(ctx)
+	require.NotNil(t, err)
+	assert.True(t, strings.Index(err.Error(), "Interrupted") > -1)
+
+	// The in-flight batch completes but the next one is not sent
+	assert.Equal(t, 500, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1000, s.summary.versionsDeleted)
+	assert.Equal(t, 0, s.summary.buckets)
+}
+
+// setupSuspendedBucket adds b3, with versioning suspended after it was enabled: each key has the versions
+// created while it was enabled, and a null version written since
+func setupSuspendedBucket() map[string]*fakeBucket {
+	fakeBuckets := setupBucketsAndObjects()
+
+	fakeBuckets["b3"] = &fakeBucket{
+		VersioningStatus: aws.String(s3.BucketVersioningStatusSuspended),
+		Objects: map[string][]*fakeVersion{
+			"key1": []*fakeVersion{
+				&fakeVersion{VersionID: "b3-key1-v1", LastModified: time.Now().Add(-10 * time.Hour), Size: 10},
+				&fakeVersion{VersionID: "b3-key1-v2", LastModified: time.Now().Add(-9 * time.Hour), Size: 20},
+				&fakeVersion{VersionID: nullVersionID, LastModified: time.Now().Add(-8 * time.Hour), Size: 30, IsLatest: true},
+			},
+			"key2": []*fakeVersion{
+				&fakeVersion{VersionID: nullVersionID, LastModified: time.Now().Add(-10 * time.Hour), Size: 40},
+				&fakeVersion{VersionID: "b3-key2-v1", LastModified: time.Now().Add(-9 * time.Hour), Size: 50},
+				&fakeVersion{VersionID: "b3-key2-deleted", LastModified: time.Now().Add(-8 * time.Hour), IsDeleteMarker: true, IsLatest: true},
+			},
+		},
+	}
+
+	return fakeBuckets
+}
+
+func TestFilterBuckets_Suspended(t *testing.T) {
+	fakeBuckets := setupSuspendedBucket()
+	s := getBasicTestService(fakeBuckets)
+
+	buckets, err := s.filterBucketsByVersioningEnabled(context.Background(), []string{"b1", "b2", "b3"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"b1"}, buckets)
+
+	s.config.IncludeSuspended = true
+	buckets, err = s.filterBucketsByVersioningEnabled(context.Background(), []string{"b1", "b2", "b3"})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"b1", "b3"}, buckets)
+	assert.True(t, s.suspended["b3"])
+	assert.False(t, s.suspended["b1"])
+}
+
+func TestFindAndDelete_SuspendedSkipped(t *testing.T) {
+	fakeBuckets := setupSuspendedBucket()
+	s := getBasicTestService(fakeBuckets)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 3, len(fakeBuckets["b3"].Objects["key1"]))
+	assert.Equal(t, 3, len(fakeBuckets["b3"].Objects["key2"]))
+}
+
+func TestFindAndDelete_Suspended(t *testing.T) {
+	fakeBuckets := setupSuspendedBucket()
+	s := getBasicTestService(fakeBuckets)
+	s.config.IncludeSuspended = true
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{nullVersionID}, versionIDs(fakeBuckets["b3"].Objects["key1"]))
+	// The noncurrent null version is deleted like the others
+	assert.Equal(t, []string{"b3-key2-v1", "b3-key2-deleted"}, versionIDs(fakeBuckets["b3"].Objects["key2"]))
+
+	assert.Equal(t, 2, s.summary.buckets)
+	assert.Equal(t, 1, s.summary.suspendedBuckets)
+	assert.Equal(t, 3, s.summary.suspendedVersionsDeleted)
+	assert.Equal(t, int64(70), s.summary.suspendedBytesDeleted)
+	assert.Equal(t, 8, s.summary.versionsDeleted)
+}
+
+func TestFindAndDelete_OmittedNullVersionIDs(t *testing.T) {
+	fakeBuckets := setupSuspendedBucket()
+	fakeBuckets["b3"].OmitNullVersionIDs = true
+	s := getBasicTestService(fakeBuckets)
+	s.config.BucketName = "b3"
+	s.config.IncludeSuspended = true
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{nullVersionID}, versionIDs(fakeBuckets["b3"].Objects["key1"]))
+	assert.Equal(t, []string{"b3-key2-v1", "b3-key2-deleted"}, versionIDs(fakeBuckets["b3"].Objects["key2"]))
+	assert.Equal(t, int64(70), s.summary.suspendedBytesDeleted)
+}
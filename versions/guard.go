@@ -0,0 +1,198 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/croman/delete-s3-versions/config"
+)
+
+// deletionLimits abort the deletions of a bucket when exceeded, zero means unlimited
+type deletionLimits struct {
+	versions int
+	bytes    uint64
+	percent  float64
+}
+
+func getDeletionLimits(c *config.Config) (*deletionLimits, error) {
+	limits := &deletionLimits{
+		versions: c.MaxDeleteVersions,
+		percent:  c.MaxDeletePercent,
+	}
+
+	if len(c.MaxDeleteBytes) > 0 {
+		bytes, err := humanize.ParseBytes(c.MaxDeleteBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --max-delete-bytes: %v", err)
+		}
+		limits.bytes = bytes
+	}
+
+	return limits, nil
+}
+
+func (l *deletionLimits) enabled() bool {
+	return l != nil && (l.versions > 0 || l.bytes > 0 || l.percent > 0)
+}
+
+// bucketTotals accumulates what is about to be deleted from a bucket, across checkpoints, and the multipart
+// uploads to abort
+type bucketTotals struct {
+	versions   int
+	bytes      int64
+	noncurrent int
+	uploads    int
+}
+
+// resumedTotals returns what the previous runs deleted from the bucket, the versions deleted were noncurrent
+func resumedTotals(checkpoint *bucketCheckpoint) *bucketTotals {
+	if checkpoint == nil {
+		return &bucketTotals{}
+	}
+
+	return &bucketTotals{
+		versions:   checkpoint.VersionsDeleted,
+		bytes:      checkpoint.BytesDeleted,
+		noncurrent: checkpoint.VersionsDeleted,
+	}
+}
+
+func (t *bucketTotals) add(versionsToDelete []*fileVersion, noncurrent int) {
+	for _, version := range versionsToDelete {
+		t.versions++
+		t.bytes += version.Size
+	}
+	t.noncurrent += noncurrent
+}
+
+func (t *bucketTotals) addUploads(uploads []*multipartUpload) {
+	for _, upload := range uploads {
+		t.uploads++
+		t.bytes += upload.Size
+	}
+}
+
+func (t *bucketTotals) empty() bool {
+	return t.versions == 0 && t.uploads == 0
+}
+
+// what describes what is about to be deleted
+func (t *bucketTotals) what() string {
+	if t.uploads == 0 {
+		return fmt.Sprintf("%d versions to delete", t.versions)
+	}
+
+	return fmt.Sprintf("%d versions to delete and %d multipart uploads to abort", t.versions, t.uploads)
+}
+
+// percent returns the share of the noncurrent versions about to be deleted
+func (t *bucketTotals) percent() float64 {
+	if t.noncurrent == 0 {
+		if t.versions == 0 {
+			return 0
+		}
+		return 100
+	}
+
+	return float64(t.versions) * 100 / float64(t.noncurrent)
+}
+
+func countNoncurrentVersions(fileVersions map[string][]*fileVersion) int {
+	count := 0
+	for _, versions := range fileVersions {
+		for _, version := range versions {
+			if !version.IsLatest {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// checkDeletionLimits returns an error when the deletions planned for the bucket exceed the limits. The multipart
+// uploads to abort count as versions, but not in the percent of the noncurrent versions.
+func (v *s3Versions) checkDeletionLimits(bucket string, totals *bucketTotals) error {
+	limits := v.deleteLimits
+	if limits == nil {
+		return nil
+	}
+
+	if limits.versions > 0 && totals.versions+totals.uploads > limits.versions {
+		return fmt.Errorf("Aborting %s: %s exceed --max-delete-versions %d", bucket, totals.what(), limits.versions)
+	}
+
+	if limits.bytes > 0 && uint64(totals.bytes) > limits.bytes {
+		return fmt.Errorf("Aborting %s: %s to delete exceed --max-delete-bytes %s", bucket,
+			humanize.Bytes(uint64(totals.bytes)), humanize.Bytes(limits.bytes))
+	}
+
+	if limits.percent > 0 && totals.percent() > limits.percent {
+		return fmt.Errorf("Aborting %s: %.1f%% of the noncurrent versions to delete exceed --max-delete-percent %g", bucket, totals.percent(), limits.percent)
+	}
+
+	return nil
+}
+
+// countBucketDeletions lists the bucket from the key marker to count what is about to be deleted, without
+// deleting anything. With checkpoints the bucket is deleted in segments, the limits and the confirmation
+// cover the whole bucket before the first segment is deleted.
+func (v *s3Versions) countBucketDeletions(ctx context.Context, bucket string, keyMarker *string, objectLock bool, totals *bucketTotals) error {
+	v.logger.Printf("Counting the versions to delete from %s before deleting them", bucket)
+	for {
+		fileVersions, nextKeyMarker, err := v.listFileVersions(ctx, bucket, keyMarker, v.checkpointPages())
+		if err != nil {
+			return err
+		}
+
+		noncurrent := countNoncurrentVersions(fileVersions)
+		ignoreFilesWithFewerVersions(fileVersions, v.minVersions)
+		decisions, err := v.computeVersionsToDelete(ctx, bucket, fileVersions, objectLock)
+		if err != nil {
+			return err
+		}
+		totals.add(decisions.toDelete, noncurrent)
+
+		if nextKeyMarker == nil {
+			return nil
+		}
+		keyMarker = nextKeyMarker
+	}
+}
+
+// confirmationNeeded reports whether the deletions have to be confirmed, when stdin is a terminal and --yes
+// isn't given
+func (v *s3Versions) confirmationNeeded() bool {
+	return !v.config.Yes && v.prompter != nil && v.prompter.interactive()
+}
+
+// confirmDeletion asks for a confirmation of the totals when needed
+func (v *s3Versions) confirmDeletion(bucket string, totals *bucketTotals) error {
+	if !v.confirmationNeeded() {
+		return nil
+	}
+
+	message := fmt.Sprintf("Delete %d versions (%s, %.1f%% of the noncurrent versions) from %s", totals.versions,
+		humanize.Bytes(uint64(totals.bytes)), totals.percent(), bucket)
+	if totals.uploads > 0 {
+		message = fmt.Sprintf("Delete %d versions and abort %d multipart uploads (%s, %.1f%% of the noncurrent versions) from %s",
+			totals.versions, totals.uploads, humanize.Bytes(uint64(totals.bytes)), totals.percent(), bucket)
+	}
+
+	answer, err := v.prompter.prompt(message + "? [y/N] ")
+	if err != nil {
+		return err
+	}
+
+	answer = strings.ToLower(answer)
+	if answer != "y" && answer != "yes" {
+		return fmt.Errorf("Deletion cancelled for %s", bucket)
+	}
+
+	v.logger.Printf("Deletion confirmed for %s", bucket)
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package versions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckDeletionLimits(t *testing.T) {
+	s := getBasicTestService(setupBucketsAndObjects())
+	s.config.MaxDeleteVersions = 10
+	s.config.MaxDeleteBytes = "1MB"
+	s.config.MaxDeletePercent = 50
+
+	limits, err := getDeletionLimits(s.config)
+	require.Nil(t, err)
+	s.deleteLimits = limits
+
+	assert.Nil(t, s.checkDeletionLimits("b1", &bucketTotals{versions: 10, bytes: 1000000, noncurrent: 20}))
+
+	err = s.checkDeletionLimits("b1", &bucketTotals{versions: 11, noncurrent: 100})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--max-delete-versions")
+
+	err = s.checkDeletionLimits("b1", &bucketTotals{versions: 1, bytes: 1000001, noncurrent: 100})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--max-delete-bytes")
+
+	err = s.checkDeletionLimits("b1", &bucketTotals{versions: 6, noncurrent: 10})
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--max-delete-percent")
+}
+
+func TestGetDeletionLimits_InvalidBytes(t *testing.T) {
+	s := getBasicTestService(setupBucketsAndObjects())
+	s.config.MaxDeleteBytes = "a lot"
+
+	_, err := getDeletionLimits(s.config)
+	require.NotNil(t, err)
+}
+
+func TestDelete_MaxDeleteVersionsExceeded(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.MaxDeleteVersions = 4
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "5 versions to delete exceed --max-delete-versions 4")
+
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestDelete_MaxDeletePercentExceeded(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.MaxDeletePercent = 50
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--max-delete-percent")
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestSkipDelete_LimitsOnlyWarn(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.Confirm = false
+	s.config.MaxDeleteVersions = 1
+
+	err := s.Delete()
+	require.Nil(t, err)
+}
+
+func TestDelete_ConfirmationDeclined(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	prompter := &fakePrompter{answers: []string{"n"}, tty: true}
+	s.prompter = prompter
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Equal(t, "Deletion cancelled for b1", err.Error())
+	assert.Equal(t, []string{"Delete 5 versions (0 B, 71.4% of the noncurrent versions) from b1? [y/N] "}, prompter.prompts)
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestDelete_ConfirmationAccepted(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.prompter = &fakePrompter{answers: []string{"yes"}, tty: true}
+
+	err := s.Delete()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestDelete_ConfirmationSkipped(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	prompter := &fakePrompter{tty: true}
+	s.prompter = prompter
+	s.config.Yes = true
+
+	err := s.Delete()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(prompter.prompts))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+}
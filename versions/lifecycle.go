@@ -0,0 +1,282 @@
+package versions
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+const lifecycleRuleID = "delete-s3-versions"
+
+// lifecycleDocument is the printed lifecycle configuration, in the format of the S3 API (XML)
+// and of the AWS CLI (JSON)
+type lifecycleDocument struct {
+	XMLName xml.Name                `json:"-" xml:"LifecycleConfiguration"`
+	Rules   []lifecycleRuleDocument `json:"Rules" xml:"Rule"`
+}
+
+type lifecycleRuleDocument struct {
+	ID                          string                               `json:"ID" xml:"ID"`
+	Filter                      lifecycleFilterDocument              `json:"Filter" xml:"Filter"`
+	Status                      string                               `json:"Status" xml:"Status"`
+	Expiration                  *lifecycleExpirationDocument         `json:"Expiration,omitempty" xml:"Expiration,omitempty"`
+	NoncurrentVersionExpiration *noncurrentVersionExpirationDocument `json:"NoncurrentVersionExpiration,omitempty" xml:"NoncurrentVersionExpiration,omitempty"`
+}
+
+type lifecycleFilterDocument struct {
+	Prefix string `json:"Prefix" xml:"Prefix"`
+}
+
+type lifecycleExpirationDocument struct {
+	ExpiredObjectDeleteMarker bool `json:"ExpiredObjectDeleteMarker" xml:"ExpiredObjectDeleteMarker"`
+}
+
+type noncurrentVersionExpirationDocument struct {
+	NoncurrentDays int64 `json:"NoncurrentDays" xml:"NoncurrentDays"`
+}
+
+// Lifecycle prints the S3 lifecycle rule equivalent to the settings, and applies it when requested
+func (v *s3Versions) Lifecycle() error {
+	return v.LifecycleWithContext(context.Background())
+}
+
+// LifecycleWithContext prints the S3 lifecycle rule equivalent to the settings, and applies it when requested
+func (v *s3Versions) LifecycleWithContext(ctx context.Context) error {
+	ctx, span := v.tracer.Start(ctx, "Lifecycle", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	rule, warnings, err := v.lifecycleRule()
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		v.logger.Printf("Warning: %s", warning)
+	}
+
+	if err = printLifecycleRules(v.out, v.config.Lifecycle.Format, []*s3.LifecycleRule{rule}); err != nil {
+		return err
+	}
+
+	if !v.config.Lifecycle.Apply {
+		return nil
+	}
+
+	buckets, err := v.getBuckets(ctx)
+	if err != nil {
+		return err
+	}
+
+	buckets, err = v.filterBucketsByVersioningEnabled(ctx, buckets)
+	if err != nil {
+		return err
+	}
+	v.logger.Println("Found these buckets with versioning enabled", buckets)
+
+	for _, bucket := range buckets {
+		if err = v.applyLifecycleRule(ctx, bucket, rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lifecycleRule translates the settings into a lifecycle rule, with warnings for the settings
+// that S3 can't apply natively
+func (v *s3Versions) lifecycleRule() (*s3.LifecycleRule, []string, error) {
+	c := v.config
+	warnings := []string{}
+	noncurrentDays := c.Lifecycle.NoncurrentDays
+	if noncurrentDays <= 0 && c.KeepDays > 0 {
+		noncurrentDays = c.KeepDays
+		warnings = append(warnings, fmt.Sprintf("--keep-days %d is used as --noncurrent-days, the rule expires all the versions noncurrent "+
+			"for more than %d days while --keep-days only deletes those beyond --count", c.KeepDays, c.KeepDays))
+	}
+	if noncurrentDays <= 0 {
+		return nil, nil, errors.New("--noncurrent-days (or --keep-days) is required, S3 lifecycle rules expire noncurrent versions by age")
+	}
+
+	if c.VersionsCount > 0 {
+		warnings = append(warnings, fmt.Sprintf("--count %d can't be expressed with the S3 API version in use (no NewerNoncurrentVersions), "+
+			"the rule expires noncurrent versions by age only", c.VersionsCount))
+	}
+	if len(c.KeepTag) > 0 {
+		warnings = append(warnings, "--keep-tag can't be expressed, lifecycle filters can't exclude tagged versions")
+	}
+	if len(c.Protect) > 0 || len(c.ProtectTag) > 0 || len(c.ProtectPolicy) > 0 {
+		warnings = append(warnings, "protected keys can't be expressed, lifecycle filters can't exclude keys")
+	}
+
+	id := lifecycleRuleID
+	if len(c.BucketPrefix) > 0 {
+		id += ":" + c.BucketPrefix
+	}
+
+	rule := &s3.LifecycleRule{
+		ID:     aws.String(id),
+		Status: aws.String(s3.ExpirationStatusEnabled),
+		Filter: &s3.LifecycleRuleFilter{
+			Prefix: aws.String(c.BucketPrefix),
+		},
+		NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int64(int64(noncurrentDays)),
+		},
+	}
+
+	if !c.Lifecycle.KeepDeleteMarkers {
+		rule.Expiration = &s3.LifecycleExpiration{
+			ExpiredObjectDeleteMarker: aws.Bool(true),
+		}
+	}
+
+	return rule, warnings, nil
+}
+
+func printLifecycleRules(w io.Writer, format string, rules []*s3.LifecycleRule) error {
+	document := lifecycleDocument{Rules: []lifecycleRuleDocument{}}
+	for _, rule := range rules {
+		ruleDocument := lifecycleRuleDocument{
+			ID:     aws.StringValue(rule.ID),
+			Status: aws.StringValue(rule.Status),
+		}
+		if rule.Filter != nil {
+			ruleDocument.Filter.Prefix = aws.StringValue(rule.Filter.Prefix)
+		}
+		if rule.Expiration != nil && aws.BoolValue(rule.Expiration.ExpiredObjectDeleteMarker) {
+			ruleDocument.Expiration = &lifecycleExpirationDocument{ExpiredObjectDeleteMarker: true}
+		}
+		if rule.NoncurrentVersionExpiration != nil {
+			ruleDocument.NoncurrentVersionExpiration = &noncurrentVersionExpirationDocument{
+				NoncurrentDays: aws.Int64Value(rule.NoncurrentVersionExpiration.NoncurrentDays),
+			}
+		}
+		document.Rules = append(document.Rules, ruleDocument)
+	}
+
+	var content []byte
+	var err error
+	if format == "xml" {
+		content, err = xml.MarshalIndent(document, "", "  ")
+	} else {
+		content, err = json.MarshalIndent(document, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+func (v *s3Versions) getLifecycleRules(ctx context.Context, bucket string) ([]*s3.LifecycleRule, error) {
+	response, err := v.s3.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchLifecycleConfiguration" {
+			return []*s3.LifecycleRule{}, nil
+		}
+		return nil, err
+	}
+
+	return response.Rules, nil
+}
+
+// applyLifecycleRule adds the rule to the existing rules of the bucket, replacing the rule with the same ID.
+// Without --confirm, the merged rules are only reported.
+func (v *s3Versions) applyLifecycleRule(ctx context.Context, bucket string, rule *s3.LifecycleRule) error {
+	existing, err := v.getLifecycleRules(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	rules, converted := mergeLifecycleRules(existing, rule)
+	for _, other := range rules {
+		if other != rule && overlapsNoncurrentExpiration(other, rule) {
+			v.logger.Printf("Warning: the rule %s of %s also expires noncurrent versions of %s, the earliest expiration applies",
+				aws.StringValue(other.ID), bucket, aws.StringValue(rule.Filter.Prefix))
+		}
+	}
+	if converted > 0 {
+		v.logger.Printf("Converting %d rules of %s from the deprecated Prefix to a Filter, S3 rejects configurations mixing both",
+			converted, bucket)
+	}
+
+	if !v.config.Confirm {
+		v.logger.Printf("Not applying the lifecycle rule %s to %s (%d rules), add --confirm to apply it",
+			aws.StringValue(rule.ID), bucket, len(rules))
+		return nil
+	}
+
+	_, err = v.s3.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{
+			Rules: rules,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	v.logger.Printf("Applied the lifecycle rule %s to %s (%d rules)", aws.StringValue(rule.ID), bucket, len(rules))
+
+	return nil
+}
+
+// mergeLifecycleRules returns the existing rules with the rule, and the number of rules converted. The rules
+// with the deprecated top-level Prefix are converted to a Filter with the same prefix, as S3 rejects a
+// configuration mixing both with MalformedXML.
+func mergeLifecycleRules(existing []*s3.LifecycleRule, rule *s3.LifecycleRule) ([]*s3.LifecycleRule, int) {
+	rules := []*s3.LifecycleRule{}
+	converted := 0
+	for _, other := range existing {
+		if aws.StringValue(other.ID) == aws.StringValue(rule.ID) {
+			continue
+		}
+		if other.Filter == nil {
+			copied := *other
+			copied.Filter = &s3.LifecycleRuleFilter{Prefix: aws.String(aws.StringValue(other.Prefix))}
+			copied.Prefix = nil
+			other = &copied
+			converted++
+		}
+		rules = append(rules, other)
+	}
+
+	return append(rules, rule), converted
+}
+
+// lifecycleRulePrefix returns the key prefix selected by the rule, from the filter or the deprecated prefix
+func lifecycleRulePrefix(rule *s3.LifecycleRule) string {
+	if rule.Filter != nil {
+		if rule.Filter.Prefix != nil {
+			return aws.StringValue(rule.Filter.Prefix)
+		}
+		if rule.Filter.And != nil {
+			return aws.StringValue(rule.Filter.And.Prefix)
+		}
+		return ""
+	}
+
+	return aws.StringValue(rule.Prefix)
+}
+
+func overlapsNoncurrentExpiration(other *s3.LifecycleRule, rule *s3.LifecycleRule) bool {
+	if other.NoncurrentVersionExpiration == nil || aws.StringValue(other.Status) != s3.ExpirationStatusEnabled {
+		return false
+	}
+
+	a, b := lifecycleRulePrefix(other), lifecycleRulePrefix(rule)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
@@ -0,0 +1,189 @@
+package versions
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func getLifecycleTestService(fakeBuckets map[string]*fakeBucket) (*s3Versions, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	s := getBasicTestService(fakeBuckets)
+	s.out = out
+	s.config.BucketPrefix = "logs/"
+	s.config.VersionsCount = 3
+	s.config.Lifecycle.NoncurrentDays = 30
+	s.config.Lifecycle.Format = "json"
+
+	return s, out
+}
+
+func TestLifecycle_JSON(t *testing.T) {
+	s, out := getLifecycleTestService(setupBucketsAndObjects())
+
+	err := s.Lifecycle()
+	require.Nil(t, err)
+
+	assert.JSONEq(t, `{
+		"Rules": [{
+			"ID": "delete-s3-versions:logs/",
+			"Filter": {"Prefix": "logs/"},
+			"Status": "Enabled",
+			"Expiration": {"ExpiredObjectDeleteMarker": true},
+			"NoncurrentVersionExpiration": {"NoncurrentDays": 30}
+		}]
+	}`, out.String())
+}
+
+func TestLifecycle_XML(t *testing.T) {
+	s, out := getLifecycleTestService(setupBucketsAndObjects())
+	s.config.Lifecycle.Format = "xml"
+	s.config.Lifecycle.KeepDeleteMarkers = true
+
+	err := s.Lifecycle()
+	require.Nil(t, err)
+
+	assert.Equal(t, `<LifecycleConfiguration>
+  <Rule>
+    <ID>delete-s3-versions:logs/</ID>
+    <Filter>
+      <Prefix>logs/</Prefix>
+    </Filter>
+    <Status>Enabled</Status>
+    <NoncurrentVersionExpiration>
+      <NoncurrentDays>30</NoncurrentDays>
+    </NoncurrentVersionExpiration>
+  </Rule>
+</LifecycleConfiguration>
+`, out.String())
+}
+
+func TestLifecycleRule_Warnings(t *testing.T) {
+	s, _ := getLifecycleTestService(setupBucketsAndObjects())
+	s.config.KeepTag = []string{"keep=true"}
+
+	_, warnings, err := s.lifecycleRule()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(warnings))
+	assert.Contains(t, warnings[0], "--count 3 can't be expressed")
+	assert.Contains(t, warnings[1], "--keep-tag can't be expressed")
+}
+
+func TestLifecycleRule_RequiresNoncurrentDays(t *testing.T) {
+	s, _ := getLifecycleTestService(setupBucketsAndObjects())
+	s.config.Lifecycle.NoncurrentDays = 0
+
+	_, _, err := s.lifecycleRule()
+	require.NotNil(t, err)
+
+	s.config.KeepDays = 14
+	rule, warnings, err := s.lifecycleRule()
+	require.Nil(t, err)
+	assert.Equal(t, int64(14), *rule.NoncurrentVersionExpiration.NoncurrentDays)
+	// --keep-days doesn't mean the same as NoncurrentDays, it only applies beyond --count
+	assert.Contains(t, warnings[0], "--keep-days 14 is used as --noncurrent-days")
+
+	s.config.Lifecycle.NoncurrentDays = 30
+	rule, warnings, err = s.lifecycleRule()
+	require.Nil(t, err)
+	assert.Equal(t, int64(30), *rule.NoncurrentVersionExpiration.NoncurrentDays)
+	for _, warning := range warnings {
+		assert.NotContains(t, warning, "--keep-days")
+	}
+}
+
+func TestLifecycle_Apply(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].LifecycleRules = []*s3.LifecycleRule{
+		{
+			ID:     aws.String("archive"),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("logs/archive/")},
+			NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int64(90),
+			},
+		},
+		{
+			ID:     aws.String("delete-s3-versions:logs/"),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("logs/")},
+			NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int64(10),
+			},
+		},
+	}
+	s, _ := getLifecycleTestService(fakeBuckets)
+	s.config.Lifecycle.Apply = true
+
+	err := s.Lifecycle()
+	require.Nil(t, err)
+
+	rules := fakeBuckets["b1"].LifecycleRules
+	require.Equal(t, 2, len(rules))
+	assert.Equal(t, "archive", *rules[0].ID)
+	assert.Equal(t, "delete-s3-versions:logs/", *rules[1].ID)
+	assert.Equal(t, int64(30), *rules[1].NoncurrentVersionExpiration.NoncurrentDays)
+
+	// Buckets without versioning are left alone
+	assert.Equal(t, 0, len(fakeBuckets["b2"].LifecycleRules))
+}
+
+func TestLifecycle_ApplyWithoutConfirm(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s, _ := getLifecycleTestService(fakeBuckets)
+	s.config.Lifecycle.Apply = true
+	s.config.Confirm = false
+
+	err := s.Lifecycle()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(fakeBuckets["b1"].LifecycleRules))
+}
+
+func TestLifecycle_ApplyLegacyPrefixRules(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].LifecycleRules = []*s3.LifecycleRule{
+		{
+			ID:     aws.String("archive"),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Prefix: aws.String("logs/archive/"),
+			NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int64(90),
+			},
+		},
+	}
+	s, _ := getLifecycleTestService(fakeBuckets)
+	s.config.Lifecycle.Apply = true
+
+	err := s.Lifecycle()
+	require.Nil(t, err)
+
+	// The rule with the deprecated prefix is converted, S3 rejects a configuration mixing both
+	rules := fakeBuckets["b1"].LifecycleRules
+	require.Equal(t, 2, len(rules))
+	assert.Equal(t, "archive", *rules[0].ID)
+	assert.Nil(t, rules[0].Prefix)
+	assert.Equal(t, "logs/archive/", *rules[0].Filter.Prefix)
+	assert.Equal(t, int64(90), *rules[0].NoncurrentVersionExpiration.NoncurrentDays)
+	assert.Equal(t, "delete-s3-versions:logs/", *rules[1].ID)
+}
+
+func TestOverlapsNoncurrentExpiration(t *testing.T) {
+	rule := &s3.LifecycleRule{Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("logs/")}}
+	expiring := func(prefix string) *s3.LifecycleRule {
+		return &s3.LifecycleRule{
+			Status:                      aws.String(s3.ExpirationStatusEnabled),
+			Prefix:                      aws.String(prefix),
+			NoncurrentVersionExpiration: &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(1)},
+		}
+	}
+
+	assert.True(t, overlapsNoncurrentExpiration(expiring(""), rule))
+	assert.True(t, overlapsNoncurrentExpiration(expiring("logs/app/"), rule))
+	assert.False(t, overlapsNoncurrentExpiration(expiring("images/"), rule))
+	assert.False(t, overlapsNoncurrentExpiration(&s3.LifecycleRule{Prefix: aws.String("logs/")}, rule))
+}
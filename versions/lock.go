@@ -0,0 +1,475 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// lockKeyPrefix is the prefix of the S3 lock objects, these keys are never processed
+const lockKeyPrefix = ".delete-s3-versions/locks/"
+const defaultLockTTL = 5 * time.Minute
+
+// lockRecord is the content of a lock
+type lockRecord struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// lockStore persists the lock of a bucket
+type lockStore interface {
+	// read returns the current lock, nil when there is none
+	read(ctx context.Context) (*lockRecord, error)
+	// update replaces the current lock with the record returned by fn, or removes it when the record is nil.
+	// Nothing is written when fn fails.
+	update(ctx context.Context, fn func(current *lockRecord) (*lockRecord, error)) error
+	remove(ctx context.Context) error
+	String() string
+}
+
+// bucketLock prevents concurrent runs against the same bucket. The lock expires unless it is renewed
+// by the heartbeat of the run holding it, so a run that died doesn't block the next ones forever.
+// The run is stopped when the lock can't be renewed or was acquired by another run.
+type bucketLock struct {
+	store  lockStore
+	owner  string
+	ttl    time.Duration
+	now    func() time.Time
+	logger Logger
+
+	stop   chan struct{}
+	done   sync.WaitGroup
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	lost error
+}
+
+func newBucketLock(store lockStore, owner string, ttl time.Duration) *bucketLock {
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+
+	return &bucketLock{
+		store:  store,
+		owner:  owner,
+		ttl:    ttl,
+		now:    time.Now,
+		logger: stdLogger{},
+	}
+}
+
+// acquire writes the lock when it is free or expired, and reads it back to make sure that another run
+// didn't write it at the same time. The heartbeat renewing the lock is started, the context returned is
+// cancelled when the lock is lost.
+func (l *bucketLock) acquire(ctx context.Context, force bool) (context.Context, error) {
+	if force {
+		l.logger.Printf("Removing %s", l.store)
+		if err := l.store.remove(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	err := l.store.update(ctx, func(current *lockRecord) (*lockRecord, error) {
+		if current != nil && current.Owner != l.owner && current.Expires.After(l.now()) {
+			return nil, fmt.Errorf("%s is held by %s until %s, use --force-unlock if that run died",
+				l.store, current.Owner, current.Expires.Format(time.RFC3339))
+		}
+		return &lockRecord{Owner: l.owner, Expires: l.now().Add(l.ttl)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := l.store.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.Owner != l.owner {
+		return nil, fmt.Errorf("%s was acquired by another run at the same time", l.store)
+	}
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.stop = make(chan struct{})
+	l.done.Add(1)
+	go l.heartbeat()
+
+	return ctx, nil
+}
+
+// renew extends the lock, checking that this run still holds it
+func (l *bucketLock) renew(current *lockRecord) (*lockRecord, error) {
+	if current == nil {
+		return nil, fmt.Errorf("%s was removed", l.store)
+	}
+	if current.Owner != l.owner {
+		return nil, fmt.Errorf("%s was acquired by %s after expiring", l.store, current.Owner)
+	}
+
+	return &lockRecord{Owner: l.owner, Expires: l.now().Add(l.ttl)}, nil
+}
+
+func (l *bucketLock) heartbeat() {
+	defer l.done.Done()
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.store.update(context.Background(), l.renew); err != nil {
+				l.logger.Printf("Stopping, failed to renew %s: %v", l.store, err)
+				l.mu.Lock()
+				l.lost = fmt.Errorf("Lost %s: %v", l.store, err)
+				l.mu.Unlock()
+				l.cancel()
+				return
+			}
+		}
+	}
+}
+
+// lostError returns why the lock was lost while the run held it, nil when it wasn't
+func (l *bucketLock) lostError() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lost
+}
+
+// release stops the heartbeat and removes the lock, unless it expired and another run acquired it
+func (l *bucketLock) release() error {
+	if l.stop != nil {
+		close(l.stop)
+		l.done.Wait()
+		l.cancel()
+		l.stop = nil
+	}
+
+	return l.store.update(context.Background(), func(current *lockRecord) (*lockRecord, error) {
+		if current != nil && current.Owner != l.owner {
+			return nil, fmt.Errorf("%s was acquired by %s after expiring", l.store, current.Owner)
+		}
+		return nil, nil
+	})
+}
+
+// s3LockStore keeps the lock in an object, the version it replaces is removed on each write and all its
+// versions are removed on release. S3 has no conditional writes for this SDK: update reads the lock then
+// writes it, another run writing in between is detected when acquiring by reading the lock back, and by
+// the next renewal otherwise.
+type s3LockStore struct {
+	v      *s3Versions
+	bucket string
+	key    string
+}
+
+func (s *s3LockStore) String() string {
+	return fmt.Sprintf("the lock s3://%s/%s", s.bucket, s.key)
+}
+
+func (s *s3LockStore) read(ctx context.Context) (*lockRecord, error) {
+	record, _, err := s.get(ctx)
+	return record, err
+}
+
+// get returns the current lock and its version ID
+func (s *s3LockStore) get(ctx context.Context) (*lockRecord, string, error) {
+	response, err := s.v.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound") {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+	defer response.Body.Close()
+
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	record, err := parseLockRecord(content)
+	return record, aws.StringValue(response.VersionId), err
+}
+
+// update removes the version of the lock it replaces, so that the heartbeats don't pile up versions in the
+// bucket. Failing to remove it only logs a warning, the remaining versions are removed on release.
+func (s *s3LockStore) update(ctx context.Context, fn func(current *lockRecord) (*lockRecord, error)) error {
+	current, previousVersionID, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	record, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return s.remove(ctx)
+	}
+
+	versionID, err := s.write(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	// Writing to a bucket without versioning replaces the null version, there is nothing left to remove
+	if previousVersionID == "" || previousVersionID == nullVersionID || previousVersionID == versionID {
+		return nil
+	}
+	objects := []*s3.ObjectIdentifier{{Key: aws.String(s.key), VersionId: aws.String(previousVersionID)}}
+	if err := s.deleteVersions(ctx, objects); err != nil {
+		s.v.logger.Printf("Warning: failed to remove the previous version of %s: %v", s, err)
+	}
+
+	return nil
+}
+
+// write puts the lock and returns its version ID
+func (s *s3LockStore) write(ctx context.Context, record *lockRecord) (string, error) {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := s.v.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(response.VersionId), nil
+}
+
+// remove deletes every version of the lock object, so that locking doesn't pile up versions in the bucket.
+// The versions are all listed before deleting them, deleting while listing would move the next page.
+func (s *s3LockStore) remove(ctx context.Context) error {
+	objects := []*s3.ObjectIdentifier{}
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.key),
+	}
+
+	for {
+		response, err := s.v.s3.ListObjectVersionsWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range response.Versions {
+			if aws.StringValue(version.Key) == s.key {
+				objects = append(objects, &s3.ObjectIdentifier{Key: version.Key, VersionId: aws.String(versionID(version.VersionId))})
+			}
+		}
+		for _, marker := range response.DeleteMarkers {
+			if aws.StringValue(marker.Key) == s.key {
+				objects = append(objects, &s3.ObjectIdentifier{Key: marker.Key, VersionId: aws.String(versionID(marker.VersionId))})
+			}
+		}
+
+		if !aws.BoolValue(response.IsTruncated) {
+			break
+		}
+		input.KeyMarker = response.NextKeyMarker
+		input.VersionIdMarker = response.NextVersionIdMarker
+	}
+
+	for beginIndex := 0; beginIndex < len(objects); beginIndex += maxDeleteObjects {
+		endIndex := int(math.Min(float64(beginIndex+maxDeleteObjects), float64(len(objects))))
+		if err := s.deleteVersions(ctx, objects[beginIndex:endIndex]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *s3LockStore) deleteVersions(ctx context.Context, objects []*s3.ObjectIdentifier) error {
+	output, err := s.v.deleteObjects(ctx, s.bucket, &s3.DeleteObjectsInput{
+		Bucket: aws.String(s.bucket),
+		Delete: &s3.Delete{Objects: objects},
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.Errors) > 0 {
+		return fmt.Errorf("Failed to remove %s: %s", s, aws.StringValue(output.Errors[0].Message))
+	}
+
+	return nil
+}
+
+// fileLockStore keeps the lock in a local file, for runs on a single host. The updates hold an exclusive
+// lock of the file with the .guard suffix, which is left in place: removing it would let two runs lock
+// different files.
+type fileLockStore struct {
+	path string
+}
+
+func (s *fileLockStore) update(ctx context.Context, fn func(current *lockRecord) (*lockRecord, error)) error {
+	guard, err := os.OpenFile(s.path+".guard", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer guard.Close()
+
+	if err = lockFile(guard); err != nil {
+		return fmt.Errorf("Failed to lock %s: %v", guard.Name(), err)
+	}
+	defer unlockFile(guard)
+
+	current, err := s.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	record, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return s.remove(ctx)
+	}
+
+	return s.write(ctx, record)
+}
+
+func (s *fileLockStore) String() string {
+	return "the lock file " + s.path
+}
+
+func (s *fileLockStore) read(ctx context.Context) (*lockRecord, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return parseLockRecord(content)
+}
+
+func (s *fileLockStore) write(ctx context.Context, record *lockRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileLockStore) remove(ctx context.Context) error {
+	err := os.Remove(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func parseLockRecord(content []byte) (*lockRecord, error) {
+	record := &lockRecord{}
+	if err := json.Unmarshal(content, record); err != nil {
+		return nil, fmt.Errorf("Invalid lock: %v", err)
+	}
+
+	return record, nil
+}
+
+func isLockKey(key string) bool {
+	return strings.HasPrefix(key, lockKeyPrefix)
+}
+
+// newLockOwner identifies the run in the locks it holds
+func newLockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	return fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
+
+// lockStore returns where the lock of the bucket is kept, nil when locking is disabled
+func (v *s3Versions) lockStore(bucket string) lockStore {
+	switch v.config.Lock {
+	case "s3":
+		lockBucket := v.config.LockBucket
+		if len(lockBucket) == 0 {
+			lockBucket = bucket
+		}
+		return &s3LockStore{v: v, bucket: lockBucket, key: lockKeyPrefix + bucket}
+	case "file":
+		dir := v.config.LockDir
+		if len(dir) == 0 {
+			dir = os.TempDir()
+		}
+		return &fileLockStore{path: filepath.Join(dir, "delete-s3-versions-"+bucket+".lock")}
+	}
+
+	return nil
+}
+
+// lockBucket acquires the lock of the bucket before deleting when locking is enabled. It returns the context
+// to delete with, cancelled when the lock is lost, and the function releasing the lock, which returns why
+// the lock was lost.
+func (v *s3Versions) lockBucket(ctx context.Context, bucket string) (context.Context, func() error, error) {
+	store := v.lockStore(bucket)
+	if store == nil {
+		return ctx, func() error { return nil }, nil
+	}
+
+	lock := newBucketLock(store, v.lockOwner, v.config.LockTTL)
+	lock.logger = v.logger
+	lockCtx, err := lock.acquire(ctx, v.config.ForceUnlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	v.logger.Printf("Acquired %s", store)
+
+	return lockCtx, func() error {
+		if err := lock.release(); err != nil {
+			v.logger.Printf("Warning: failed to release %s: %v", store, err)
+		}
+		return lock.lostError()
+	}, nil
+}
@@ -0,0 +1,310 @@
+package versions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func putFakeLock(t *testing.T, bucket *fakeBucket, key string, record *lockRecord) {
+	body, err := json.Marshal(record)
+	require.Nil(t, err)
+
+	bucket.Objects[key] = append(bucket.Objects[key], &fakeVersion{
+		VersionID:    "other-run",
+		LastModified: time.Now(),
+		Body:         body,
+	})
+}
+
+func getLockTestService(fakeBuckets map[string]*fakeBucket, mode string) *s3Versions {
+	s := getBasicTestService(fakeBuckets)
+	s.config.BucketName = "b1"
+	s.config.Lock = mode
+	s.config.LockTTL = time.Hour
+	s.lockOwner = "this-run"
+
+	return s
+}
+
+func TestDelete_S3Lock(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getLockTestService(fakeBuckets, "s3")
+
+	var lockDuringDelete *lockRecord
+	s.s3.(*s3apiMock).onDeleteObjects = func(input *s3.DeleteObjectsInput) {
+		if lockDuringDelete == nil {
+			lockDuringDelete, _ = s.lockStore("b1").read(context.Background())
+		}
+	}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	require.NotNil(t, lockDuringDelete)
+	assert.Equal(t, "this-run", lockDuringDelete.Owner)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	// Every version of the lock object is removed once the bucket is done
+	assert.Equal(t, 0, len(fakeBuckets["b1"].Objects[lockKeyPrefix+"b1"]))
+}
+
+func TestDelete_S3LockHeld(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	putFakeLock(t, fakeBuckets["b1"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)})
+	s := getLockTestService(fakeBuckets, "s3")
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is held by other-run")
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects[lockKeyPrefix+"b1"]))
+}
+
+func TestDelete_S3LockExpired(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	putFakeLock(t, fakeBuckets["b1"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run", Expires: time.Now().Add(-time.Minute)})
+	s := getLockTestService(fakeBuckets, "s3")
+
+	err := s.Delete()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 0, len(fakeBuckets["b1"].Objects[lockKeyPrefix+"b1"]))
+}
+
+func TestDelete_ForceUnlock(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	putFakeLock(t, fakeBuckets["b1"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)})
+	s := getLockTestService(fakeBuckets, "s3")
+	s.config.ForceUnlock = true
+
+	err := s.Delete()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestDelete_S3LockBucket(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	putFakeLock(t, fakeBuckets["b2"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)})
+	s := getLockTestService(fakeBuckets, "s3")
+	s.config.LockBucket = "b2"
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "s3://b2/"+lockKeyPrefix+"b1")
+}
+
+func TestSkipDelete_NoLock(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	putFakeLock(t, fakeBuckets["b1"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)})
+	s := getLockTestService(fakeBuckets, "s3")
+	s.config.Confirm = false
+
+	err := s.Delete()
+	require.Nil(t, err)
+}
+
+func TestListFileVersions_IgnoresLockObjects(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	putFakeLock(t, fakeBuckets["b1"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run"})
+	s := getBasicTestService(fakeBuckets)
+
+	fileVersions, err := s.getFileVersions(context.Background(), "b1")
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(fileVersions))
+}
+
+func TestDelete_FileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	fakeBuckets := setupBucketsAndObjects()
+	s := getLockTestService(fakeBuckets, "file")
+	s.config.LockDir = dir
+
+	store := s.lockStore("b1").(*fileLockStore)
+	require.Nil(t, store.write(context.Background(), &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)}))
+
+	err = s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is held by other-run")
+
+	s.config.ForceUnlock = true
+	err = s.Delete()
+	require.Nil(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "delete-s3-versions-b1.lock"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBucketLock_Heartbeat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &fileLockStore{path: filepath.Join(dir, "test.lock")}
+	lock := newBucketLock(store, "this-run", 30*time.Millisecond)
+
+	_, err = lock.acquire(context.Background(), false)
+	require.Nil(t, err)
+	acquired, err := store.read(context.Background())
+	require.Nil(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	renewed, err := store.read(context.Background())
+	require.Nil(t, err)
+	assert.True(t, renewed.Expires.After(acquired.Expires))
+
+	require.Nil(t, lock.release())
+	current, err := store.read(context.Background())
+	require.Nil(t, err)
+	assert.Nil(t, current)
+}
+
+func TestBucketLock_ReleaseAfterTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &fileLockStore{path: filepath.Join(dir, "test.lock")}
+	lock := newBucketLock(store, "this-run", time.Hour)
+	_, err = lock.acquire(context.Background(), false)
+	require.Nil(t, err)
+
+	require.Nil(t, store.write(context.Background(), &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)}))
+	assert.NotNil(t, lock.release())
+
+	current, err := store.read(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "other-run", current.Owner)
+}
+
+func TestBucketLock_HeartbeatAfterTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &fileLockStore{path: filepath.Join(dir, "test.lock")}
+	lock := newBucketLock(store, "this-run", 30*time.Millisecond)
+	ctx, err := lock.acquire(context.Background(), false)
+	require.Nil(t, err)
+
+	// The renewal doesn't overwrite the lock of the other run, and stops this run
+	require.Nil(t, store.write(context.Background(), &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)}))
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the run wasn't stopped")
+	}
+	require.NotNil(t, lock.lostError())
+	assert.Contains(t, lock.lostError().Error(), "acquired by other-run")
+
+	current, err := store.read(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "other-run", current.Owner)
+	assert.NotNil(t, lock.release())
+}
+
+func TestDelete_S3LockLost(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getLockTestService(fakeBuckets, "s3")
+	s.config.LockTTL = 30 * time.Millisecond
+
+	// Another run takes the lock over before the first batch, this run stops once the renewal notices it
+	mock := s.s3.(*s3apiMock)
+	mock.onDeleteObjects = func(input *s3.DeleteObjectsInput) {
+		if aws.StringValue(input.Delete.Objects[0].Key) == "key1" {
+			mock.objectsMu.Lock()
+			putFakeLock(t, fakeBuckets["b1"], lockKeyPrefix+"b1", &lockRecord{Owner: "other-run", Expires: time.Now().Add(time.Hour)})
+			mock.objectsMu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	s.config.CheckpointPages = 1
+	s.config.StateFile = filepath.Join(os.TempDir(), fmt.Sprintf("lock-lost-%d.json", time.Now().UnixNano()))
+	defer os.Remove(s.config.StateFile)
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Lost the lock s3://b1/"+lockKeyPrefix+"b1")
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestFileLockStore_ConcurrentAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	store := &fileLockStore{path: filepath.Join(dir, "test.lock")}
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			lock := newBucketLock(store, fmt.Sprintf("run-%d", i), time.Hour)
+			_, err := lock.acquire(context.Background(), false)
+			results <- err
+		}(i)
+	}
+
+	acquired := 0
+	for i := 0; i < 10; i++ {
+		if <-results == nil {
+			acquired++
+		}
+	}
+	assert.Equal(t, 1, acquired)
+}
+
+func TestS3LockStore_RenewalsKeepOneVersion(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getLockTestService(fakeBuckets, "s3")
+	s.s3 = newS3ApiMock(fakeBuckets, 1000)
+	lock := newBucketLock(s.lockStore("b1"), "this-run", time.Hour)
+
+	_, err := lock.acquire(context.Background(), false)
+	require.Nil(t, err)
+	defer lock.release()
+
+	for i := 0; i < 1500; i++ {
+		require.Nil(t, lock.store.update(context.Background(), lock.renew))
+	}
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects[lockKeyPrefix+"b1"]))
+	current, err := lock.store.read(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, "this-run", current.Owner)
+}
+
+func TestS3LockStore_RemoveManyVersions(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getLockTestService(fakeBuckets, "s3")
+	s.s3 = newS3ApiMock(fakeBuckets, 1000)
+
+	// Versions left behind by the heartbeats of a run that couldn't remove them
+	key := lockKeyPrefix + "b1"
+	for i := 0; i < 2500; i++ {
+		body, err := json.Marshal(&lockRecord{Owner: "other-run", Expires: time.Now().Add(-time.Minute)})
+		require.Nil(t, err)
+		fakeBuckets["b1"].Objects[key] = append(fakeBuckets["b1"].Objects[key], &fakeVersion{
+			VersionID:      fmt.Sprintf("heartbeat-%d", i),
+			LastModified:   time.Now().Add(time.Duration(i-2500) * time.Second),
+			IsDeleteMarker: i%100 == 99,
+			Body:           body,
+		})
+	}
+
+	require.Nil(t, s.lockStore("b1").remove(context.Background()))
+	assert.Equal(t, 0, len(fakeBuckets["b1"].Objects[key]))
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
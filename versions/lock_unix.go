@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package versions
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits for an exclusive lock of the file, released when the process exits
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
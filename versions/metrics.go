@@ -0,0 +1,167 @@
+package versions
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/croman/delete-s3-versions/metrics"
+	"github.com/croman/delete-s3-versions/s3api"
+)
+
+const metricsPrefix = "delete_s3_versions_"
+
+// runMetrics holds the metrics recorded while finding and deleting file versions
+type runMetrics struct {
+	registry        *metrics.Registry
+	listPages       *metrics.Counter
+	versionsScanned *metrics.Counter
+	versionsDeleted *metrics.Counter
+	bytesReclaimed  *metrics.Counter
+	deleteErrors    *metrics.Counter
+	uploadsAborted  *metrics.Counter
+	apiLatency      *metrics.Histogram
+	lastRun         *metrics.Gauge
+}
+
+func newRunMetrics() *runMetrics {
+	registry := metrics.NewRegistry()
+
+	return &runMetrics{
+		registry: registry,
+		listPages: registry.NewCounter(metricsPrefix+"list_pages_total",
+			"ListObjectVersions pages fetched", "bucket", "region"),
+		versionsScanned: registry.NewCounter(metricsPrefix+"versions_scanned_total",
+			"File versions and delete markers listed", "bucket", "region"),
+		versionsDeleted: registry.NewCounter(metricsPrefix+"versions_deleted_total",
+			"File versions and delete markers deleted", "bucket", "region"),
+		bytesReclaimed: registry.NewCounter(metricsPrefix+"bytes_reclaimed_total",
+			"Size of the deleted file versions", "bucket", "region"),
+		deleteErrors: registry.NewCounter(metricsPrefix+"delete_errors_total",
+			"DeleteObjects request failures and per-version deletion errors", "bucket", "region"),
+		uploadsAborted: registry.NewCounter(metricsPrefix+"multipart_uploads_aborted_total",
+			"Incomplete multipart uploads aborted", "bucket", "region"),
+		apiLatency: registry.NewHistogram(metricsPrefix+"api_duration_seconds",
+			"S3 API call latencies", metrics.DefaultLatencyBuckets, "operation", "bucket", "region"),
+		lastRun: registry.NewGauge(metricsPrefix+"last_run_timestamp_seconds",
+			"Unix time of the last completed run", "region"),
+	}
+}
+
+// instrumentedS3 records the latency of the S3 API calls used to find and delete file versions
+type instrumentedS3 struct {
+	s3api.S3API
+	metrics *runMetrics
+	region  string
+	regions *regionCache
+}
+
+func newInstrumentedS3(api s3api.S3API, m *runMetrics, region string, regions *regionCache) s3api.S3API {
+	return &instrumentedS3{
+		S3API:   api,
+		metrics: m,
+		region:  region,
+		regions: regions,
+	}
+}
+
+// observe labels the calls with the region of the bucket, or with the region of the client until it is known
+func (s *instrumentedS3) observe(operation string, bucket *string, start time.Time) {
+	region := s.region
+	if bucketRegion, ok := s.regions.get(aws.StringValue(bucket)); ok {
+		region = bucketRegion
+	}
+	s.metrics.apiLatency.Observe(time.Since(start).Seconds(), operation, aws.StringValue(bucket), region)
+}
+
+func (s *instrumentedS3) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput, opts ...request.Option) (*s3.ListBucketsOutput, error) {
+	defer s.observe("ListBuckets", nil, time.Now())
+	return s.S3API.ListBucketsWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	defer s.observe("HeadBucket", input.Bucket, time.Now())
+	return s.S3API.HeadBucketWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	defer s.observe("GetBucketLocation", input.Bucket, time.Now())
+	return s.S3API.GetBucketLocationWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, opts ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+	defer s.observe("GetBucketVersioning", input.Bucket, time.Now())
+	return s.S3API.GetBucketVersioningWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) ListObjectVersionsWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, opts ...request.Option) (*s3.ListObjectVersionsOutput, error) {
+	defer s.observe("ListObjectVersions", input.Bucket, time.Now())
+	return s.S3API.ListObjectVersionsWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	defer s.observe("DeleteObjects", input.Bucket, time.Now())
+	return s.S3API.DeleteObjectsWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetObjectLockConfigurationWithContext(ctx aws.Context, input *s3.GetObjectLockConfigurationInput, opts ...request.Option) (*s3.GetObjectLockConfigurationOutput, error) {
+	defer s.observe("GetObjectLockConfiguration", input.Bucket, time.Now())
+	return s.S3API.GetObjectLockConfigurationWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetObjectRetentionWithContext(ctx aws.Context, input *s3.GetObjectRetentionInput, opts ...request.Option) (*s3.GetObjectRetentionOutput, error) {
+	defer s.observe("GetObjectRetention", input.Bucket, time.Now())
+	return s.S3API.GetObjectRetentionWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetObjectLegalHoldWithContext(ctx aws.Context, input *s3.GetObjectLegalHoldInput, opts ...request.Option) (*s3.GetObjectLegalHoldOutput, error) {
+	defer s.observe("GetObjectLegalHold", input.Bucket, time.Now())
+	return s.S3API.GetObjectLegalHoldWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	defer s.observe("GetObjectTagging", input.Bucket, time.Now())
+	return s.S3API.GetObjectTaggingWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	defer s.observe("GetObject", input.Bucket, time.Now())
+	return s.S3API.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	defer s.observe("PutObject", input.Bucket, time.Now())
+	return s.S3API.PutObjectWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	defer s.observe("GetBucketLifecycleConfiguration", input.Bucket, time.Now())
+	return s.S3API.GetBucketLifecycleConfigurationWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	defer s.observe("PutBucketLifecycleConfiguration", input.Bucket, time.Now())
+	return s.S3API.PutBucketLifecycleConfigurationWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+	defer s.observe("ListMultipartUploads", input.Bucket, time.Now())
+	return s.S3API.ListMultipartUploadsWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
+	defer s.observe("ListParts", input.Bucket, time.Now())
+	return s.S3API.ListPartsWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	defer s.observe("AbortMultipartUpload", input.Bucket, time.Now())
+	return s.S3API.AbortMultipartUploadWithContext(ctx, input, opts...)
+}
+
+func (s *instrumentedS3) PutBucketVersioningWithContext(ctx aws.Context, input *s3.PutBucketVersioningInput, opts ...request.Option) (*s3.PutBucketVersioningOutput, error) {
+	defer s.observe("PutBucketVersioning", input.Bucket, time.Now())
+	return s.S3API.PutBucketVersioningWithContext(ctx, input, opts...)
+}
@@ -0,0 +1,66 @@
+package versions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].Objects["key1"][0].Size = 100
+	fakeBuckets["b1"].Objects["key1"][1].Size = 20
+
+	s := getBasicTestService(fakeBuckets)
+	s.s3 = newInstrumentedS3(s.s3, s.metrics, "eu-west-1", s.regions)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	out := &bytes.Buffer{}
+	require.Nil(t, s.Metrics().Write(out))
+
+	assert.Contains(t, out.String(), `delete_s3_versions_list_pages_total{bucket="b1",region="eu-west-1"} 3`)
+	assert.Contains(t, out.String(), `delete_s3_versions_versions_scanned_total{bucket="b1",region="eu-west-1"} 7`)
+	assert.Contains(t, out.String(), `delete_s3_versions_versions_deleted_total{bucket="b1",region="eu-west-1"} 5`)
+	assert.Contains(t, out.String(), `delete_s3_versions_bytes_reclaimed_total{bucket="b1",region="eu-west-1"} 120`)
+	assert.Contains(t, out.String(), `delete_s3_versions_api_duration_seconds_count{operation="DeleteObjects",bucket="b1",region="eu-west-1"} 1`)
+	assert.Contains(t, out.String(), `delete_s3_versions_api_duration_seconds_count{operation="ListBuckets",bucket="",region="eu-west-1"} 1`)
+	assert.Contains(t, out.String(), `delete_s3_versions_delete_errors_total{bucket="b1",region="eu-west-1"} 0`)
+}
+
+func TestMetrics_LastRunClock(t *testing.T) {
+	s := getBasicTestService(setupBucketsAndObjects())
+	s.now = func() time.Time { return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	require.Nil(t, s.Delete())
+
+	out := &bytes.Buffer{}
+	require.Nil(t, s.Metrics().Write(out))
+	assert.Contains(t, out.String(), `delete_s3_versions_last_run_timestamp_seconds{region="eu-west-1"} 1.5778368e+09`)
+}
+
+func TestMetrics_BucketRegion(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].Region = "us-east-1"
+
+	s := getBasicTestService(fakeBuckets)
+	s.s3 = newInstrumentedS3(s.s3, s.metrics, "eu-west-1", s.regions)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	out := &bytes.Buffer{}
+	require.Nil(t, s.Metrics().Write(out))
+
+	// The series of b1 are labelled with its region, not with --s3-region
+	assert.Contains(t, out.String(), `delete_s3_versions_versions_deleted_total{bucket="b1",region="us-east-1"} 5`)
+	assert.Contains(t, out.String(), `delete_s3_versions_api_duration_seconds_count{operation="DeleteObjects",bucket="b1",region="us-east-1"} 1`)
+	assert.Contains(t, out.String(), `delete_s3_versions_api_duration_seconds_count{operation="GetBucketVersioning",bucket="b1",region="us-east-1"} 1`)
+	// Only the call looking the region up is labelled with the region of the client
+	assert.Contains(t, out.String(), `delete_s3_versions_api_duration_seconds_count{operation="GetBucketLocation",bucket="b1",region="eu-west-1"} 1`)
+	assert.Contains(t, out.String(), `delete_s3_versions_api_duration_seconds_count{operation="GetBucketVersioning",bucket="b2",region="eu-west-1"} 1`)
+}
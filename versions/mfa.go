@@ -0,0 +1,111 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// mfaCodeLifetime is how long a TOTP code is used before asking for a new one
+const mfaCodeLifetime = 30 * time.Second
+
+// mfaCode supplies the MFA header of the delete requests sent to buckets with MFA Delete enabled,
+// asking for a new code when the current one expired
+type mfaCode struct {
+	mu         sync.Mutex
+	serial     string
+	code       string
+	obtainedAt time.Time
+	prompter   prompter
+	now        func() time.Time
+}
+
+func newMFACode(serial string, code string, p prompter) *mfaCode {
+	m := &mfaCode{
+		serial:   serial,
+		prompter: p,
+		now:      time.Now,
+	}
+
+	if len(code) > 0 {
+		m.code = code
+		m.obtainedAt = m.now()
+	}
+
+	return m
+}
+
+// header returns the value of the MFA header, "serial code"
+func (m *mfaCode) header() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.code) == 0 || m.now().Sub(m.obtainedAt) >= mfaCodeLifetime {
+		code, err := m.prompter.prompt(fmt.Sprintf("MFA code for %s: ", m.serial))
+		if err != nil {
+			return "", fmt.Errorf("Failed to read the MFA code: %v", err)
+		}
+		if len(code) == 0 {
+			return "", errors.New("Failed to read the MFA code: empty code")
+		}
+
+		m.code = code
+		m.obtainedAt = m.now()
+	}
+
+	return m.serial + " " + m.code, nil
+}
+
+// expire forgets the current code, e.g. when S3 rejected it
+func (m *mfaCode) expire() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.code = ""
+}
+
+// checkMFA fails when a bucket to delete from has MFA Delete enabled and no MFA device is configured
+func (v *s3Versions) checkMFA(buckets []string) error {
+	if !v.config.Confirm || v.mfa != nil {
+		return nil
+	}
+
+	for _, bucket := range buckets {
+		if v.mfaDelete[bucket] {
+			return fmt.Errorf("Bucket %s has MFA Delete enabled, --mfa-serial is required", bucket)
+		}
+	}
+
+	return nil
+}
+
+// deleteObjects sends a deletion batch, with the MFA header on buckets with MFA Delete enabled.
+// When the code is rejected, the batch is sent again once with a new code.
+func (v *s3Versions) deleteObjects(ctx context.Context, bucket string, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	if !v.mfaDelete[bucket] {
+		return v.s3.DeleteObjectsWithContext(ctx, input)
+	}
+
+	for attempt := 1; ; attempt++ {
+		header, err := v.mfa.header()
+		if err != nil {
+			return nil, err
+		}
+		input.MFA = aws.String(header)
+
+		response, err := v.s3.DeleteObjectsWithContext(ctx, input)
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "AccessDenied" && attempt == 1 {
+			v.logger.Printf("\tThe MFA code was rejected for %s: %v", bucket, err)
+			v.mfa.expire()
+			continue
+		}
+
+		return response, err
+	}
+}
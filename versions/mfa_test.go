@@ -0,0 +1,107 @@
+package versions
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePrompter answers the prompts in order
+type fakePrompter struct {
+	answers []string
+	prompts []string
+	tty     bool
+}
+
+func (p *fakePrompter) prompt(message string) (string, error) {
+	p.prompts = append(p.prompts, message)
+	if len(p.answers) == 0 {
+		return "", errors.New("EOF")
+	}
+
+	answer := p.answers[0]
+	p.answers = p.answers[1:]
+	return answer, nil
+}
+
+func (p *fakePrompter) interactive() bool {
+	return p.tty
+}
+
+func TestMFACode_Expires(t *testing.T) {
+	prompter := &fakePrompter{answers: []string{"654321"}}
+	m := newMFACode("arn:aws:iam::123456789012:mfa/user", "123456", prompter)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	m.obtainedAt = now
+
+	header, err := m.header()
+	require.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:mfa/user 123456", header)
+	assert.Equal(t, 0, len(prompter.prompts))
+
+	now = now.Add(mfaCodeLifetime)
+	header, err = m.header()
+	require.Nil(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:mfa/user 654321", header)
+	assert.Equal(t, []string{"MFA code for arn:aws:iam::123456789012:mfa/user: "}, prompter.prompts)
+
+	_, err = m.header()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(prompter.prompts))
+}
+
+func TestDelete_MFADeleteRequiresSerial(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].MFA = "serial 123456"
+	s := getBasicTestService(fakeBuckets)
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "--mfa-serial is required")
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestDelete_MFADelete(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].MFA = "serial 123456"
+	s := getBasicTestService(fakeBuckets)
+	prompter := &fakePrompter{answers: []string{"123456"}}
+	s.mfa = newMFACode("serial", "", prompter)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+	assert.Equal(t, 1, len(prompter.prompts))
+}
+
+func TestDelete_MFACodeRejected(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].MFA = "serial 123456"
+	s := getBasicTestService(fakeBuckets)
+	prompter := &fakePrompter{answers: []string{"123456"}}
+	s.mfa = newMFACode("serial", "000000", prompter)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(prompter.prompts))
+}
+
+func TestDelete_MFACodeRejectedTwice(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b1"].MFA = "serial 123456"
+	s := getBasicTestService(fakeBuckets)
+	s.mfa = newMFACode("serial", "000000", &fakePrompter{answers: []string{"111111"}})
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "AccessDenied")
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
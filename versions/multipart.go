@@ -0,0 +1,184 @@
+package versions
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dustin/go-humanize"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+// multipartUpload is an incomplete multipart upload, its parts are billed until it is aborted
+type multipartUpload struct {
+	Key          string
+	UploadID     string
+	Initiated    time.Time
+	StorageClass string
+	Parts        int
+	Size         int64
+}
+
+// findStaleMultipartUploads lists the multipart uploads of the bucket initiated more than --abort-multipart-days
+// ago, they are listed before deleting the versions so that they count against the limits and the confirmation
+func (v *s3Versions) findStaleMultipartUploads(ctx context.Context, bucket string) ([]*multipartUpload, error) {
+	days := v.config.AbortMultipartDays
+	if days <= 0 {
+		return nil, nil
+	}
+
+	uploads, err := v.listStaleMultipartUploads(ctx, bucket, v.now().Add(-time.Duration(days)*24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if len(uploads) == 0 {
+		v.logger.Printf("No incomplete multipart uploads older than %d days for %s", days, bucket)
+	}
+
+	return uploads, nil
+}
+
+// abortMultipartUploads aborts the given multipart uploads of the bucket. Without --confirm, they are only printed.
+func (v *s3Versions) abortMultipartUploads(ctx context.Context, bucket string, uploads []*multipartUpload) (err error) {
+	if len(uploads) == 0 {
+		return nil
+	}
+
+	ctx, span := v.tracer.Start(ctx, "AbortMultipartUploads", tracing.String("bucket", bucket))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
+	// The parts aren't charged a minimum storage duration, only their storage is estimated
+	costs := newCostEstimate()
+	var totalSize int64
+	v.logger.Printf("Incomplete multipart uploads to abort for %s (count = %d):", bucket, len(uploads))
+	for _, upload := range uploads {
+		v.logger.Printf("\t %s %s (%d parts, %s, initiated %s)", upload.Key, upload.UploadID, upload.Parts,
+			humanize.Bytes(uint64(upload.Size)), humanize.Time(upload.Initiated))
+		totalSize += upload.Size
+		costs.addStorage(v.prices, v.bucketRegion(ctx, bucket), upload.StorageClass, upload.Size)
+	}
+	v.logger.Printf("Total space recovered by aborting the multipart uploads of %s: %s", bucket, humanize.Bytes(uint64(totalSize)))
+	v.printCostEstimate(bucket+" multipart uploads", costs)
+	v.costs.merge(costs)
+
+	if !v.config.Confirm {
+		return nil
+	}
+
+	v.logger.Printf("Aborting %d multipart uploads for %s ...", len(uploads), bucket)
+	aborted, errors := 0, 0
+	var abortedSize int64
+	for _, upload := range uploads {
+		_, err := v.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(upload.Key),
+			UploadId: aws.String(upload.UploadID),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// The upload was completed or aborted since it was listed
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+				continue
+			}
+			v.logger.Printf("\tError aborting %s %s: %v", upload.Key, upload.UploadID, err)
+			errors++
+			continue
+		}
+
+		aborted++
+		abortedSize += upload.Size
+	}
+	v.logger.Printf("\tAborted %d multipart uploads", aborted)
+
+	region := v.bucketRegion(ctx, bucket)
+	v.metrics.uploadsAborted.Add(float64(aborted), bucket, region)
+	v.metrics.bytesReclaimed.Add(float64(abortedSize), bucket, region)
+	v.summary.addMultipart(aborted, abortedSize, errors)
+
+	return nil
+}
+
+// listStaleMultipartUploads lists the multipart uploads initiated before the given time, with the size of their parts
+func (v *s3Versions) listStaleMultipartUploads(ctx context.Context, bucket string, before time.Time) ([]*multipartUpload, error) {
+	v.logger.Printf("Get incomplete multipart uploads for %s/%s", bucket, v.config.BucketPrefix)
+	uploads := []*multipartUpload{}
+
+	var keyMarker, uploadIDMarker *string
+	for {
+		response, err := v.s3.ListMultipartUploadsWithContext(ctx, &s3.ListMultipartUploadsInput{
+			Bucket:         aws.String(bucket),
+			Prefix:         aws.String(v.config.BucketPrefix),
+			KeyMarker:      keyMarker,
+			UploadIdMarker: uploadIDMarker,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, upload := range response.Uploads {
+			if !aws.TimeValue(upload.Initiated).Before(before) {
+				continue
+			}
+			if reason := v.protection.keyReason(aws.StringValue(upload.Key)); len(reason) > 0 {
+				v.logger.Printf("\t Keeping the multipart upload %s of %s, %s", aws.StringValue(upload.UploadId), aws.StringValue(upload.Key), reason)
+				continue
+			}
+
+			stale := &multipartUpload{
+				Key:          aws.StringValue(upload.Key),
+				UploadID:     aws.StringValue(upload.UploadId),
+				Initiated:    aws.TimeValue(upload.Initiated),
+				StorageClass: aws.StringValue(upload.StorageClass),
+			}
+			if err = v.countMultipartUploadParts(ctx, bucket, stale); err != nil {
+				return nil, err
+			}
+			uploads = append(uploads, stale)
+		}
+
+		if !aws.BoolValue(response.IsTruncated) {
+			break
+		}
+		keyMarker = response.NextKeyMarker
+		uploadIDMarker = response.NextUploadIdMarker
+	}
+
+	return uploads, nil
+}
+
+func (v *s3Versions) countMultipartUploadParts(ctx context.Context, bucket string, upload *multipartUpload) error {
+	var partNumberMarker *int64
+	for {
+		response, err := v.s3.ListPartsWithContext(ctx, &s3.ListPartsInput{
+			Bucket:           aws.String(bucket),
+			Key:              aws.String(upload.Key),
+			UploadId:         aws.String(upload.UploadID),
+			PartNumberMarker: partNumberMarker,
+		})
+		if err != nil {
+			// The upload was completed or aborted since it was listed, it is aborted as a no-op
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchUpload {
+				return nil
+			}
+			return err
+		}
+
+		for _, part := range response.Parts {
+			upload.Parts++
+			upload.Size += aws.Int64Value(part.Size)
+		}
+
+		if !aws.BoolValue(response.IsTruncated) {
+			return nil
+		}
+		partNumberMarker = response.NextPartNumberMarker
+	}
+}
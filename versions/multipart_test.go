@@ -0,0 +1,145 @@
+package versions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func setupMultipartUploads() map[string]*fakeBucket {
+	fakeBuckets := setupBucketsAndObjects()
+	daysAgo := func(n int) time.Time {
+		return time.Now().Add(-time.Duration(n) * 24 * time.Hour)
+	}
+
+	fakeBuckets["b1"].Uploads = []*fakeUpload{
+		{Key: "backup.tar", UploadID: "u1", Initiated: daysAgo(30), StorageClass: "STANDARD", PartSizes: []int64{100, 100, 100, 100, 50}},
+		{Key: "backup.tar", UploadID: "u2", Initiated: daysAgo(1), StorageClass: "STANDARD", PartSizes: []int64{100}},
+		{Key: "logs/app.log", UploadID: "u3", Initiated: daysAgo(10), StorageClass: "STANDARD_IA", PartSizes: []int64{20}},
+		{Key: "video.mp4", UploadID: "u4", Initiated: daysAgo(8)},
+	}
+
+	return fakeBuckets
+}
+
+func TestListStaleMultipartUploads(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+
+	uploads, err := s.listStaleMultipartUploads(context.Background(), "b1", time.Now().Add(-7*24*time.Hour))
+	require.Nil(t, err)
+
+	require.Equal(t, 3, len(uploads))
+	assert.Equal(t, &multipartUpload{Key: "backup.tar", UploadID: "u1", Initiated: fakeBuckets["b1"].Uploads[0].Initiated,
+		StorageClass: "STANDARD", Parts: 5, Size: 450}, uploads[0])
+	assert.Equal(t, "u3", uploads[1].UploadID)
+	assert.Equal(t, int64(20), uploads[1].Size)
+	assert.Equal(t, "u4", uploads[2].UploadID)
+	assert.Equal(t, 0, uploads[2].Parts)
+}
+
+func TestFindAndDelete_AbortMultipartUploads(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+	s.config.AbortMultipartDays = 7
+	s.config.Protect = []string{"logs/**"}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	require.Equal(t, 2, len(fakeBuckets["b1"].Uploads))
+	assert.Equal(t, "u2", fakeBuckets["b1"].Uploads[0].UploadID)
+	assert.Equal(t, "u3", fakeBuckets["b1"].Uploads[1].UploadID)
+	assert.Equal(t, 2, s.summary.uploadsAborted)
+	assert.Equal(t, int64(450), s.summary.uploadBytes)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestSkipDelete_MultipartUploads(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+	s.config.AbortMultipartDays = 7
+	s.config.Confirm = false
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Uploads))
+	assert.Equal(t, 0, s.summary.uploadsAborted)
+	assert.Equal(t, int64(470), s.costs.bytesByClass["STANDARD"]+s.costs.bytesByClass["STANDARD_IA"])
+	// u3 is in STANDARD_IA for 10 days, but the parts aren't charged the minimum storage duration
+	assert.Equal(t, 0, s.costs.earlyDeletions)
+}
+
+func TestDelete_MaxDeleteVersionsCountsUploads(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+	s.config.AbortMultipartDays = 7
+	s.config.MaxDeleteVersions = 6
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "5 versions to delete and 3 multipart uploads to abort exceed --max-delete-versions 6")
+
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Uploads))
+}
+
+func TestDelete_MaxDeleteBytesCountsUploads(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+	s.config.AbortMultipartDays = 7
+	s.config.MaxDeleteBytes = "400B"
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "470 B to delete exceed --max-delete-bytes 400 B")
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Uploads))
+}
+
+func TestDelete_ConfirmationCoversUploads(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+	s.config.AbortMultipartDays = 7
+	prompter := &fakePrompter{answers: []string{"n"}, tty: true}
+	s.prompter = prompter
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Equal(t, []string{"Delete 5 versions and abort 3 multipart uploads (470 B, 71.4% of the noncurrent versions) from b1? [y/N] "}, prompter.prompts)
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Uploads))
+}
+
+func TestFindAndDelete_AbortMultipartUploadErrors(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+	s.config.AbortMultipartDays = 7
+	s.s3.(*s3apiMock).injectedErrors["AbortMultipartUpload"] = []error{
+		awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil),
+		awserr.New("AccessDenied", "Access Denied", nil),
+	}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	// The first upload was already gone, the second one failed
+	assert.Equal(t, 1, s.summary.uploadsAborted)
+	assert.Equal(t, 1, s.summary.errors)
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Uploads))
+}
+
+func TestFindAndDelete_MultipartUploadsDisabled(t *testing.T) {
+	fakeBuckets := setupMultipartUploads()
+	s := getBasicTestService(fakeBuckets)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Uploads))
+}
@@ -0,0 +1,161 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// lockStatus is the Object Lock protection of a file version
+type lockStatus struct {
+	retentionMode string
+	retainUntil   time.Time
+	legalHold     bool
+}
+
+// skipReason returns why the version can't be deleted, empty when it can be
+func (s *lockStatus) skipReason(now time.Time, bypassGovernance bool) string {
+	if s.legalHold {
+		return "legal hold"
+	}
+
+	if !s.retainUntil.After(now) {
+		return ""
+	}
+
+	switch s.retentionMode {
+	case s3.ObjectLockRetentionModeCompliance:
+		return fmt.Sprintf("compliance retention until %s", s.retainUntil.Format(time.RFC3339))
+	case s3.ObjectLockRetentionModeGovernance:
+		if !bypassGovernance {
+			return fmt.Sprintf("governance retention until %s", s.retainUntil.Format(time.RFC3339))
+		}
+	}
+
+	return ""
+}
+
+// lockCache caches the Object Lock status of the file versions checked during a run
+type lockCache struct {
+	mu       sync.Mutex
+	statuses map[string]*lockStatus
+}
+
+func newLockCache() *lockCache {
+	return &lockCache{
+		statuses: map[string]*lockStatus{},
+	}
+}
+
+func (c *lockCache) get(key string) (*lockStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status, ok := c.statuses[key]
+	return status, ok
+}
+
+func (c *lockCache) put(key string, status *lockStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.statuses[key] = status
+}
+
+// isObjectLockNotFound reports whether the error means there is no lock configuration, retention or legal hold
+func isObjectLockNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && (awsErr.Code() == "ObjectLockConfigurationNotFoundError" || awsErr.Code() == "NoSuchObjectLockConfiguration")
+}
+
+func (v *s3Versions) isObjectLockEnabled(ctx context.Context, bucket string) (bool, error) {
+	input := &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+	}
+
+	response, err := v.s3.GetObjectLockConfigurationWithContext(ctx, input)
+	if err != nil {
+		if isObjectLockNotFound(err) {
+			return false, nil
+		}
+
+		// Without permission to read the configuration, locked versions fail to delete and are counted as errors
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "AccessDenied" || awsErr.Code() == "NotImplemented") {
+			v.logger.Printf("Warning: can't check the Object Lock configuration of %s: %v", bucket, err)
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	lockConfig := response.ObjectLockConfiguration
+	isEnabled := lockConfig != nil && aws.StringValue(lockConfig.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled
+
+	return isEnabled, nil
+}
+
+// checkObjectLocks sets the skip reason of the versions protected by a retention or a legal hold.
+// The versions are checked concurrently, delete markers can't be locked and are not checked.
+func (v *s3Versions) checkObjectLocks(ctx context.Context, bucket string, versions []*fileVersion) error {
+	now := v.now()
+
+	objectVersions := []*fileVersion{}
+	for _, version := range versions {
+		if !version.IsDeleteMarker {
+			objectVersions = append(objectVersions, version)
+		}
+	}
+
+	return forEachVersion(objectVersions, v.config.CheckConcurrency, func(version *fileVersion) error {
+		status, err := v.getLockStatus(ctx, bucket, version)
+		if err != nil {
+			return err
+		}
+
+		version.SkipReason = status.skipReason(now, v.config.BypassGovernanceRetention)
+		return nil
+	})
+}
+
+func (v *s3Versions) getLockStatus(ctx context.Context, bucket string, version *fileVersion) (*lockStatus, error) {
+	cacheKey := bucket + "\x00" + version.Key + "\x00" + version.VersionID
+	if status, ok := v.locks.get(cacheKey); ok {
+		return status, nil
+	}
+
+	status := &lockStatus{}
+
+	retention, err := v.s3.GetObjectRetentionWithContext(ctx, &s3.GetObjectRetentionInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(version.Key),
+		VersionId: aws.String(version.VersionID),
+	})
+	if err != nil && !isObjectLockNotFound(err) {
+		return nil, err
+	}
+	if err == nil && retention.Retention != nil {
+		status.retentionMode = aws.StringValue(retention.Retention.Mode)
+		status.retainUntil = aws.TimeValue(retention.Retention.RetainUntilDate)
+	}
+
+	legalHold, err := v.s3.GetObjectLegalHoldWithContext(ctx, &s3.GetObjectLegalHoldInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(version.Key),
+		VersionId: aws.String(version.VersionID),
+	})
+	if err != nil && !isObjectLockNotFound(err) {
+		return nil, err
+	}
+	if err == nil && legalHold.LegalHold != nil {
+		status.legalHold = aws.StringValue(legalHold.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn
+	}
+
+	v.locks.put(cacheKey, status)
+
+	return status, nil
+}
@@ -0,0 +1,148 @@
+package versions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func setupLockedBuckets() map[string]*fakeBucket {
+	fakeBuckets := setupBucketsAndObjects()
+
+	b1 := fakeBuckets["b1"]
+	b1.ObjectLockEnabled = true
+	retainUntil := time.Now().Add(24 * time.Hour)
+
+	for _, version := range b1.Objects["key1"] {
+		switch version.VersionID {
+		case "b1-key1-v1":
+			version.RetentionMode = s3.ObjectLockRetentionModeCompliance
+			version.RetainUntil = retainUntil
+		case "b1-key1-v2":
+			version.LegalHold = true
+		}
+	}
+	for _, version := range b1.Objects["key2"] {
+		if version.VersionID == "b1-key2-v1" {
+			version.RetentionMode = s3.ObjectLockRetentionModeGovernance
+			version.RetainUntil = retainUntil
+		}
+	}
+
+	return fakeBuckets
+}
+
+func versionIDs(versions []*fakeVersion) []string {
+	ids := []string{}
+	for _, version := range versions {
+		ids = append(ids, version.VersionID)
+	}
+
+	return ids
+}
+
+func TestLockStatusSkipReason(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	future := now.Add(time.Hour)
+	past := now.Add(-time.Hour)
+
+	tests := []struct {
+		status           lockStatus
+		bypassGovernance bool
+		expected         string
+	}{
+		{lockStatus{}, false, ""},
+		{lockStatus{legalHold: true}, true, "legal hold"},
+		{lockStatus{retentionMode: s3.ObjectLockRetentionModeCompliance, retainUntil: future}, true, "compliance retention until 2020-01-01T01:00:00Z"},
+		{lockStatus{retentionMode: s3.ObjectLockRetentionModeGovernance, retainUntil: future}, false, "governance retention until 2020-01-01T01:00:00Z"},
+		{lockStatus{retentionMode: s3.ObjectLockRetentionModeGovernance, retainUntil: future}, true, ""},
+		{lockStatus{retentionMode: s3.ObjectLockRetentionModeCompliance, retainUntil: past}, false, ""},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.status.skipReason(now, test.bypassGovernance))
+	}
+}
+
+func TestFindAndDelete_ObjectLock(t *testing.T) {
+	fakeBuckets := setupLockedBuckets()
+	s := getBasicTestService(fakeBuckets)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	// Only the delete markers could be deleted
+	assert.Equal(t, []string{"b1-key1-v1", "b1-key1-v2", "b1-key1-v3"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, []string{"b1-key2-v1", "b1-key2-v2"}, versionIDs(fakeBuckets["b1"].Objects["key2"]))
+	assert.Equal(t, 3, s.summary.lockSkipped)
+	assert.Equal(t, 2, s.summary.versionsDeleted)
+	assert.Equal(t, 0, s.summary.errors)
+}
+
+func TestFindAndDelete_BypassGovernanceRetention(t *testing.T) {
+	fakeBuckets := setupLockedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	s.config.BypassGovernanceRetention = true
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{"b1-key1-v1", "b1-key1-v2", "b1-key1-v3"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, []string{"b1-key2-v2"}, versionIDs(fakeBuckets["b1"].Objects["key2"]))
+	assert.Equal(t, 2, s.summary.lockSkipped)
+	assert.Equal(t, 0, s.summary.errors)
+}
+
+func TestCheckObjectLocks_Cached(t *testing.T) {
+	fakeBuckets := setupLockedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	mock := s.s3.(*s3apiMock)
+
+	fileVersions, err := s.getFileVersions(context.Background(), "b1")
+	require.Nil(t, err)
+
+	versions := append(fileVersions["key1"], fileVersions["key2"]...)
+	require.Nil(t, s.checkObjectLocks(context.Background(), "b1", versions))
+	require.Nil(t, s.checkObjectLocks(context.Background(), "b1", versions))
+
+	// Delete markers are not checked, the other versions are checked once
+	assert.Equal(t, 5, mock.lockChecks)
+
+	reasons := map[string]string{}
+	for _, version := range versions {
+		reasons[version.VersionID] = version.SkipReason
+	}
+	assert.Equal(t, "legal hold", reasons["b1-key1-v2"])
+	assert.Contains(t, reasons["b1-key1-v1"], "compliance retention until")
+	assert.Contains(t, reasons["b1-key2-v1"], "governance retention until")
+	assert.Equal(t, "", reasons["b1-key1-v3"])
+}
+
+func TestIsObjectLockEnabled(t *testing.T) {
+	fakeBuckets := setupLockedBuckets()
+	s := getBasicTestService(fakeBuckets)
+
+	enabled, err := s.isObjectLockEnabled(context.Background(), "b1")
+	require.Nil(t, err)
+	assert.True(t, enabled)
+
+	enabled, err = s.isObjectLockEnabled(context.Background(), "b2")
+	require.Nil(t, err)
+	assert.False(t, enabled)
+}
+
+func TestPlan_LockedVersionsClock(t *testing.T) {
+	fakeBuckets := setupLockedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	// The compliance retention of b1-key1-v1 is over two days from now, unlike the legal hold of b1-key1-v2
+	s.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []Decision{DecisionKeep, DecisionDelete, DecisionSkip, DecisionDelete}, decisions(plan.Buckets[0].Keys[0]))
+}
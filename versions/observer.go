@@ -0,0 +1,99 @@
+package versions
+
+// Observer is notified of the progress of Delete, Plan and Execute. It is called from the goroutine running
+// the command, so slow callbacks slow the run down. The progress logs aren't printed by an observer, they are
+// still printed by the commands with the Logger.
+type Observer interface {
+	// OnBucketStart is called before listing or deleting the versions of a bucket
+	OnBucketStart(bucket string)
+	// OnPage is called for every page of versions listed
+	OnPage(bucket string, page int, versions int)
+	// OnKeyDecision is called with the decisions about the versions of a key, the newest first. The keys
+	// with too few versions to have any to delete are left out.
+	OnKeyDecision(bucket string, key string, decisions []*VersionDecision)
+	// OnBatchDeleted is called after every DeleteObjects request, with the versions deleted and those S3
+	// failed to delete
+	OnBatchDeleted(bucket string, deleted []*DeletedVersion, failed []*FailedVersion)
+	// OnError is called when an error stops the processing of a bucket
+	OnError(bucket string, err error)
+	// OnBucketDone is called once a bucket is processed successfully. Plan deletes nothing, as Delete without
+	// --confirm, its summary is always empty.
+	OnBucketDone(bucket string, summary BucketSummary)
+}
+
+// BucketSummary is what was deleted from a bucket
+type BucketSummary struct {
+	VersionsDeleted int
+	BytesDeleted    int64
+	Failures        int
+}
+
+// NopObserver ignores all the events, it can be embedded to implement only some of the callbacks
+type NopObserver struct{}
+
+// OnBucketStart does nothing
+func (NopObserver) OnBucketStart(bucket string) {}
+
+// OnPage does nothing
+func (NopObserver) OnPage(bucket string, page int, versions int) {}
+
+// OnKeyDecision does nothing
+func (NopObserver) OnKeyDecision(bucket string, key string, decisions []*VersionDecision) {}
+
+// OnBatchDeleted does nothing
+func (NopObserver) OnBatchDeleted(bucket string, deleted []*DeletedVersion, failed []*FailedVersion) {
+}
+
+// OnError does nothing
+func (NopObserver) OnError(bucket string, err error) {}
+
+// OnBucketDone does nothing
+func (NopObserver) OnBucketDone(bucket string, summary BucketSummary) {}
+
+// observers notifies all the observers of the options, in order
+type observers []Observer
+
+func (o observers) OnBucketStart(bucket string) {
+	for _, observer := range o {
+		observer.OnBucketStart(bucket)
+	}
+}
+
+func (o observers) OnPage(bucket string, page int, versions int) {
+	for _, observer := range o {
+		observer.OnPage(bucket, page, versions)
+	}
+}
+
+func (o observers) OnKeyDecision(bucket string, key string, decisions []*VersionDecision) {
+	for _, observer := range o {
+		observer.OnKeyDecision(bucket, key, decisions)
+	}
+}
+
+func (o observers) OnBatchDeleted(bucket string, deleted []*DeletedVersion, failed []*FailedVersion) {
+	for _, observer := range o {
+		observer.OnBatchDeleted(bucket, deleted, failed)
+	}
+}
+
+func (o observers) OnError(bucket string, err error) {
+	for _, observer := range o {
+		observer.OnError(bucket, err)
+	}
+}
+
+func (o observers) OnBucketDone(bucket string, summary BucketSummary) {
+	for _, observer := range o {
+		observer.OnBucketDone(bucket, summary)
+	}
+}
+
+// bucketSummary returns what was deleted since the summary of the run was at start
+func (s *deletionSummary) bucketSummary(start deletionSummary) BucketSummary {
+	return BucketSummary{
+		VersionsDeleted: s.versionsDeleted - start.versionsDeleted,
+		BytesDeleted:    s.bytesDeleted - start.bytesDeleted,
+		Failures:        s.errors - start.errors,
+	}
+}
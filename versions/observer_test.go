@@ -0,0 +1,96 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// recordingObserver records the events as strings
+type recordingObserver struct {
+	NopObserver
+	events []string
+}
+
+func (o *recordingObserver) OnBucketStart(bucket string) {
+	o.events = append(o.events, "start "+bucket)
+}
+
+func (o *recordingObserver) OnPage(bucket string, page int, versions int) {
+	o.events = append(o.events, fmt.Sprintf("page %s %d: %d", bucket, page, versions))
+}
+
+func (o *recordingObserver) OnKeyDecision(bucket string, key string, decisions []*VersionDecision) {
+	event := fmt.Sprintf("decisions %s/%s:", bucket, key)
+	for _, decision := range decisions {
+		event += " " + string(decision.Decision)
+	}
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) OnBatchDeleted(bucket string, deleted []*DeletedVersion, failed []*FailedVersion) {
+	o.events = append(o.events, fmt.Sprintf("batch %s: %d deleted, %d failed", bucket, len(deleted), len(failed)))
+}
+
+func (o *recordingObserver) OnError(bucket string, err error) {
+	o.events = append(o.events, fmt.Sprintf("error %s: %v", bucket, err))
+}
+
+func (o *recordingObserver) OnBucketDone(bucket string, summary BucketSummary) {
+	o.events = append(o.events, fmt.Sprintf("done %s: %+v", bucket, summary))
+}
+
+func TestObserver_Delete(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	c := getBasicTestService(fakeBuckets).config
+	c.Yes = true
+	observer := &recordingObserver{}
+	s := NewWithOptions(WithConfig(c), WithS3(newS3ApiMock(fakeBuckets, 3)), WithObserver(observer))
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"start b1",
+		"page b1 1: 3",
+		"page b1 2: 3",
+		"page b1 3: 1",
+		"decisions b1/key1: keep delete delete delete",
+		"decisions b1/key2: keep delete delete",
+		"batch b1: 5 deleted, 0 failed",
+		"done b1: {VersionsDeleted:5 BytesDeleted:0 Failures:0}",
+	}, observer.events)
+}
+
+func TestObserver_Plan(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	observer := &recordingObserver{}
+	s.observer = observers{observer}
+
+	_, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	// Nothing is deleted, the summary is empty
+	assert.Equal(t, "start b1", observer.events[0])
+	assert.Equal(t, "done b1: {VersionsDeleted:0 BytesDeleted:0 Failures:0}", observer.events[len(observer.events)-1])
+	assert.NotContains(t, observer.events, "batch b1: 5 deleted, 0 failed")
+}
+
+func TestObserver_Error(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	observer := &recordingObserver{}
+	s.observer = observers{observer}
+	s.s3.(*s3apiMock).injectedErrors["DeleteObjects"] = []error{awserr.New("AccessDenied", "Access Denied", nil)}
+
+	err := s.Delete()
+	require.NotNil(t, err)
+
+	assert.Equal(t, "error b1: AccessDenied: Access Denied", observer.events[len(observer.events)-1])
+}
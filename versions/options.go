@@ -0,0 +1,214 @@
+package versions
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/croman/delete-s3-versions/config"
+	"github.com/croman/delete-s3-versions/metrics"
+	"github.com/croman/delete-s3-versions/s3api"
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+// Logger prints the progress of the runs, *log.Logger implements it
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// stdLogger prints with the standard logger, so that its output and flags can still be changed
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+func (stdLogger) Println(v ...interface{}) {
+	log.Println(v...)
+}
+
+// Option customizes the S3Versions instances created with NewWithOptions
+type Option func(*options)
+
+type options struct {
+	config      *config.Config
+	s3          s3api.S3API
+	logger      Logger
+	out         io.Writer
+	now         func() time.Time
+	retryPolicy *s3api.RetryPolicy
+	observers   observers
+	retention   RetentionPolicy
+	tracer      *tracing.Tracer
+	// prompter is shared by the accounts of --account-role-arn, a reader per account would lose the answers
+	// piped on stdin that another one buffered
+	prompter prompter
+}
+
+// WithConfig sets the configuration, config.Default() is used otherwise
+func WithConfig(c *config.Config) Option {
+	return func(o *options) {
+		o.config = c
+	}
+}
+
+// WithS3 uses this S3 client instead of creating one from the configuration. Its calls are still
+// instrumented, rate limited and retried.
+func WithS3(api s3api.S3API) Option {
+	return func(o *options) {
+		o.s3 = api
+	}
+}
+
+// WithLogger prints the progress with this logger instead of the standard logger
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithReporter writes the reports (statistics, lifecycle configurations, versioning) to w instead of stdout
+func WithReporter(w io.Writer) Option {
+	return func(o *options) {
+		o.out = w
+	}
+}
+
+// WithClock sets the current time used to compute the ages of the versions and of the multipart uploads
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.now = now
+	}
+}
+
+// WithRetryPolicy retries the S3 calls with this policy instead of the one of the configuration
+func WithRetryPolicy(policy s3api.RetryPolicy) Option {
+	return func(o *options) {
+		o.retryPolicy = &policy
+	}
+}
+
+// WithObserver notifies the observer of the progress of the runs, it can be repeated
+func WithObserver(observer Observer) Option {
+	return func(o *options) {
+		o.observers = append(o.observers, observer)
+	}
+}
+
+// WithRetentionPolicy decides which versions to delete with this policy instead of --count and --keep-days
+func WithRetentionPolicy(policy RetentionPolicy) Option {
+	return func(o *options) {
+		o.retention = policy
+	}
+}
+
+// WithTracer traces the runs with this tracer instead of one exporting to --otlp-endpoint. The commands
+// flush it, shutting it down is left to the caller.
+func WithTracer(tracer *tracing.Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// NewTracer creates the tracer exporting to --otlp-endpoint, nil without it
+func NewTracer(c *config.Config) *tracing.Tracer {
+	if len(c.OTLPEndpoint) == 0 {
+		return nil
+	}
+
+	return tracing.NewTracer(tracing.NewOTLPExporter(c.OTLPEndpoint, serviceName))
+}
+
+var errS3WithAccounts = errors.New("WithS3 can't be used with --account-role-arn, the client can't assume the role of each account")
+
+// NewWithOptions creates a new S3Versions instance. Without an S3 client, it is created from the
+// configuration, running against every account of --account-role-arn in turn. With an S3 client,
+// --account-role-arn can't be used and every command fails.
+func NewWithOptions(opts ...Option) S3Versions {
+	o := &options{
+		logger: stdLogger{},
+		out:    os.Stdout,
+		now:    time.Now,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.config == nil {
+		o.config = config.Default()
+	}
+	// The accounts share the tracer, its exporter keeps running until the process exits
+	if o.tracer == nil {
+		o.tracer = NewTracer(o.config)
+	}
+
+	if len(o.config.AccountRoleARNs) > 0 {
+		if o.s3 != nil {
+			return &failedVersions{err: errS3WithAccounts, metrics: newRunMetrics()}
+		}
+		return newAccountsVersions(o)
+	}
+
+	return newS3Versions(o, newRunMetrics())
+}
+
+// failedVersions fails every command with the error of invalid options
+type failedVersions struct {
+	err     error
+	metrics *runMetrics
+}
+
+func (f *failedVersions) Delete() error {
+	return f.err
+}
+
+func (f *failedVersions) DeleteWithContext(ctx context.Context) error {
+	return f.err
+}
+
+func (f *failedVersions) Stats() error {
+	return f.err
+}
+
+func (f *failedVersions) StatsWithContext(ctx context.Context) error {
+	return f.err
+}
+
+func (f *failedVersions) Lifecycle() error {
+	return f.err
+}
+
+func (f *failedVersions) LifecycleWithContext(ctx context.Context) error {
+	return f.err
+}
+
+func (f *failedVersions) Audit() error {
+	return f.err
+}
+
+func (f *failedVersions) AuditWithContext(ctx context.Context) error {
+	return f.err
+}
+
+func (f *failedVersions) Versioning() error {
+	return f.err
+}
+
+func (f *failedVersions) VersioningWithContext(ctx context.Context) error {
+	return f.err
+}
+
+func (f *failedVersions) Plan(ctx context.Context) (*Plan, error) {
+	return nil, f.err
+}
+
+func (f *failedVersions) Execute(ctx context.Context, plan *Plan) (*Result, error) {
+	return nil, f.err
+}
+
+func (f *failedVersions) Metrics() *metrics.Registry {
+	return f.metrics.registry
+}
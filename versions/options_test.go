@@ -0,0 +1,75 @@
+package versions
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/croman/delete-s3-versions/config"
+	"github.com/croman/delete-s3-versions/s3api"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	mock := newS3ApiMock(fakeBuckets, 3).(*s3apiMock)
+	mock.injectedErrors["ListObjectVersions"] = []error{awserr.New("InternalError", "We encountered an internal error", nil)}
+
+	c := config.Default()
+	c.BucketName = "b1"
+	out := &bytes.Buffer{}
+	logs := &bytes.Buffer{}
+	now := time.Date(2019, 11, 20, 12, 0, 0, 0, time.UTC)
+
+	retries := 0
+	policy := s3api.DefaultRetryPolicy()
+	policy.BaseDelay = time.Millisecond
+	policy.OnRetry = func(operation string, err error, attempt int, delay time.Duration) {
+		retries++
+	}
+
+	s := NewWithOptions(
+		WithConfig(c),
+		WithS3(mock),
+		WithReporter(out),
+		WithLogger(log.New(logs, "", 0)),
+		WithClock(func() time.Time { return now }),
+		WithRetryPolicy(policy),
+	)
+	assert.Equal(t, now, s.(*s3Versions).now())
+
+	err := s.Stats()
+	require.Nil(t, err)
+
+	assert.Contains(t, out.String(), "Statistics for b1")
+	assert.Contains(t, logs.String(), "ListObjectVersions failed (attempt 1), retrying in")
+	assert.Equal(t, 1, retries)
+	// The calls made with the injected client are still recorded
+	metricsOut := &bytes.Buffer{}
+	require.Nil(t, s.Metrics().Write(metricsOut))
+	assert.Contains(t, metricsOut.String(), `delete_s3_versions_list_pages_total{bucket="b1",region="eu-west-1"}`)
+}
+
+func TestNewWithOptions_S3WithAccounts(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	c := config.Default()
+	c.BucketName = "b1"
+	c.VersionsCount = 1
+	c.Confirm = true
+	c.AccountRoleARNs = []string{"arn:aws:iam::111111111111:role/cleanup"}
+
+	s := NewWithOptions(WithConfig(c), WithS3(newS3ApiMock(fakeBuckets, 3)))
+	assert.Equal(t, errS3WithAccounts, s.Delete())
+	_, err := s.Plan(context.Background())
+	assert.Equal(t, errS3WithAccounts, err)
+	assert.NotNil(t, s.Metrics())
+
+	// The accounts aren't silently ignored
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
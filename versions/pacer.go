@@ -0,0 +1,64 @@
+package versions
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const minPacerDelay = 100 * time.Millisecond
+const maxPacerDelay = 30 * time.Second
+
+// pacer spaces out the deletion batches after S3 throttled the requests, and speeds up again
+// as the batches succeed
+type pacer struct {
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+func (p *pacer) throttled() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.delay *= 2
+	if p.delay < minPacerDelay {
+		p.delay = minPacerDelay
+	} else if p.delay > maxPacerDelay {
+		p.delay = maxPacerDelay
+	}
+}
+
+func (p *pacer) succeeded() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.delay /= 2
+	if p.delay < minPacerDelay {
+		p.delay = 0
+	}
+}
+
+func (p *pacer) currentDelay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.delay
+}
+
+// wait waits for the current delay, returning early if the context is cancelled
+func (p *pacer) wait(ctx context.Context) error {
+	delay := p.currentDelay()
+	if delay == 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,75 @@
+package versions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/croman/delete-s3-versions/config"
+	"github.com/croman/delete-s3-versions/s3api"
+)
+
+func TestPacer(t *testing.T) {
+	p := &pacer{}
+	assert.Nil(t, p.wait(context.Background()))
+
+	p.throttled()
+	assert.Equal(t, minPacerDelay, p.currentDelay())
+	p.throttled()
+	assert.Equal(t, 2*minPacerDelay, p.currentDelay())
+
+	p.succeeded()
+	assert.Equal(t, minPacerDelay, p.currentDelay())
+	p.succeeded()
+	assert.Equal(t, time.Duration(0), p.currentDelay())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.throttled()
+	assert.Equal(t, context.Canceled, p.wait(ctx))
+}
+
+func TestDelete_RetryThrottling(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	mock := s.s3.(*s3apiMock)
+	mock.injectedErrors["ListObjectVersions"] = []error{awserr.New("InternalError", "We encountered an internal error", nil)}
+	mock.injectedErrors["DeleteObjects"] = []error{
+		awserr.New("SlowDown", "Please reduce your request rate", nil),
+		awserr.New("SlowDown", "Please reduce your request rate", nil),
+	}
+
+	policy := getRetryPolicy(&config.Config{MaxAttempts: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Millisecond})
+	s.s3 = s3api.NewRetrying(mock, pacedRetryPolicy(policy, s.pacer, stdLogger{}))
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+	// Two throttling responses doubled the delay once, the successful batch halved it
+	assert.Equal(t, minPacerDelay, s.pacer.currentDelay())
+}
+
+func TestDelete_RetryExhausted(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	mock := s.s3.(*s3apiMock)
+	mock.injectedErrors["DeleteObjects"] = []error{
+		awserr.New("SlowDown", "Please reduce your request rate", nil),
+		awserr.New("SlowDown", "Please reduce your request rate", nil),
+	}
+
+	policy := getRetryPolicy(&config.Config{MaxAttempts: 2, RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Millisecond})
+	s.s3 = s3api.NewRetrying(mock, pacedRetryPolicy(policy, s.pacer, stdLogger{}))
+
+	err := s.Delete()
+	require.NotNil(t, err)
+	assert.Equal(t, "SlowDown", err.(awserr.Error).Code())
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
@@ -0,0 +1,526 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+// Decision is what a plan does with a file version
+type Decision string
+
+const (
+	// DecisionKeep keeps the version, it is recent enough or pinned by a tag
+	DecisionKeep Decision = "keep"
+	// DecisionDelete deletes the version when the plan is executed
+	DecisionDelete Decision = "delete"
+	// DecisionSkip keeps a version old enough to be deleted, because it is protected or locked
+	DecisionSkip Decision = "skip"
+)
+
+// Plan is what a deletion would do, computed without deleting anything. It can be inspected and changed,
+// e.g. by turning decisions into DecisionKeep, before being executed. The stale multipart uploads are not
+// part of it, Execute doesn't abort them.
+type Plan struct {
+	Prefix  string        `json:"prefix"`
+	Buckets []*BucketPlan `json:"buckets"`
+}
+
+// BucketPlan is the plan of a bucket. The keys with no more versions than --count are left out, unless the
+// retention policy is set with WithRetentionPolicy.
+type BucketPlan struct {
+	Bucket    string `json:"bucket"`
+	Suspended bool   `json:"suspended"`
+	MFADelete bool   `json:"mfaDelete"`
+	// Noncurrent is the number of noncurrent versions in the bucket, --max-delete-percent is relative to it
+	Noncurrent int        `json:"noncurrent"`
+	Keys       []*KeyPlan `json:"keys"`
+}
+
+// KeyPlan is the plan of a key, its versions the newest first
+type KeyPlan struct {
+	Key      string             `json:"key"`
+	Versions []*VersionDecision `json:"versions"`
+}
+
+// VersionDecision is the decision about a file version or a delete marker
+type VersionDecision struct {
+	VersionID      string    `json:"versionId"`
+	IsLatest       bool      `json:"isLatest"`
+	IsDeleteMarker bool      `json:"isDeleteMarker"`
+	LastModified   time.Time `json:"lastModified"`
+	Size           int64     `json:"size"`
+	StorageClass   string    `json:"storageClass,omitempty"`
+	Decision       Decision  `json:"decision"`
+	Reason         string    `json:"reason"`
+}
+
+// PlanTotals counts the decisions of a plan
+type PlanTotals struct {
+	Keys        int   `json:"keys"`
+	Delete      int   `json:"delete"`
+	DeleteBytes int64 `json:"deleteBytes"`
+	Keep        int   `json:"keep"`
+	Skip        int   `json:"skip"`
+}
+
+func (t *PlanTotals) add(other PlanTotals) {
+	t.Keys += other.Keys
+	t.Delete += other.Delete
+	t.DeleteBytes += other.DeleteBytes
+	t.Keep += other.Keep
+	t.Skip += other.Skip
+}
+
+// Totals counts the decisions of all the buckets
+func (p *Plan) Totals() PlanTotals {
+	totals := PlanTotals{}
+	for _, bucket := range p.Buckets {
+		totals.add(bucket.Totals())
+	}
+
+	return totals
+}
+
+// Totals counts the decisions of the bucket
+func (b *BucketPlan) Totals() PlanTotals {
+	totals := PlanTotals{Keys: len(b.Keys)}
+	for _, key := range b.Keys {
+		for _, version := range key.Versions {
+			switch version.Decision {
+			case DecisionDelete:
+				totals.Delete++
+				totals.DeleteBytes += version.Size
+			case DecisionSkip:
+				totals.Skip++
+			default:
+				totals.Keep++
+			}
+		}
+	}
+
+	return totals
+}
+
+// versionsToDelete returns the versions of the bucket with DecisionDelete
+func (b *BucketPlan) versionsToDelete() []*fileVersion {
+	versions := []*fileVersion{}
+	for _, key := range b.Keys {
+		for _, version := range key.Versions {
+			if version.Decision != DecisionDelete {
+				continue
+			}
+			versions = append(versions, &fileVersion{
+				Key:            key.Key,
+				VersionID:      version.VersionID,
+				IsLatest:       version.IsLatest,
+				LastModified:   version.LastModified,
+				Size:           version.Size,
+				IsDeleteMarker: version.IsDeleteMarker,
+				StorageClass:   version.StorageClass,
+			})
+		}
+	}
+
+	return versions
+}
+
+// Result is what Execute actually deleted
+type Result struct {
+	Buckets []*BucketResult `json:"buckets"`
+}
+
+// BucketResult lists the versions of a bucket that were deleted, and those S3 failed to delete
+type BucketResult struct {
+	Bucket  string            `json:"bucket"`
+	Deleted []*DeletedVersion `json:"deleted"`
+	Failed  []*FailedVersion  `json:"failed"`
+}
+
+// DeletedVersion is a version deleted by Execute
+type DeletedVersion struct {
+	Key       string `json:"key"`
+	VersionID string `json:"versionId"`
+	Size      int64  `json:"size"`
+}
+
+// FailedVersion is a version S3 failed to delete
+type FailedVersion struct {
+	Key       string `json:"key"`
+	VersionID string `json:"versionId"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// VersionsDeleted counts the versions deleted in all the buckets
+func (r *Result) VersionsDeleted() int {
+	count := 0
+	for _, bucket := range r.Buckets {
+		count += len(bucket.Deleted)
+	}
+
+	return count
+}
+
+// BytesDeleted sums the sizes of the versions deleted in all the buckets
+func (r *Result) BytesDeleted() int64 {
+	var bytes int64
+	for _, bucket := range r.Buckets {
+		for _, deleted := range bucket.Deleted {
+			bytes += deleted.Size
+		}
+	}
+
+	return bytes
+}
+
+// Failures counts the versions S3 failed to delete in all the buckets
+func (r *Result) Failures() int {
+	count := 0
+	for _, bucket := range r.Buckets {
+		count += len(bucket.Failed)
+	}
+
+	return count
+}
+
+// newDeletedVersion returns the deleted version, with the size of the version sent to S3
+func newDeletedVersion(deleted *s3.DeletedObject, sent map[string]*fileVersion) *DeletedVersion {
+	key := aws.StringValue(deleted.Key)
+	id := versionID(deleted.VersionId)
+
+	result := &DeletedVersion{Key: key, VersionID: id}
+	if version, ok := sent[key+"\x00"+id]; ok {
+		result.Size = version.Size
+	}
+
+	return result
+}
+
+func newFailedVersion(deleteErr *s3.Error) *FailedVersion {
+	return &FailedVersion{
+		Key:       aws.StringValue(deleteErr.Key),
+		VersionID: versionID(deleteErr.VersionId),
+		Code:      aws.StringValue(deleteErr.Code),
+		Message:   aws.StringValue(deleteErr.Message),
+	}
+}
+
+// Plan computes the decisions of a deletion about the versions of the buckets, without deleting anything.
+// The limits exceeded are logged, Execute enforces them.
+func (v *s3Versions) Plan(ctx context.Context) (*Plan, error) {
+	ctx, span := v.tracer.Start(ctx, "Plan", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	if err := v.prepareDeletion(); err != nil {
+		return nil, err
+	}
+
+	buckets, err := v.getBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err = v.filterBucketsByVersioningEnabled(ctx, buckets)
+	if err != nil {
+		return nil, err
+	}
+	v.logger.Println("Found these buckets with versioning enabled", buckets)
+
+	plan := &Plan{Prefix: v.config.BucketPrefix}
+	for _, bucket := range buckets {
+		v.observer.OnBucketStart(bucket)
+		bucketPlan, err := v.planBucket(ctx, bucket)
+		if err != nil {
+			span.RecordError(err)
+			v.observer.OnError(bucket, err)
+			return nil, err
+		}
+		plan.Buckets = append(plan.Buckets, bucketPlan)
+		v.observer.OnBucketDone(bucket, BucketSummary{})
+	}
+	v.printCostEstimate("all buckets", v.costs)
+
+	return plan, nil
+}
+
+func (v *s3Versions) planBucket(ctx context.Context, bucket string) (*BucketPlan, error) {
+	objectLock, err := v.isObjectLockEnabled(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	fileVersions, err := v.getFileVersions(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketPlan := &BucketPlan{
+		Bucket:     bucket,
+		Suspended:  v.suspended[bucket],
+		MFADelete:  v.mfaDelete[bucket],
+		Noncurrent: countNoncurrentVersions(fileVersions),
+	}
+
+	ignoreFilesWithFewerVersions(fileVersions, v.minVersions)
+	versionsToDelete, err := v.computeAndPrintVersionsInfo(ctx, bucket, fileVersions, objectLock)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := &bucketTotals{}
+	totals.add(versionsToDelete, bucketPlan.Noncurrent)
+	if err = v.checkDeletionLimits(bucket, totals); err != nil {
+		v.logger.Printf("Warning: %v", err)
+	}
+
+	deleting := versionSet(versionsToDelete)
+	keys := []string{}
+	for key := range fileVersions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		bucketPlan.Keys = append(bucketPlan.Keys, &KeyPlan{
+			Key:      key,
+			Versions: v.keyDecisions(fileVersions[key], deleting),
+		})
+	}
+
+	return bucketPlan, nil
+}
+
+// keyDecisions returns the decisions about the versions of a key, once computeAndPrintVersionsInfo
+// sorted them and set their reasons
+func (v *s3Versions) keyDecisions(versions []*fileVersion, deleting map[*fileVersion]bool) []*VersionDecision {
+	decisions := []*VersionDecision{}
+	for _, version := range versions {
+		decision := &VersionDecision{
+			VersionID:      version.VersionID,
+			IsLatest:       version.IsLatest,
+			IsDeleteMarker: version.IsDeleteMarker,
+			LastModified:   version.LastModified,
+			Size:           version.Size,
+			StorageClass:   version.StorageClass,
+			Decision:       DecisionKeep,
+			Reason:         version.KeepReason,
+		}
+		switch {
+		case deleting[version]:
+			decision.Decision = DecisionDelete
+			decision.Reason = version.DeleteReason
+		case len(version.SkipReason) > 0:
+			decision.Decision = DecisionSkip
+			decision.Reason = version.SkipReason
+		}
+		decisions = append(decisions, decision)
+	}
+
+	return decisions
+}
+
+func versionSet(versions []*fileVersion) map[*fileVersion]bool {
+	set := map[*fileVersion]bool{}
+	for _, version := range versions {
+		set[version] = true
+	}
+
+	return set
+}
+
+// Execute deletes the versions of the plan with DecisionDelete, whatever --confirm. Their keys are listed
+// again and only the versions a new plan would still delete are deleted: a changed or stale plan can't
+// delete what the retention policy, the --keep-tag tags, the protected keys or the Object Lock retentions
+// keep, nor the current versions. The deletion limits and the bucket locks still apply. The result lists
+// what was deleted, also when an error stops the execution.
+func (v *s3Versions) Execute(ctx context.Context, plan *Plan) (*Result, error) {
+	ctx, span := v.tracer.Start(ctx, "Execute", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	if err := v.prepareDeletion(); err != nil {
+		return nil, err
+	}
+	v.mfaDelete = map[string]bool{}
+	v.suspended = map[string]bool{}
+
+	result := &Result{}
+	for _, bucketPlan := range plan.Buckets {
+		bucket := bucketPlan.Bucket
+		versionsToDelete := bucketPlan.versionsToDelete()
+		if len(versionsToDelete) == 0 {
+			continue
+		}
+
+		start := *v.summary
+		v.observer.OnBucketStart(bucket)
+		bucketResult := &BucketResult{Bucket: bucket}
+		result.Buckets = append(result.Buckets, bucketResult)
+
+		if err := v.executeBucket(ctx, bucketPlan, versionsToDelete, bucketResult); err != nil {
+			span.RecordError(err)
+			v.observer.OnError(bucket, err)
+			return result, err
+		}
+		v.summary.buckets++
+		if bucketPlan.Suspended {
+			v.summary.suspendedBuckets++
+		}
+		v.observer.OnBucketDone(bucket, v.summary.bucketSummary(start))
+	}
+
+	v.summary.print(v.logger)
+	v.metrics.lastRun.Set(float64(v.now().Unix()), v.region())
+
+	return result, nil
+}
+
+func (v *s3Versions) executeBucket(ctx context.Context, bucketPlan *BucketPlan, versionsToDelete []*fileVersion, result *BucketResult) error {
+	bucket := bucketPlan.Bucket
+	v.mfaDelete[bucket] = bucketPlan.MFADelete
+	v.suspended[bucket] = bucketPlan.Suspended
+	if bucketPlan.MFADelete && v.mfa == nil {
+		return fmt.Errorf("Bucket %s has MFA Delete enabled, --mfa-serial is required", bucket)
+	}
+
+	if err := v.checkPlanVersions(ctx, bucketPlan, versionsToDelete); err != nil {
+		return err
+	}
+	allowed := []*fileVersion{}
+	for _, version := range versionsToDelete {
+		if len(version.SkipReason) > 0 {
+			v.logger.Printf("\tRefusing to delete %s (%s): %s", version.Key, version.VersionID, version.SkipReason)
+			continue
+		}
+		allowed = append(allowed, version)
+	}
+	versionsToDelete = allowed
+
+	totals := &bucketTotals{}
+	totals.add(versionsToDelete, bucketPlan.Noncurrent)
+	if err := v.checkDeletionLimits(bucket, totals); err != nil {
+		return err
+	}
+
+	lockCtx, release, err := v.lockBucket(ctx, bucket)
+	if err != nil {
+		return err
+	}
+
+	err = v.deleteS3Versions(lockCtx, bucket, versionsToDelete, result)
+	if lockErr := release(); lockErr != nil {
+		return lockErr
+	}
+
+	return err
+}
+
+// checkPlanVersions checks the versions to delete again, as the plan may have been changed or be stale. The
+// keys are listed again and the versions to delete decided again with the retention policy, the --keep-tag
+// tags, the protected keys and the Object Lock retentions. The versions of the plan that are no longer to
+// delete get a skip reason, as do the current versions.
+func (v *s3Versions) checkPlanVersions(ctx context.Context, bucketPlan *BucketPlan, versions []*fileVersion) error {
+	bucket := bucketPlan.Bucket
+
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, version := range versions {
+		if !seen[version.Key] {
+			seen[version.Key] = true
+			keys = append(keys, version.Key)
+		}
+	}
+	fileVersions, err := v.listKeyVersions(ctx, bucket, keys)
+	if err != nil {
+		return err
+	}
+
+	listed := map[string]*fileVersion{}
+	for _, keyVersions := range fileVersions {
+		for _, version := range keyVersions {
+			listed[version.Key+"\x00"+version.VersionID] = version
+		}
+	}
+
+	ignoreFilesWithFewerVersions(fileVersions, v.minVersions)
+	objectLock, err := v.isObjectLockEnabled(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	decisions, err := v.computeVersionsToDelete(ctx, bucket, fileVersions, objectLock)
+	if err != nil {
+		return err
+	}
+	deleting := map[string]bool{}
+	for _, version := range decisions.toDelete {
+		deleting[version.Key+"\x00"+version.VersionID] = true
+	}
+
+	for _, version := range versions {
+		id := version.Key + "\x00" + version.VersionID
+		current, ok := listed[id]
+		switch {
+		case !ok:
+			version.SkipReason = "no longer listed"
+		case current.IsLatest && !current.IsDeleteMarker:
+			version.SkipReason = "current version"
+		case deleting[id]:
+			continue
+		case len(current.SkipReason) > 0:
+			version.SkipReason = current.SkipReason
+		case len(current.KeepReason) > 0:
+			version.SkipReason = "kept, " + current.KeepReason
+		default:
+			version.SkipReason = "kept by the retention policy"
+		}
+	}
+
+	return nil
+}
+
+// listKeyVersions lists the versions of the keys, one listing per key
+func (v *s3Versions) listKeyVersions(ctx context.Context, bucket string, keys []string) (map[string][]*fileVersion, error) {
+	fileVersions := map[string][]*fileVersion{}
+	for _, key := range keys {
+		input := &s3.ListObjectVersionsInput{
+			Bucket:  aws.String(bucket),
+			Prefix:  aws.String(key),
+			MaxKeys: aws.Int64(defaultMaxKeys),
+		}
+
+		for {
+			response, err := v.s3.ListObjectVersionsWithContext(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			v.metrics.listPages.Inc(bucket, v.bucketRegion(ctx, bucket))
+
+			appendFileVersions(fileVersions, response.Versions)
+			appendDeleteMarkers(fileVersions, response.DeleteMarkers)
+
+			if !aws.BoolValue(response.IsTruncated) {
+				break
+			}
+			input.KeyMarker = response.NextKeyMarker
+			input.VersionIdMarker = response.NextVersionIdMarker
+		}
+	}
+
+	// The prefix of a key also lists the keys it starts
+	listed := map[string][]*fileVersion{}
+	for _, key := range keys {
+		if versions, ok := fileVersions[key]; ok {
+			listed[key] = versions
+		}
+	}
+
+	return listed, nil
+}
@@ -0,0 +1,227 @@
+package versions
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decisions(keyPlan *KeyPlan) []Decision {
+	result := []Decision{}
+	for _, version := range keyPlan.Versions {
+		result = append(result, version.Decision)
+	}
+
+	return result
+}
+
+func TestPlan(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.Protect = []string{"key2"}
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	require.Equal(t, 1, len(plan.Buckets))
+	bucketPlan := plan.Buckets[0]
+	assert.Equal(t, "b1", bucketPlan.Bucket)
+	require.Equal(t, 2, len(bucketPlan.Keys))
+
+	key1 := bucketPlan.Keys[0]
+	assert.Equal(t, "key1", key1.Key)
+	assert.Equal(t, []Decision{DecisionKeep, DecisionDelete, DecisionDelete, DecisionDelete}, decisions(key1))
+	assert.Equal(t, "b1-key1-v3", key1.Versions[0].VersionID)
+	assert.Equal(t, "one of the 1 most recent versions", key1.Versions[0].Reason)
+	assert.True(t, key1.Versions[1].IsDeleteMarker)
+	assert.Equal(t, "older than the 1 most recent versions", key1.Versions[1].Reason)
+
+	key2 := bucketPlan.Keys[1]
+	assert.Equal(t, []Decision{DecisionKeep, DecisionSkip, DecisionSkip}, decisions(key2))
+	assert.Equal(t, "protected key, matches key2", key2.Versions[1].Reason)
+
+	assert.Equal(t, PlanTotals{Keys: 2, Delete: 3, Keep: 2, Skip: 2}, plan.Totals())
+	// Nothing is deleted when planning
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestExecute(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.Confirm = false
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	// The oldest version of key1 is kept by changing the plan
+	key1 := plan.Buckets[0].Keys[0]
+	key1.Versions[3].Decision = DecisionKeep
+
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+
+	assert.Equal(t, 4, result.VersionsDeleted())
+	assert.Equal(t, 0, result.Failures())
+	require.Equal(t, 1, len(result.Buckets))
+	assert.Equal(t, &DeletedVersion{Key: "key1", VersionID: "b1-key1-v2-deleted"}, result.Buckets[0].Deleted[0])
+
+	assert.Equal(t, 2, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, "b1-key1-v1", fakeBuckets["b1"].Objects["key1"][0].VersionID)
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestExecute_Limits(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.MaxDeleteVersions = 2
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	result, err := s.Execute(context.Background(), plan)
+	require.NotNil(t, err)
+	assert.Equal(t, "Aborting b1: 5 versions to delete exceed --max-delete-versions 2", err.Error())
+	assert.Equal(t, 0, result.VersionsDeleted())
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestExecute_ProtectedKeys(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.Protect = []string{"key2"}
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	// The versions of protected keys are never deleted, even when the plan is changed
+	for _, version := range plan.Buckets[0].Keys[1].Versions[1:] {
+		version.Decision = DecisionDelete
+	}
+
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 3, result.VersionsDeleted())
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+// flipToDelete turns the decisions about the versions into DecisionDelete
+func flipToDelete(plan *Plan, versionIDs ...string) {
+	flip := map[string]bool{}
+	for _, id := range versionIDs {
+		flip[id] = true
+	}
+
+	for _, bucketPlan := range plan.Buckets {
+		for _, keyPlan := range bucketPlan.Keys {
+			for _, version := range keyPlan.Versions {
+				if flip[version.VersionID] {
+					version.Decision = DecisionDelete
+				}
+			}
+		}
+	}
+}
+
+func TestExecute_TagProtectedKeys(t *testing.T) {
+	fakeBuckets := setupTaggedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	s.config.ProtectTag = []string{"keep=false"}
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []Decision{DecisionKeep, DecisionSkip, DecisionSkip}, decisions(plan.Buckets[0].Keys[1]))
+
+	flipToDelete(plan, "b1-key2-v1", "b1-key2-deleted")
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 3, result.VersionsDeleted())
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestExecute_PinnedVersions(t *testing.T) {
+	fakeBuckets := setupTaggedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	s.config.KeepTag = []string{"release"}
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []Decision{DecisionKeep, DecisionKeep, DecisionDelete}, decisions(plan.Buckets[0].Keys[1]))
+	// The pinned version was first decided to be deleted, the policy was applied again without it
+	assert.Equal(t, "pinned by the tag release", plan.Buckets[0].Keys[1].Versions[1].Reason)
+	assert.Equal(t, "older than the 1 most recent versions", plan.Buckets[0].Keys[1].Versions[2].Reason)
+
+	flipToDelete(plan, "b1-key2-v1")
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 4, result.VersionsDeleted())
+	assert.Equal(t, []string{"b1-key2-v1", "b1-key2-v2"}, versionIDs(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestExecute_LockedVersions(t *testing.T) {
+	fakeBuckets := setupLockedBuckets()
+	s := getBasicTestService(fakeBuckets)
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []Decision{DecisionKeep, DecisionDelete, DecisionSkip, DecisionSkip}, decisions(plan.Buckets[0].Keys[0]))
+
+	// The locked versions are refused before reaching S3, which would fail to delete them
+	flipToDelete(plan, "b1-key1-v1", "b1-key1-v2", "b1-key2-v1")
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 2, result.VersionsDeleted())
+	assert.Equal(t, 0, result.Failures())
+	assert.Equal(t, []string{"b1-key1-v1", "b1-key1-v2", "b1-key1-v3"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestExecute_CurrentVersion(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	current := plan.Buckets[0].Keys[0].Versions[0]
+	current.IsLatest = true
+	current.Decision = DecisionDelete
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 5, result.VersionsDeleted())
+	assert.Equal(t, []string{"b1-key1-v3"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestExecute_KeptByRetentionPolicy(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.VersionsCount = 2
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, []Decision{DecisionKeep, DecisionKeep, DecisionKeep, DecisionDelete}, decisions(plan.Buckets[0].Keys[0]))
+
+	// The second most recent version is kept by --count, even when the plan is changed
+	flipToDelete(plan, "b1-key1-v2")
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 2, result.VersionsDeleted())
+	assert.Equal(t, []string{"b1-key1-v2", "b1-key1-v2-deleted", "b1-key1-v3"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestExecute_StalePlan(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	// The newest version of key1 is deleted after planning, the planned deletion of v2 is now stale
+	key1 := fakeBuckets["b1"].Objects["key1"]
+	fakeBuckets["b1"].Objects["key1"] = key1[:len(key1)-1]
+
+	result, err := s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+	assert.Equal(t, 3, result.VersionsDeleted())
+	assert.Equal(t, []string{"b1-key1-v2", "b1-key1-v2-deleted"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+}
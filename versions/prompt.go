@@ -0,0 +1,54 @@
+package versions
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// prompter asks the user for input
+type prompter interface {
+	// prompt prints the message and returns the next line read, without the line break
+	prompt(message string) (string, error)
+	// interactive reports whether a user is typing the answers
+	interactive() bool
+}
+
+// terminalPrompter reads the answers from stdin, which can also be a pipe
+type terminalPrompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	tty bool
+}
+
+func newTerminalPrompter() prompter {
+	return &terminalPrompter{
+		in:  bufio.NewReader(os.Stdin),
+		out: os.Stderr,
+		tty: isTerminal(os.Stdin),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *terminalPrompter) prompt(message string) (string, error) {
+	if p.tty {
+		fmt.Fprint(p.out, message)
+	}
+
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+
+	return strings.TrimSpace(line), nil
+}
+
+func (p *terminalPrompter) interactive() bool {
+	return p.tty
+}
@@ -0,0 +1,195 @@
+package versions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/croman/delete-s3-versions/config"
+)
+
+// protectionPolicy is the content of the --protect-policy file
+type protectionPolicy struct {
+	Keys []string `json:"keys"`
+	Tags []string `json:"tags"`
+}
+
+// protectionRules are the keys whose versions are never deleted
+type protectionRules struct {
+	globs    []string
+	patterns []*regexp.Regexp
+	tags     []tagCondition
+}
+
+// tagCondition matches a tag by key and value, or by key only when anyValue is set
+type tagCondition struct {
+	key      string
+	value    string
+	anyValue bool
+}
+
+func parseTagCondition(condition string) tagCondition {
+	parts := strings.SplitN(condition, "=", 2)
+	if len(parts) == 1 {
+		return tagCondition{key: parts[0], anyValue: true}
+	}
+
+	return tagCondition{key: parts[0], value: parts[1]}
+}
+
+func (c tagCondition) matches(tags map[string]string) bool {
+	value, ok := tags[c.key]
+	return ok && (c.anyValue || value == c.value)
+}
+
+func (c tagCondition) String() string {
+	if c.anyValue {
+		return c.key
+	}
+
+	return c.key + "=" + c.value
+}
+
+// globToRegexp converts a key glob: '*' and '?' don't match '/', '**' matches anything
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				pattern.WriteString(".*")
+				i++
+			} else {
+				pattern.WriteString("[^/]*")
+			}
+		case '?':
+			pattern.WriteString("[^/]")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	pattern.WriteString("$")
+
+	return regexp.Compile(pattern.String())
+}
+
+func loadProtectionRules(c *config.Config) (*protectionRules, error) {
+	globs := append([]string{}, c.Protect...)
+	tags := append([]string{}, c.ProtectTag...)
+
+	if len(c.ProtectPolicy) > 0 {
+		content, err := ioutil.ReadFile(c.ProtectPolicy)
+		if err != nil {
+			return nil, err
+		}
+
+		policy := protectionPolicy{}
+		if err = json.Unmarshal(content, &policy); err != nil {
+			return nil, fmt.Errorf("Invalid protection policy %s: %v", c.ProtectPolicy, err)
+		}
+
+		globs = append(globs, policy.Keys...)
+		tags = append(tags, policy.Tags...)
+	}
+
+	rules := &protectionRules{}
+	for _, glob := range globs {
+		pattern, err := globToRegexp(glob)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid protected key glob %s: %v", glob, err)
+		}
+		rules.globs = append(rules.globs, glob)
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	for _, tag := range tags {
+		rules.tags = append(rules.tags, parseTagCondition(tag))
+	}
+
+	return rules, nil
+}
+
+// keyReason returns the glob protecting the key, empty when there is none
+func (r *protectionRules) keyReason(key string) string {
+	if r == nil {
+		return ""
+	}
+
+	for i, pattern := range r.patterns {
+		if pattern.MatchString(key) {
+			return "matches " + r.globs[i]
+		}
+	}
+
+	return ""
+}
+
+// tagReason returns the tag condition protecting a key with these tags, empty when there is none
+func (r *protectionRules) tagReason(tags map[string]string) string {
+	if r == nil {
+		return ""
+	}
+
+	for _, condition := range r.tags {
+		if condition.matches(tags) {
+			return "tagged " + condition.String()
+		}
+	}
+
+	return ""
+}
+
+// protectedKeys returns why the keys having versions to delete are protected. The tag conditions are checked
+// on the current version of the keys (the newest version that isn't a delete marker).
+func (v *s3Versions) protectedKeys(ctx context.Context, bucket string, fileVersions map[string][]*fileVersion, candidates map[string][]*fileVersion) (map[string]string, error) {
+	protected := map[string]string{}
+	currentVersions := []*fileVersion{}
+
+	for key := range candidates {
+		if reason := v.protection.keyReason(key); len(reason) > 0 {
+			protected[key] = reason
+			continue
+		}
+
+		if v.protection == nil || len(v.protection.tags) == 0 {
+			continue
+		}
+
+		// The versions are sorted from the newest
+		for _, version := range fileVersions[key] {
+			if !version.IsDeleteMarker {
+				currentVersions = append(currentVersions, version)
+				break
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	err := forEachVersion(currentVersions, v.config.CheckConcurrency, func(version *fileVersion) error {
+		tags, err := v.getVersionTags(ctx, bucket, version)
+		if err != nil {
+			return err
+		}
+
+		if reason := v.protection.tagReason(tags); len(reason) > 0 {
+			mu.Lock()
+			protected[version.Key] = reason
+			mu.Unlock()
+		}
+		return nil
+	})
+
+	return protected, err
+}
+
+// isProtected reports whether the version must not be deleted, as decided when computing the versions to delete
+// or because its key matches a protected glob
+func (v *s3Versions) isProtected(version *fileVersion) bool {
+	return len(version.SkipReason) > 0 || len(v.protection.keyReason(version.Key)) > 0
+}
@@ -0,0 +1,113 @@
+package versions
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob     string
+		key      string
+		expected bool
+	}{
+		{"releases/**", "releases/v1/app.tar.gz", true},
+		{"releases/**", "other/releases/app.tar.gz", false},
+		{"releases/*", "releases/app.tar.gz", true},
+		{"releases/*", "releases/v1/app.tar.gz", false},
+		{"**/*.sig", "artifacts/v1/app.sig", true},
+		{"*.sig", "artifacts/app.sig", false},
+		{"app-?.jar", "app-1.jar", true},
+		{"app-?.jar", "app-10.jar", false},
+		{"a+b(c).txt", "a+b(c).txt", true},
+	}
+
+	for _, test := range tests {
+		pattern, err := globToRegexp(test.glob)
+		require.Nil(t, err)
+		assert.Equal(t, test.expected, pattern.MatchString(test.key), "%s %s", test.glob, test.key)
+	}
+}
+
+func TestLoadProtectionRules(t *testing.T) {
+	policy, err := ioutil.TempFile("", "policy")
+	require.Nil(t, err)
+	defer os.Remove(policy.Name())
+	_, err = policy.WriteString(`{"keys": ["releases/**"], "tags": ["signed=true"]}`)
+	require.Nil(t, err)
+	policy.Close()
+
+	s := getBasicTestService(setupBucketsAndObjects())
+	s.config.Protect = []string{"*.sig"}
+	s.config.ProtectTag = []string{"legal"}
+	s.config.ProtectPolicy = policy.Name()
+
+	rules, err := loadProtectionRules(s.config)
+	require.Nil(t, err)
+
+	assert.Equal(t, "matches *.sig", rules.keyReason("app.sig"))
+	assert.Equal(t, "matches releases/**", rules.keyReason("releases/v1/app"))
+	assert.Equal(t, "", rules.keyReason("builds/app"))
+
+	assert.Equal(t, "tagged legal", rules.tagReason(map[string]string{"legal": ""}))
+	assert.Equal(t, "tagged signed=true", rules.tagReason(map[string]string{"signed": "true"}))
+	assert.Equal(t, "", rules.tagReason(map[string]string{"signed": "false"}))
+}
+
+func TestFindAndDelete_ProtectedKey(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.Protect = []string{"key1"}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+	assert.Equal(t, 3, s.summary.protectedSkipped)
+}
+
+func TestFindAndDelete_ProtectedTag(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	for _, version := range fakeBuckets["b1"].Objects["key2"] {
+		if version.VersionID == "b1-key2-v2" {
+			version.Tags = map[string]string{"signed": "true"}
+		}
+	}
+	s := getBasicTestService(fakeBuckets)
+	s.config.ProtectTag = []string{"signed=true"}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 3, len(fakeBuckets["b1"].Objects["key2"]))
+	assert.Equal(t, 2, s.summary.protectedSkipped)
+	// Only the current version of each key is checked
+	assert.Equal(t, 2, s.s3.(*s3apiMock).tagChecks)
+}
+
+func TestDeleteS3Versions_RefusesProtectedVersions(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.summary = &deletionSummary{}
+	s.config.Protect = []string{"key1"}
+
+	rules, err := loadProtectionRules(s.config)
+	require.Nil(t, err)
+	s.protection = rules
+
+	fileVersions, err := s.getFileVersions(context.Background(), "b1")
+	require.Nil(t, err)
+
+	err = s.deleteS3Versions(context.Background(), "b1", append(fileVersions["key1"], fileVersions["key2"][0]), nil)
+	require.Nil(t, err)
+
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 2, len(fakeBuckets["b1"].Objects["key2"]))
+}
@@ -0,0 +1,246 @@
+package versions
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/croman/delete-s3-versions/config"
+)
+
+// Version is a file version or a delete marker, as seen by the retention policies
+type Version struct {
+	Key            string
+	VersionID      string
+	IsLatest       bool
+	IsDeleteMarker bool
+	LastModified   time.Time
+	Size           int64
+	StorageClass   string
+}
+
+// RetentionDecision is the decision of a retention policy about a version
+type RetentionDecision struct {
+	Delete bool
+	Reason string
+}
+
+// RetentionPolicy decides which versions of a key to delete. The versions are sorted the newest first, those
+// it decided to delete that are pinned by a --keep-tag tag are left out and it is called again. It returns a
+// decision per version, in the same order. The versions of protected keys and the versions under an Object
+// Lock are kept whatever the decisions.
+type RetentionPolicy interface {
+	Decide(key string, versions []*Version, now time.Time) []RetentionDecision
+}
+
+// RetentionPolicyFunc adapts a function to a RetentionPolicy
+type RetentionPolicyFunc func(key string, versions []*Version, now time.Time) []RetentionDecision
+
+// Decide calls the function
+func (f RetentionPolicyFunc) Decide(key string, versions []*Version, now time.Time) []RetentionDecision {
+	return f(key, versions, now)
+}
+
+// KeepCount keeps the n most recent versions of every key. The delete markers aren't counted, those older
+// than the n-th version are deleted.
+func KeepCount(n int) RetentionPolicy {
+	return countPolicy(n)
+}
+
+type countPolicy int
+
+func (p countPolicy) Decide(key string, versions []*Version, now time.Time) []RetentionDecision {
+	decisions := []RetentionDecision{}
+	versionCount := 0
+	for _, version := range versions {
+		if versionCount >= int(p) {
+			reason := fmt.Sprintf("older than the %d most recent versions", p)
+			decisions = append(decisions, RetentionDecision{Delete: true, Reason: reason})
+		} else {
+			decisions = append(decisions, RetentionDecision{Reason: fmt.Sprintf("one of the %d most recent versions", p)})
+		}
+
+		if !version.IsDeleteMarker {
+			versionCount++
+		}
+	}
+
+	return decisions
+}
+
+// KeepNoncurrentFor keeps the current versions, and the versions noncurrent for less than the duration.
+// A version is noncurrent since the next one was created, as with the lifecycle rules. The newest version
+// given is always kept, when the current one is pinned it is unknown since when it is noncurrent.
+func KeepNoncurrentFor(age time.Duration) RetentionPolicy {
+	return agePolicy(age)
+}
+
+type agePolicy time.Duration
+
+func (p agePolicy) Decide(key string, versions []*Version, now time.Time) []RetentionDecision {
+	decisions := []RetentionDecision{}
+	for i, version := range versions {
+		switch {
+		case version.IsLatest:
+			decisions = append(decisions, RetentionDecision{Reason: "current version"})
+		case i == 0:
+			decisions = append(decisions, RetentionDecision{Reason: "newest version"})
+		case now.Sub(versions[i-1].LastModified) < time.Duration(p):
+			decisions = append(decisions, RetentionDecision{Reason: "noncurrent for less than " + formatAge(time.Duration(p))})
+		default:
+			reason := "noncurrent for more than " + formatAge(time.Duration(p))
+			decisions = append(decisions, RetentionDecision{Delete: true, Reason: reason})
+		}
+	}
+
+	return decisions
+}
+
+func formatAge(age time.Duration) string {
+	if age%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%d days", age/(24*time.Hour))
+	}
+
+	return age.String()
+}
+
+// All deletes a version only when all the policies delete it, e.g. the versions beyond the count to keep
+// that are also old enough
+func All(policies ...RetentionPolicy) RetentionPolicy {
+	return combinedPolicy{policies: policies, all: true}
+}
+
+// Any deletes a version as soon as one of the policies deletes it
+func Any(policies ...RetentionPolicy) RetentionPolicy {
+	return combinedPolicy{policies: policies}
+}
+
+type combinedPolicy struct {
+	policies []RetentionPolicy
+	all      bool
+}
+
+// Decide joins the reasons of the policies that made the decision
+func (p combinedPolicy) Decide(key string, versions []*Version, now time.Time) []RetentionDecision {
+	decisions := make([][]RetentionDecision, len(p.policies))
+	for i, policy := range p.policies {
+		decisions[i] = policy.Decide(key, versions, now)
+	}
+
+	combined := []RetentionDecision{}
+	for i := range versions {
+		deleteReasons, keepReasons := []string{}, []string{}
+		for _, policyDecisions := range decisions {
+			if i >= len(policyDecisions) {
+				keepReasons = append(keepReasons, "no decision")
+			} else if policyDecisions[i].Delete {
+				deleteReasons = append(deleteReasons, policyDecisions[i].Reason)
+			} else {
+				keepReasons = append(keepReasons, policyDecisions[i].Reason)
+			}
+		}
+
+		remove := len(deleteReasons) > 0
+		if p.all {
+			remove = len(keepReasons) == 0 && len(deleteReasons) > 0
+		}
+		if remove {
+			combined = append(combined, RetentionDecision{Delete: true, Reason: strings.Join(deleteReasons, " and ")})
+		} else {
+			combined = append(combined, RetentionDecision{Reason: strings.Join(keepReasons, " and ")})
+		}
+	}
+
+	return combined
+}
+
+// RetentionRule applies a retention policy to the keys matching a glob, '**' matching across '/'
+type RetentionRule struct {
+	Keys   string
+	Policy RetentionPolicy
+}
+
+// FirstMatch applies to every key the policy of the first rule matching it, the keys matching no rule are kept
+func FirstMatch(rules ...RetentionRule) (RetentionPolicy, error) {
+	policy := firstMatchPolicy{}
+	for _, rule := range rules {
+		pattern, err := globToRegexp(rule.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retention rule glob %q: %v", rule.Keys, err)
+		}
+		policy.patterns = append(policy.patterns, pattern)
+		policy.policies = append(policy.policies, rule.Policy)
+	}
+
+	return policy, nil
+}
+
+type firstMatchPolicy struct {
+	patterns []*regexp.Regexp
+	policies []RetentionPolicy
+}
+
+func (p firstMatchPolicy) Decide(key string, versions []*Version, now time.Time) []RetentionDecision {
+	for i, pattern := range p.patterns {
+		if pattern.MatchString(key) {
+			return p.policies[i].Decide(key, versions, now)
+		}
+	}
+
+	decisions := []RetentionDecision{}
+	for range versions {
+		decisions = append(decisions, RetentionDecision{Reason: "no retention rule matches the key"})
+	}
+
+	return decisions
+}
+
+// defaultRetentionPolicy keeps --count versions, and with --keep-days the versions noncurrent for less than
+// that. It returns the number of versions of the keys that can't have anything to delete, they are left out
+// before applying the policy.
+func defaultRetentionPolicy(c *config.Config) (RetentionPolicy, int) {
+	policy := KeepCount(c.VersionsCount)
+	if c.KeepDays > 0 {
+		policy = All(policy, KeepNoncurrentFor(time.Duration(c.KeepDays)*24*time.Hour))
+	}
+
+	return policy, c.VersionsCount
+}
+
+// decideRetention applies the retention policy to the versions of a key, setting their keep or delete reason.
+// It returns the versions to delete.
+func (v *s3Versions) decideRetention(key string, versions []*fileVersion, now time.Time) ([]*fileVersion, error) {
+	retained := []*Version{}
+	for _, version := range versions {
+		retained = append(retained, &Version{
+			Key:            version.Key,
+			VersionID:      version.VersionID,
+			IsLatest:       version.IsLatest,
+			IsDeleteMarker: version.IsDeleteMarker,
+			LastModified:   version.LastModified,
+			Size:           version.Size,
+			StorageClass:   version.StorageClass,
+		})
+	}
+
+	decisions := v.retention.Decide(key, retained, now)
+	if len(decisions) != len(versions) {
+		return nil, fmt.Errorf("The retention policy returned %d decisions for the %d versions of %s",
+			len(decisions), len(versions), key)
+	}
+
+	toDelete := []*fileVersion{}
+	for i, decision := range decisions {
+		if decision.Delete {
+			versions[i].DeleteReason = decision.Reason
+			versions[i].KeepReason = ""
+			toDelete = append(toDelete, versions[i])
+		} else {
+			versions[i].KeepReason = decision.Reason
+			versions[i].DeleteReason = ""
+		}
+	}
+
+	return toDelete, nil
+}
@@ -0,0 +1,172 @@
+package versions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deletes(decisions []RetentionDecision) []bool {
+	result := []bool{}
+	for _, decision := range decisions {
+		result = append(result, decision.Delete)
+	}
+
+	return result
+}
+
+func retentionVersions(now time.Time) []*Version {
+	return []*Version{
+		&Version{VersionID: "v4", IsLatest: true, LastModified: now.Add(-1 * 24 * time.Hour)},
+		&Version{VersionID: "v3-deleted", IsDeleteMarker: true, LastModified: now.Add(-5 * 24 * time.Hour)},
+		&Version{VersionID: "v3", LastModified: now.Add(-10 * 24 * time.Hour)},
+		&Version{VersionID: "v2", LastModified: now.Add(-20 * 24 * time.Hour)},
+		&Version{VersionID: "v1", LastModified: now.Add(-40 * 24 * time.Hour)},
+	}
+}
+
+func TestKeepCount(t *testing.T) {
+	now := time.Now()
+	decisions := KeepCount(2).Decide("key", retentionVersions(now), now)
+
+	// The delete marker isn't counted
+	assert.Equal(t, []bool{false, false, false, true, true}, deletes(decisions))
+	assert.Equal(t, "one of the 2 most recent versions", decisions[0].Reason)
+	assert.Equal(t, "older than the 2 most recent versions", decisions[3].Reason)
+}
+
+func TestKeepCount_Cases(t *testing.T) {
+	now := time.Now()
+	version := func(id string) *Version { return &Version{VersionID: id} }
+	marker := func(id string) *Version { return &Version{VersionID: id, IsDeleteMarker: true} }
+	// key1 and key2 of setupBucketsAndObjects, the newest first
+	key1 := []*Version{version("v3"), marker("v2-deleted"), version("v2"), version("v1")}
+	key2 := []*Version{version("v2"), version("v1"), marker("deleted")}
+
+	tests := []struct {
+		name     string
+		count    int
+		versions []*Version
+		deletes  []bool
+	}{
+		{"marker between versions, keep 1", 1, key1, []bool{false, true, true, true}},
+		{"marker between versions, keep 2", 2, key1, []bool{false, false, false, true}},
+		{"keep all the versions", 3, key1, []bool{false, false, false, false}},
+		{"keep more than the versions", 5, key1, []bool{false, false, false, false}},
+		{"oldest marker, keep 1", 1, key2, []bool{false, true, true}},
+		{"oldest marker, keep 2", 2, key2, []bool{false, false, true}},
+		{"newest marker", 1, []*Version{marker("deleted"), version("v2"), version("v1")}, []bool{false, false, true}},
+		{"only markers", 1, []*Version{marker("m2"), marker("m1")}, []bool{false, false}},
+		{"keep none", 0, key2, []bool{true, true, true}},
+		{"no versions", 1, []*Version{}, []bool{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.deletes, deletes(KeepCount(test.count).Decide("key", test.versions, now)))
+		})
+	}
+}
+
+func TestKeepNoncurrentFor(t *testing.T) {
+	now := time.Now()
+	decisions := KeepNoncurrentFor(7*24*time.Hour).Decide("key", retentionVersions(now), now)
+
+	// v3-deleted is noncurrent since v4 was created a day ago, v3 since 5 days
+	assert.Equal(t, []bool{false, false, false, true, true}, deletes(decisions))
+	assert.Equal(t, "current version", decisions[0].Reason)
+	assert.Equal(t, "noncurrent for less than 7 days", decisions[2].Reason)
+	assert.Equal(t, "noncurrent for more than 7 days", decisions[3].Reason)
+
+	// The newest version is kept when the current one is pinned
+	decisions = KeepNoncurrentFor(time.Hour).Decide("key", retentionVersions(now)[2:], now)
+	assert.Equal(t, []bool{false, true, true}, deletes(decisions))
+	assert.Equal(t, "newest version", decisions[0].Reason)
+}
+
+func TestAllAndAny(t *testing.T) {
+	now := time.Now()
+	count := KeepCount(1)
+	age := KeepNoncurrentFor(15 * 24 * time.Hour)
+
+	decisions := All(count, age).Decide("key", retentionVersions(now), now)
+	assert.Equal(t, []bool{false, false, false, false, true}, deletes(decisions))
+	assert.Equal(t, "noncurrent for less than 15 days", decisions[2].Reason)
+	assert.Equal(t, "older than the 1 most recent versions and noncurrent for more than 15 days", decisions[4].Reason)
+
+	decisions = Any(count, age).Decide("key", retentionVersions(now), now)
+	assert.Equal(t, []bool{false, true, true, true, true}, deletes(decisions))
+	assert.Equal(t, "one of the 1 most recent versions and current version", decisions[0].Reason)
+	assert.Equal(t, "older than the 1 most recent versions", decisions[2].Reason)
+}
+
+func TestFirstMatch(t *testing.T) {
+	now := time.Now()
+	policy, err := FirstMatch(
+		RetentionRule{Keys: "logs/**", Policy: KeepCount(1)},
+		RetentionRule{Keys: "**", Policy: KeepCount(3)},
+	)
+	require.Nil(t, err)
+
+	assert.Equal(t, []bool{false, true, true, true, true}, deletes(policy.Decide("logs/2020/app.log", retentionVersions(now), now)))
+	assert.Equal(t, []bool{false, false, false, false, true}, deletes(policy.Decide("data/file", retentionVersions(now), now)))
+
+	policy, err = FirstMatch(RetentionRule{Keys: "logs/**", Policy: KeepCount(1)})
+	require.Nil(t, err)
+	decisions := policy.Decide("data/file", retentionVersions(now), now)
+	assert.Equal(t, []bool{false, false, false, false, false}, deletes(decisions))
+	assert.Equal(t, "no retention rule matches the key", decisions[0].Reason)
+}
+
+func TestPlan_RetentionPolicy(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	// Only the versions older than 9h30 are deleted
+	s.customRetention = RetentionPolicyFunc(func(key string, versions []*Version, now time.Time) []RetentionDecision {
+		decisions := []RetentionDecision{}
+		for _, version := range versions {
+			old := now.Sub(version.LastModified) > 9*time.Hour+30*time.Minute
+			decisions = append(decisions, RetentionDecision{Delete: old, Reason: "age"})
+		}
+		return decisions
+	})
+
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+
+	require.Equal(t, 2, len(plan.Buckets[0].Keys))
+	key1 := plan.Buckets[0].Keys[0]
+	assert.Equal(t, []Decision{DecisionKeep, DecisionKeep, DecisionKeep, DecisionDelete}, decisions(key1))
+	assert.Equal(t, "age", key1.Versions[3].Reason)
+	key2 := plan.Buckets[0].Keys[1]
+	assert.Equal(t, []Decision{DecisionKeep, DecisionDelete, DecisionDelete}, decisions(key2))
+}
+
+func TestDelete_KeepDays(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	s.config.KeepDays = 1
+
+	// All the versions are noncurrent for less than a day
+	require.Nil(t, s.Delete())
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+
+	s = getBasicTestService(fakeBuckets)
+	s.config.KeepDays = 1
+	s.now = func() time.Time { return time.Now().Add(2 * 24 * time.Hour) }
+	require.Nil(t, s.Delete())
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+}
+
+func TestDecideRetention_DecisionCount(t *testing.T) {
+	s := getBasicTestService(setupBucketsAndObjects())
+	s.retention = RetentionPolicyFunc(func(key string, versions []*Version, now time.Time) []RetentionDecision {
+		return []RetentionDecision{}
+	})
+
+	_, err := s.decideRetention("key1", []*fileVersion{&fileVersion{}}, time.Now())
+	assert.EqualError(t, err, "The retention policy returned 0 decisions for the 1 versions of key1")
+}
@@ -1,8 +1,12 @@
 package versions
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"sort"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,8 +18,25 @@ import (
 )
 
 type fakeBucket struct {
-	VersioningStatus *string
-	Objects          map[string][]*fakeVersion
+	// Region is returned by GetBucketLocation, eu-west-1 when empty
+	Region            string
+	VersioningStatus  *string
+	ObjectLockEnabled bool
+	// MFA is the MFA header expected by DeleteObjects, when the bucket has MFA Delete enabled
+	MFA            string
+	LifecycleRules []*s3.LifecycleRule
+	Objects        map[string][]*fakeVersion
+	Uploads        []*fakeUpload
+	// OmitNullVersionIDs lists the null versions without ID, like some S3 compatible stores
+	OmitNullVersionIDs bool
+}
+
+type fakeUpload struct {
+	Key          string
+	UploadID     string
+	Initiated    time.Time
+	StorageClass string
+	PartSizes    []int64
 }
 
 type fakeVersion struct {
@@ -24,18 +45,47 @@ type fakeVersion struct {
 	IsLatest       bool
 	Size           int64
 	IsDeleteMarker bool
+	StorageClass   string
+	RetentionMode  string
+	RetainUntil    time.Time
+	LegalHold      bool
+	Tags           map[string]string
+	Body           []byte
 }
 
 type s3apiMock struct {
 	buckets         map[string]*fakeBucket
 	versionsPerPage int
+	onDeleteObjects func(input *s3.DeleteObjectsInput)
+	// injectedErrors are returned, in order, by the next calls of an operation
+	injectedErrors map[string][]error
+
+	// mu guards the counters, the checks and the lock heartbeats are concurrent
+	mu         sync.Mutex
+	lockChecks int
+	tagChecks  int
+	puts       int
+
+	// objectsMu guards the objects of the buckets, the lock heartbeats read and write them during the deletions
+	objectsMu sync.Mutex
 }
 
 func newS3ApiMock(buckets map[string]*fakeBucket, versionsPerPage int) s3api.S3API {
 	return &s3apiMock{
 		buckets:         buckets,
 		versionsPerPage: versionsPerPage,
+		injectedErrors:  map[string][]error{},
+	}
+}
+
+func (c *s3apiMock) injectedError(operation string) error {
+	errors := c.injectedErrors[operation]
+	if len(errors) == 0 {
+		return nil
 	}
+
+	c.injectedErrors[operation] = errors[1:]
+	return errors[0]
 }
 
 // Mock methods used in the package functionality
@@ -61,21 +111,48 @@ func (c *s3apiMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput,
 	return nil, awserr.New("NotFound", "NotFound", nil)
 }
 
+func (c *s3apiMock) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	if err := c.injectedError("GetBucketLocation"); err != nil {
+		return nil, err
+	}
+
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	// The buckets are in the region of the test service unless set
+	region := bucket.Region
+	if len(region) == 0 {
+		region = "eu-west-1"
+	}
+
+	return &s3.GetBucketLocationOutput{LocationConstraint: aws.String(region)}, nil
+}
+
 func (c *s3apiMock) GetBucketVersioning(input *s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
 	if *input.Bucket == "bucket-in-wrong-region" {
 		return nil, awserr.New("BucketRegionError", "BucketRegionError", nil)
 	}
 
 	if bucket, ok := c.buckets[*input.Bucket]; ok {
-		return &s3.GetBucketVersioningOutput{
+		output := &s3.GetBucketVersioningOutput{
 			Status: bucket.VersioningStatus,
-		}, nil
+		}
+		if len(bucket.MFA) > 0 {
+			output.MFADelete = aws.String(s3.MFADeleteStatusEnabled)
+		}
+
+		return output, nil
 	}
 
 	return nil, awserr.New("NotFound", "NotFound", nil)
 }
 
 func (c *s3apiMock) ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	c.objectsMu.Lock()
+	defer c.objectsMu.Unlock()
+
 	bucket, ok := c.buckets[*input.Bucket]
 
 	if !ok {
@@ -85,85 +162,109 @@ func (c *s3apiMock) ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.L
 	objectVersions := []*s3.ObjectVersion{}
 	deleteMarkers := []*s3.DeleteMarkerEntry{}
 
-	var page int
-	var err error
-	if input.KeyMarker != nil {
-		page, err = strconv.Atoi(*input.KeyMarker)
-		if err != nil {
-			return nil, awserr.New("InvalidKeyMarker", "InvalidKeyMarker", err)
-		}
-	}
-
-	startIndex := c.versionsPerPage * page
-	endIndex := c.versionsPerPage * (page + 1)
-
-	hasNextPage := false
-	index := -1
-
 	keys := []string{}
 	for key := range bucket.Objects {
-		keys = append(keys, key)
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
 	}
 	sort.Strings(keys)
 
+	keyMarker := aws.StringValue(input.KeyMarker)
+	versionIDMarker := aws.StringValue(input.VersionIdMarker)
+
+	// Versions are listed after the key marker, or after the version marker of the key marker when both are given
+	started := len(keyMarker) == 0
+	count := 0
+	var lastKey, lastVersionID string
+	var nextKeyMarker, nextVersionIDMarker *string
+
 	for _, key := range keys {
-		if hasNextPage {
+		if nextKeyMarker != nil {
 			break
 		}
 
-		versions := bucket.Objects[key]
-		for _, version := range versions {
-			index++
-			if index < startIndex {
+		if !started && key > keyMarker && len(versionIDMarker) == 0 {
+			started = true
+		}
+
+		for _, version := range bucket.Objects[key] {
+			if !started {
+				if key == keyMarker && version.VersionID == versionIDMarker {
+					started = true
+				}
 				continue
 			}
 
-			if index >= endIndex {
-				hasNextPage = true
+			if count == c.versionsPerPage {
+				nextKeyMarker = aws.String(lastKey)
+				nextVersionIDMarker = aws.String(lastVersionID)
 				break
 			}
+			count++
+			lastKey = key
+			lastVersionID = version.VersionID
+
+			versionID := aws.String(version.VersionID)
+			if version.VersionID == nullVersionID && bucket.OmitNullVersionIDs {
+				versionID = nil
+			}
 
 			if version.IsDeleteMarker {
 				deleteMarkers = append(deleteMarkers, &s3.DeleteMarkerEntry{
 					Key:          aws.String(key),
-					VersionId:    aws.String(version.VersionID),
+					VersionId:    versionID,
 					IsLatest:     aws.Bool(version.IsLatest),
 					LastModified: aws.Time(version.LastModified),
 				})
 			} else {
 				objectVersions = append(objectVersions, &s3.ObjectVersion{
 					Key:          aws.String(key),
-					VersionId:    aws.String(version.VersionID),
+					VersionId:    versionID,
 					IsLatest:     aws.Bool(version.IsLatest),
 					LastModified: aws.Time(version.LastModified),
 					Size:         aws.Int64(version.Size),
+					StorageClass: aws.String(version.StorageClass),
 				})
 			}
 		}
 	}
 
-	var nextKeymarker *string
-	if hasNextPage {
-		nextKeymarker = aws.String(strconv.Itoa(page + 1))
-	}
-
 	return &s3.ListObjectVersionsOutput{
-		DeleteMarkers: deleteMarkers,
-		Versions:      objectVersions,
-		NextKeyMarker: nextKeymarker,
+		DeleteMarkers:       deleteMarkers,
+		Versions:            objectVersions,
+		IsTruncated:         aws.Bool(nextKeyMarker != nil),
+		NextKeyMarker:       nextKeyMarker,
+		NextVersionIdMarker: nextVersionIDMarker,
 	}, nil
 }
 
 func (c *s3apiMock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	c.objectsMu.Lock()
+	defer c.objectsMu.Unlock()
+
 	bucket, ok := c.buckets[*input.Bucket]
 	if !ok {
 		return nil, awserr.New("NotFound", "NotFound", nil)
 	}
 
+	if len(input.Delete.Objects) > maxDeleteObjects {
+		return nil, awserr.New("MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema", nil)
+	}
+
+	if len(bucket.MFA) > 0 && aws.StringValue(input.MFA) != bucket.MFA {
+		return nil, awserr.New("AccessDenied", "Mfa Authentication must be used for this request", nil)
+	}
+
 	deleted := []*s3.DeletedObject{}
+	errors := []*s3.Error{}
 
 	objects := input.Delete.Objects
 	for _, object := range objects {
+		if object.VersionId == nil {
+			return nil, fmt.Errorf("deleting %s without a version ID would add a delete marker", *object.Key)
+		}
+
 		versions, ok := bucket.Objects[*object.Key]
 		if !ok {
 			return nil, awserr.New("NotFound", "NotFound", nil)
@@ -171,7 +272,18 @@ func (c *s3apiMock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjec
 
 		for i, version := range versions {
 			if version.VersionID == *object.VersionId {
+				if version.isLocked(aws.BoolValue(input.BypassGovernanceRetention)) {
+					errors = append(errors, &s3.Error{
+						Key:       object.Key,
+						VersionId: object.VersionId,
+						Code:      aws.String("AccessDenied"),
+						Message:   aws.String("Access Denied because object protected by object lock."),
+					})
+					break
+				}
+
 				deleted = append(deleted, &s3.DeletedObject{
+					Key:       object.Key,
 					VersionId: aws.String(version.VersionID),
 				})
 
@@ -183,9 +295,436 @@ func (c *s3apiMock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjec
 
 	return &s3.DeleteObjectsOutput{
 		Deleted: deleted,
+		Errors:  errors,
 	}, nil
 }
 
+func (v *fakeVersion) isLocked(bypassGovernance bool) bool {
+	if v.LegalHold {
+		return true
+	}
+
+	if !v.RetainUntil.After(time.Now()) {
+		return false
+	}
+
+	return v.RetentionMode == s3.ObjectLockRetentionModeCompliance || !bypassGovernance
+}
+
+func (c *s3apiMock) findVersion(bucketName string, key string, versionID string) (*fakeVersion, error) {
+	bucket, ok := c.buckets[bucketName]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	for _, version := range bucket.Objects[key] {
+		if version.VersionID == versionID {
+			return version, nil
+		}
+	}
+
+	return nil, awserr.New("NoSuchVersion", "NoSuchVersion", nil)
+}
+
+func (c *s3apiMock) GetObjectLockConfiguration(input *s3.GetObjectLockConfigurationInput) (*s3.GetObjectLockConfigurationOutput, error) {
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	if !bucket.ObjectLockEnabled {
+		return nil, awserr.New("ObjectLockConfigurationNotFoundError", "Object Lock configuration does not exist for this bucket", nil)
+	}
+
+	return &s3.GetObjectLockConfigurationOutput{
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+		},
+	}, nil
+}
+
+func (c *s3apiMock) GetObjectRetention(input *s3.GetObjectRetentionInput) (*s3.GetObjectRetentionOutput, error) {
+	c.mu.Lock()
+	c.lockChecks++
+	c.mu.Unlock()
+
+	version, err := c.findVersion(*input.Bucket, *input.Key, *input.VersionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(version.RetentionMode) == 0 {
+		return nil, awserr.New("NoSuchObjectLockConfiguration", "The specified object does not have a ObjectLock configuration", nil)
+	}
+
+	return &s3.GetObjectRetentionOutput{
+		Retention: &s3.ObjectLockRetention{
+			Mode:            aws.String(version.RetentionMode),
+			RetainUntilDate: aws.Time(version.RetainUntil),
+		},
+	}, nil
+}
+
+func (c *s3apiMock) GetObjectLegalHold(input *s3.GetObjectLegalHoldInput) (*s3.GetObjectLegalHoldOutput, error) {
+	version, err := c.findVersion(*input.Bucket, *input.Key, *input.VersionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !version.LegalHold {
+		return nil, awserr.New("NoSuchObjectLockConfiguration", "The specified object does not have a ObjectLock configuration", nil)
+	}
+
+	return &s3.GetObjectLegalHoldOutput{
+		LegalHold: &s3.ObjectLockLegalHold{
+			Status: aws.String(s3.ObjectLockLegalHoldStatusOn),
+		},
+	}, nil
+}
+
+func (c *s3apiMock) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput, opts ...request.Option) (*s3.ListBucketsOutput, error) {
+	return c.ListBuckets(input)
+}
+
+func (c *s3apiMock) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	return c.HeadBucket(input)
+}
+
+func (c *s3apiMock) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	return c.GetBucketLocation(input)
+}
+
+func (c *s3apiMock) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, opts ...request.Option) (*s3.GetBucketVersioningOutput, error) {
+	return c.GetBucketVersioning(input)
+}
+
+func (c *s3apiMock) ListObjectVersionsWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, opts ...request.Option) (*s3.ListObjectVersionsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	if err := c.injectedError("ListObjectVersions"); err != nil {
+		return nil, err
+	}
+
+	return c.ListObjectVersions(input)
+}
+
+func (c *s3apiMock) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	if err := c.injectedError("DeleteObjects"); err != nil {
+		return nil, err
+	}
+
+	if c.onDeleteObjects != nil {
+		c.onDeleteObjects(input)
+	}
+
+	return c.DeleteObjects(input)
+}
+
+func (c *s3apiMock) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	c.mu.Lock()
+	c.tagChecks++
+	c.mu.Unlock()
+
+	version, err := c.findVersion(*input.Bucket, *input.Key, *input.VersionId)
+	if err != nil {
+		return nil, err
+	}
+
+	tagSet := []*s3.Tag{}
+	for key, value := range version.Tags {
+		tagSet = append(tagSet, &s3.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+
+	return &s3.GetObjectTaggingOutput{
+		TagSet:    tagSet,
+		VersionId: input.VersionId,
+	}, nil
+}
+
+func (c *s3apiMock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.puts++
+	versionID := fmt.Sprintf("put-%d", c.puts)
+	c.mu.Unlock()
+
+	c.objectsMu.Lock()
+	defer c.objectsMu.Unlock()
+
+	bucket.Objects[*input.Key] = append(bucket.Objects[*input.Key], &fakeVersion{
+		VersionID:    versionID,
+		LastModified: time.Now(),
+		Size:         int64(len(body)),
+		Body:         body,
+	})
+
+	return &s3.PutObjectOutput{
+		VersionId: aws.String(versionID),
+	}, nil
+}
+
+// GetObject returns the latest version, the last one put when several have the same modification time
+func (c *s3apiMock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	c.objectsMu.Lock()
+	defer c.objectsMu.Unlock()
+
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	var latest *fakeVersion
+	for _, version := range bucket.Objects[*input.Key] {
+		if latest == nil || !version.LastModified.Before(latest.LastModified) {
+			latest = version
+		}
+	}
+
+	if latest == nil || latest.IsDeleteMarker {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	return &s3.GetObjectOutput{
+		Body:      ioutil.NopCloser(bytes.NewReader(latest.Body)),
+		VersionId: aws.String(latest.VersionID),
+	}, nil
+}
+
+func (c *s3apiMock) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	return c.PutObject(input)
+}
+
+func (c *s3apiMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return c.GetObject(input)
+}
+
+func (c *s3apiMock) GetBucketLifecycleConfiguration(input *s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	if len(bucket.LifecycleRules) == 0 {
+		return nil, awserr.New("NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", nil)
+	}
+
+	return &s3.GetBucketLifecycleConfigurationOutput{
+		Rules: bucket.LifecycleRules,
+	}, nil
+}
+
+func (c *s3apiMock) PutBucketLifecycleConfiguration(input *s3.PutBucketLifecycleConfigurationInput) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	// Like S3, the rules can't mix the deprecated Prefix and Filter
+	filters := 0
+	for _, rule := range input.LifecycleConfiguration.Rules {
+		if rule.Filter != nil {
+			filters++
+		}
+	}
+	if filters > 0 && filters < len(input.LifecycleConfiguration.Rules) {
+		return nil, awserr.New("MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema", nil)
+	}
+
+	bucket.LifecycleRules = input.LifecycleConfiguration.Rules
+
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (c *s3apiMock) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	return c.GetBucketLifecycleConfiguration(input)
+}
+
+func (c *s3apiMock) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	return c.PutBucketLifecycleConfiguration(input)
+}
+
+func (c *s3apiMock) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	return c.GetObjectTagging(input)
+}
+
+func (c *s3apiMock) GetObjectLockConfigurationWithContext(ctx aws.Context, input *s3.GetObjectLockConfigurationInput, opts ...request.Option) (*s3.GetObjectLockConfigurationOutput, error) {
+	return c.GetObjectLockConfiguration(input)
+}
+
+func (c *s3apiMock) GetObjectRetentionWithContext(ctx aws.Context, input *s3.GetObjectRetentionInput, opts ...request.Option) (*s3.GetObjectRetentionOutput, error) {
+	return c.GetObjectRetention(input)
+}
+
+func (c *s3apiMock) GetObjectLegalHoldWithContext(ctx aws.Context, input *s3.GetObjectLegalHoldInput, opts ...request.Option) (*s3.GetObjectLegalHoldOutput, error) {
+	return c.GetObjectLegalHold(input)
+}
+
+func (c *s3apiMock) ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
+	if err := c.injectedError("ListMultipartUploads"); err != nil {
+		return nil, err
+	}
+
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	uploads := []*fakeUpload{}
+	for _, upload := range bucket.Uploads {
+		if strings.HasPrefix(upload.Key, aws.StringValue(input.Prefix)) {
+			uploads = append(uploads, upload)
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key == uploads[j].Key {
+			return uploads[i].UploadID < uploads[j].UploadID
+		}
+		return uploads[i].Key < uploads[j].Key
+	})
+
+	start := 0
+	if input.KeyMarker != nil {
+		for start < len(uploads) && (uploads[start].Key < *input.KeyMarker ||
+			(uploads[start].Key == *input.KeyMarker && uploads[start].UploadID <= aws.StringValue(input.UploadIdMarker))) {
+			start++
+		}
+	}
+	end := start + c.versionsPerPage
+	if end > len(uploads) {
+		end = len(uploads)
+	}
+
+	output := &s3.ListMultipartUploadsOutput{
+		IsTruncated: aws.Bool(end < len(uploads)),
+	}
+	for _, upload := range uploads[start:end] {
+		output.Uploads = append(output.Uploads, &s3.MultipartUpload{
+			Key:          aws.String(upload.Key),
+			UploadId:     aws.String(upload.UploadID),
+			Initiated:    aws.Time(upload.Initiated),
+			StorageClass: aws.String(upload.StorageClass),
+		})
+	}
+	if end < len(uploads) {
+		output.NextKeyMarker = aws.String(uploads[end-1].Key)
+		output.NextUploadIdMarker = aws.String(uploads[end-1].UploadID)
+	}
+
+	return output, nil
+}
+
+func (c *s3apiMock) findUpload(bucketName string, key string, uploadID string) (*fakeBucket, int, error) {
+	bucket, ok := c.buckets[bucketName]
+	if !ok {
+		return nil, 0, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	for i, upload := range bucket.Uploads {
+		if upload.Key == key && upload.UploadID == uploadID {
+			return bucket, i, nil
+		}
+	}
+
+	return nil, 0, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+}
+
+func (c *s3apiMock) ListParts(input *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
+	bucket, i, err := c.findUpload(*input.Bucket, *input.Key, *input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := bucket.Uploads[i].PartSizes
+	start := int(aws.Int64Value(input.PartNumberMarker))
+	end := start + c.versionsPerPage
+	if end > len(sizes) {
+		end = len(sizes)
+	}
+
+	output := &s3.ListPartsOutput{
+		IsTruncated: aws.Bool(end < len(sizes)),
+	}
+	for n := start; n < end; n++ {
+		output.Parts = append(output.Parts, &s3.Part{
+			PartNumber: aws.Int64(int64(n + 1)),
+			Size:       aws.Int64(sizes[n]),
+		})
+	}
+	if end < len(sizes) {
+		output.NextPartNumberMarker = aws.Int64(int64(end))
+	}
+
+	return output, nil
+}
+
+func (c *s3apiMock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	if err := c.injectedError("AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	bucket, i, err := c.findUpload(*input.Bucket, *input.Key, *input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket.Uploads = append(bucket.Uploads[:i], bucket.Uploads[i+1:]...)
+
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (c *s3apiMock) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
+	return c.ListMultipartUploads(input)
+}
+
+func (c *s3apiMock) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
+	return c.ListParts(input)
+}
+
+func (c *s3apiMock) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	return c.AbortMultipartUpload(input)
+}
+
+func (c *s3apiMock) PutBucketVersioning(input *s3.PutBucketVersioningInput) (*s3.PutBucketVersioningOutput, error) {
+	if err := c.injectedError("PutBucketVersioning"); err != nil {
+		return nil, err
+	}
+
+	bucket, ok := c.buckets[*input.Bucket]
+	if !ok {
+		return nil, awserr.New("NoSuchBucket", "NoSuchBucket", nil)
+	}
+
+	if len(bucket.MFA) > 0 && aws.StringValue(input.MFA) != bucket.MFA {
+		return nil, awserr.New("AccessDenied", "Mfa Authentication must be used for this request", nil)
+	}
+
+	bucket.VersioningStatus = input.VersioningConfiguration.Status
+
+	return &s3.PutBucketVersioningOutput{}, nil
+}
+
+func (c *s3apiMock) PutBucketVersioningWithContext(ctx aws.Context, input *s3.PutBucketVersioningInput, opts ...request.Option) (*s3.PutBucketVersioningOutput, error) {
+	return c.PutBucketVersioning(input)
+}
+
 func remove(slice []*fakeVersion, i int) []*fakeVersion {
 	copy(slice[i:], slice[i+1:])
 	return slice[:len(slice)-1]
@@ -196,12 +735,6 @@ func remove(slice []*fakeVersion, i int) []*fakeVersion {
 func (c *s3apiMock) AbortMultipartUploadRequest(input *s3.AbortMultipartUploadInput) (req *request.Request, output *s3.AbortMultipartUploadOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) CompleteMultipartUploadRequest(input *s3.CompleteMultipartUploadInput) (req *request.Request, output *s3.CompleteMultipartUploadOutput) {
 	return nil, nil
 }
@@ -358,9 +891,6 @@ func (c *s3apiMock) DeleteObjectTaggingWithContext(ctx aws.Context, input *s3.De
 func (c *s3apiMock) DeleteObjectsRequest(input *s3.DeleteObjectsInput) (req *request.Request, output *s3.DeleteObjectsOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) DeletePublicAccessBlockRequest(input *s3.DeletePublicAccessBlockInput) (req *request.Request, output *s3.DeletePublicAccessBlockOutput) {
 	return nil, nil
 }
@@ -436,21 +966,9 @@ func (c *s3apiMock) GetBucketLifecycleWithContext(ctx aws.Context, input *s3.Get
 func (c *s3apiMock) GetBucketLifecycleConfigurationRequest(input *s3.GetBucketLifecycleConfigurationInput) (req *request.Request, output *s3.GetBucketLifecycleConfigurationOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetBucketLifecycleConfiguration(input *s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.GetBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.GetBucketLifecycleConfigurationOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetBucketLocationRequest(input *s3.GetBucketLocationInput) (req *request.Request, output *s3.GetBucketLocationOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetBucketLoggingRequest(input *s3.GetBucketLoggingInput) (req *request.Request, output *s3.GetBucketLoggingOutput) {
 	return nil, nil
 }
@@ -535,9 +1053,6 @@ func (c *s3apiMock) GetBucketTaggingWithContext(ctx aws.Context, input *s3.GetBu
 func (c *s3apiMock) GetBucketVersioningRequest(input *s3.GetBucketVersioningInput) (req *request.Request, output *s3.GetBucketVersioningOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetBucketVersioningWithContext(ctx aws.Context, input *s3.GetBucketVersioningInput, opts ...request.Option) (*s3.GetBucketVersioningOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetBucketWebsiteRequest(input *s3.GetBucketWebsiteInput) (req *request.Request, output *s3.GetBucketWebsiteOutput) {
 	return nil, nil
 }
@@ -550,12 +1065,6 @@ func (c *s3apiMock) GetBucketWebsiteWithContext(ctx aws.Context, input *s3.GetBu
 func (c *s3apiMock) GetObjectRequest(input *s3.GetObjectInput) (req *request.Request, output *s3.GetObjectOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetObjectAclRequest(input *s3.GetObjectAclInput) (req *request.Request, output *s3.GetObjectAclOutput) {
 	return nil, nil
 }
@@ -568,39 +1077,15 @@ func (c *s3apiMock) GetObjectAclWithContext(ctx aws.Context, input *s3.GetObject
 func (c *s3apiMock) GetObjectLegalHoldRequest(input *s3.GetObjectLegalHoldInput) (req *request.Request, output *s3.GetObjectLegalHoldOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetObjectLegalHold(input *s3.GetObjectLegalHoldInput) (*s3.GetObjectLegalHoldOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetObjectLegalHoldWithContext(ctx aws.Context, input *s3.GetObjectLegalHoldInput, opts ...request.Option) (*s3.GetObjectLegalHoldOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetObjectLockConfigurationRequest(input *s3.GetObjectLockConfigurationInput) (req *request.Request, output *s3.GetObjectLockConfigurationOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetObjectLockConfiguration(input *s3.GetObjectLockConfigurationInput) (*s3.GetObjectLockConfigurationOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetObjectLockConfigurationWithContext(ctx aws.Context, input *s3.GetObjectLockConfigurationInput, opts ...request.Option) (*s3.GetObjectLockConfigurationOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetObjectRetentionRequest(input *s3.GetObjectRetentionInput) (req *request.Request, output *s3.GetObjectRetentionOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetObjectRetention(input *s3.GetObjectRetentionInput) (*s3.GetObjectRetentionOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetObjectRetentionWithContext(ctx aws.Context, input *s3.GetObjectRetentionInput, opts ...request.Option) (*s3.GetObjectRetentionOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetObjectTaggingRequest(input *s3.GetObjectTaggingInput) (req *request.Request, output *s3.GetObjectTaggingOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) GetObjectTorrentRequest(input *s3.GetObjectTorrentInput) (req *request.Request, output *s3.GetObjectTorrentOutput) {
 	return nil, nil
 }
@@ -622,9 +1107,6 @@ func (c *s3apiMock) GetPublicAccessBlockWithContext(ctx aws.Context, input *s3.G
 func (c *s3apiMock) HeadBucketRequest(input *s3.HeadBucketInput) (req *request.Request, output *s3.HeadBucketOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) HeadObjectRequest(input *s3.HeadObjectInput) (req *request.Request, output *s3.HeadObjectOutput) {
 	return nil, nil
 }
@@ -664,18 +1146,9 @@ func (c *s3apiMock) ListBucketMetricsConfigurationsWithContext(ctx aws.Context,
 func (c *s3apiMock) ListBucketsRequest(input *s3.ListBucketsInput) (req *request.Request, output *s3.ListBucketsOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) ListBucketsWithContext(ctx aws.Context, input *s3.ListBucketsInput, opts ...request.Option) (*s3.ListBucketsOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) ListMultipartUploadsRequest(input *s3.ListMultipartUploadsInput) (req *request.Request, output *s3.ListMultipartUploadsOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) ListMultipartUploads(input *s3.ListMultipartUploadsInput) (*s3.ListMultipartUploadsOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) ListMultipartUploadsWithContext(ctx aws.Context, input *s3.ListMultipartUploadsInput, opts ...request.Option) (*s3.ListMultipartUploadsOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) ListMultipartUploadsPages(input *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
 	return nil
 }
@@ -685,9 +1158,6 @@ func (c *s3apiMock) ListMultipartUploadsPagesWithContext(ctx aws.Context, input
 func (c *s3apiMock) ListObjectVersionsRequest(input *s3.ListObjectVersionsInput) (req *request.Request, output *s3.ListObjectVersionsOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) ListObjectVersionsWithContext(ctx aws.Context, input *s3.ListObjectVersionsInput, opts ...request.Option) (*s3.ListObjectVersionsOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
 	return nil
 }
@@ -727,12 +1197,6 @@ func (c *s3apiMock) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.Lis
 func (c *s3apiMock) ListPartsRequest(input *s3.ListPartsInput) (req *request.Request, output *s3.ListPartsOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) ListParts(input *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
 	return nil
 }
@@ -805,12 +1269,6 @@ func (c *s3apiMock) PutBucketLifecycleWithContext(ctx aws.Context, input *s3.Put
 func (c *s3apiMock) PutBucketLifecycleConfigurationRequest(input *s3.PutBucketLifecycleConfigurationInput) (req *request.Request, output *s3.PutBucketLifecycleConfigurationOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) PutBucketLifecycleConfiguration(input *s3.PutBucketLifecycleConfigurationInput) (*s3.PutBucketLifecycleConfigurationOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) PutBucketLifecycleConfigurationWithContext(ctx aws.Context, input *s3.PutBucketLifecycleConfigurationInput, opts ...request.Option) (*s3.PutBucketLifecycleConfigurationOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) PutBucketLoggingRequest(input *s3.PutBucketLoggingInput) (req *request.Request, output *s3.PutBucketLoggingOutput) {
 	return nil, nil
 }
@@ -886,12 +1344,6 @@ func (c *s3apiMock) PutBucketTaggingWithContext(ctx aws.Context, input *s3.PutBu
 func (c *s3apiMock) PutBucketVersioningRequest(input *s3.PutBucketVersioningInput) (req *request.Request, output *s3.PutBucketVersioningOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) PutBucketVersioning(input *s3.PutBucketVersioningInput) (*s3.PutBucketVersioningOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) PutBucketVersioningWithContext(ctx aws.Context, input *s3.PutBucketVersioningInput, opts ...request.Option) (*s3.PutBucketVersioningOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) PutBucketWebsiteRequest(input *s3.PutBucketWebsiteInput) (req *request.Request, output *s3.PutBucketWebsiteOutput) {
 	return nil, nil
 }
@@ -904,12 +1356,6 @@ func (c *s3apiMock) PutBucketWebsiteWithContext(ctx aws.Context, input *s3.PutBu
 func (c *s3apiMock) PutObjectRequest(input *s3.PutObjectInput) (req *request.Request, output *s3.PutObjectOutput) {
 	return nil, nil
 }
-func (c *s3apiMock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
-	return nil, nil
-}
-func (c *s3apiMock) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
-	return nil, nil
-}
 func (c *s3apiMock) PutObjectAclRequest(input *s3.PutObjectAclInput) (req *request.Request, output *s3.PutObjectAclOutput) {
 	return nil, nil
 }
@@ -0,0 +1,236 @@
+package versions
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+var versionsPerKeyPercentiles = []int{50, 90, 99}
+
+// noncurrentAgeRanges defines the upper bounds of the age distribution for noncurrent versions
+var noncurrentAgeRanges = []struct {
+	label string
+	max   time.Duration
+}{
+	{"< 1 day", 24 * time.Hour},
+	{"1-7 days", 7 * 24 * time.Hour},
+	{"7-30 days", 30 * 24 * time.Hour},
+	{"30-90 days", 90 * 24 * time.Hour},
+	{"90-365 days", 365 * 24 * time.Hour},
+	{">= 1 year", 0},
+}
+
+type keyVersionsCount struct {
+	Key      string
+	Versions int
+}
+
+// versionStats describes the file versions distribution of a bucket
+type versionStats struct {
+	keys                 int
+	versions             int
+	currentVersions      int
+	deleteMarkers        int
+	currentDeleteMarkers int
+	totalBytes           int64
+	currentBytes         int64
+	noncurrentBytes      int64
+	versionsPerKey       []int
+	noncurrentAges       []int
+	topKeys              []keyVersionsCount
+}
+
+func newVersionStats() *versionStats {
+	return &versionStats{
+		versionsPerKey: []int{},
+		noncurrentAges: make([]int, len(noncurrentAgeRanges)),
+		topKeys:        []keyVersionsCount{},
+	}
+}
+
+// Stats prints statistics about the file versions of the configured buckets
+func (v *s3Versions) Stats() error {
+	return v.StatsWithContext(context.Background())
+}
+
+// StatsWithContext prints statistics about the file versions of the configured buckets
+func (v *s3Versions) StatsWithContext(ctx context.Context) error {
+	ctx, span := v.tracer.Start(ctx, "Stats", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	buckets, err := v.getBuckets(ctx)
+	if err != nil {
+		return err
+	}
+
+	buckets, err = v.filterBucketsByVersioningEnabled(ctx, buckets)
+	if err != nil {
+		return err
+	}
+	v.logger.Println("Found these buckets with versioning enabled", buckets)
+
+	total := newVersionStats()
+	for _, bucket := range buckets {
+		fileVersions, err := v.getFileVersions(ctx, bucket)
+		if err != nil {
+			return err
+		}
+
+		stats := computeVersionStats(fileVersions, v.now())
+		stats.print(v.out, bucket, v.config.Stats.TopKeys)
+		total.merge(bucket+"/", stats)
+	}
+
+	if len(buckets) > 1 {
+		total.print(v.out, "all buckets", v.config.Stats.TopKeys)
+	}
+	v.printRateLimitWaitTime()
+
+	return nil
+}
+
+func computeVersionStats(fileVersions map[string][]*fileVersion, now time.Time) *versionStats {
+	stats := newVersionStats()
+
+	for key, versions := range fileVersions {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].LastModified.After(versions[j].LastModified)
+		})
+
+		stats.keys++
+		stats.versionsPerKey = append(stats.versionsPerKey, len(versions))
+		stats.topKeys = append(stats.topKeys, keyVersionsCount{Key: key, Versions: len(versions)})
+
+		for i, version := range versions {
+			stats.totalBytes += version.Size
+
+			if version.IsDeleteMarker {
+				stats.deleteMarkers++
+				if version.IsLatest {
+					stats.currentDeleteMarkers++
+				}
+			} else {
+				stats.versions++
+				if version.IsLatest {
+					stats.currentVersions++
+				}
+			}
+
+			if version.IsLatest {
+				stats.currentBytes += version.Size
+				continue
+			}
+
+			stats.noncurrentBytes += version.Size
+
+			stats.noncurrentAges[ageRangeIndex(now.Sub(noncurrentSince(versions, i)))]++
+		}
+	}
+
+	stats.sort()
+
+	return stats
+}
+
+// noncurrentSince returns when the version became noncurrent, which is when the next (newer) version
+// was created. The versions are sorted from the newest.
+func noncurrentSince(versions []*fileVersion, i int) time.Time {
+	if i > 0 {
+		return versions[i-1].LastModified
+	}
+
+	return versions[i].LastModified
+}
+
+func ageRangeIndex(age time.Duration) int {
+	for i, ageRange := range noncurrentAgeRanges {
+		if ageRange.max == 0 || age < ageRange.max {
+			return i
+		}
+	}
+
+	return len(noncurrentAgeRanges) - 1
+}
+
+func (s *versionStats) sort() {
+	sort.Ints(s.versionsPerKey)
+	sort.Slice(s.topKeys, func(i, j int) bool {
+		if s.topKeys[i].Versions == s.topKeys[j].Versions {
+			return s.topKeys[i].Key < s.topKeys[j].Key
+		}
+		return s.topKeys[i].Versions > s.topKeys[j].Versions
+	})
+}
+
+// merge adds the stats of another bucket, prefixing its keys
+func (s *versionStats) merge(keyPrefix string, other *versionStats) {
+	s.keys += other.keys
+	s.versions += other.versions
+	s.currentVersions += other.currentVersions
+	s.deleteMarkers += other.deleteMarkers
+	s.currentDeleteMarkers += other.currentDeleteMarkers
+	s.totalBytes += other.totalBytes
+	s.currentBytes += other.currentBytes
+	s.noncurrentBytes += other.noncurrentBytes
+	s.versionsPerKey = append(s.versionsPerKey, other.versionsPerKey...)
+	for _, key := range other.topKeys {
+		s.topKeys = append(s.topKeys, keyVersionsCount{Key: keyPrefix + key.Key, Versions: key.Versions})
+	}
+	for i, count := range other.noncurrentAges {
+		s.noncurrentAges[i] += count
+	}
+
+	s.sort()
+}
+
+// percentile returns the nearest-rank percentile of the versions per key
+func (s *versionStats) percentile(p int) int {
+	if len(s.versionsPerKey) == 0 {
+		return 0
+	}
+
+	rank := (p*len(s.versionsPerKey) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return s.versionsPerKey[rank-1]
+}
+
+func (s *versionStats) print(w io.Writer, name string, topKeys int) {
+	fmt.Fprintf(w, "Statistics for %s\n", name)
+	fmt.Fprintf(w, "  Keys: %d\n", s.keys)
+	fmt.Fprintf(w, "  Versions: %d (current: %d, noncurrent: %d)\n", s.versions, s.currentVersions, s.versions-s.currentVersions)
+	fmt.Fprintf(w, "  Delete markers: %d (current: %d, noncurrent: %d)\n", s.deleteMarkers, s.currentDeleteMarkers, s.deleteMarkers-s.currentDeleteMarkers)
+	fmt.Fprintf(w, "  Size: %s (current: %s, noncurrent: %s)\n",
+		humanize.Bytes(uint64(s.totalBytes)), humanize.Bytes(uint64(s.currentBytes)), humanize.Bytes(uint64(s.noncurrentBytes)))
+
+	fmt.Fprintf(w, "  Versions per key:")
+	for _, p := range versionsPerKeyPercentiles {
+		fmt.Fprintf(w, " p%d=%d", p, s.percentile(p))
+	}
+	fmt.Fprintf(w, " max=%d\n", s.percentile(100))
+
+	fmt.Fprintf(w, "  Noncurrent versions age:\n")
+	for i, ageRange := range noncurrentAgeRanges {
+		fmt.Fprintf(w, "    %-12s %d\n", ageRange.label, s.noncurrentAges[i])
+	}
+
+	if topKeys < 0 {
+		topKeys = 0
+	} else if topKeys > len(s.topKeys) {
+		topKeys = len(s.topKeys)
+	}
+	fmt.Fprintf(w, "  Keys with the most versions:\n")
+	for _, key := range s.topKeys[:topKeys] {
+		fmt.Fprintf(w, "    %6d %s\n", key.Versions, key.Key)
+	}
+}
@@ -0,0 +1,69 @@
+package versions
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeVersionStats(t *testing.T) {
+	now := time.Now()
+	fileVersions := map[string][]*fileVersion{
+		"key1": []*fileVersion{
+			&fileVersion{Key: "key1", VersionID: "v1", Size: 100, LastModified: now.Add(-400 * 24 * time.Hour)},
+			&fileVersion{Key: "key1", VersionID: "v2", Size: 200, LastModified: now.Add(-40 * 24 * time.Hour)},
+			&fileVersion{Key: "key1", VersionID: "v3", Size: 300, LastModified: now.Add(-2 * time.Hour), IsLatest: true},
+		},
+		"key2": []*fileVersion{
+			&fileVersion{Key: "key2", VersionID: "v1", Size: 50, LastModified: now.Add(-3 * 24 * time.Hour)},
+			&fileVersion{Key: "key2", VersionID: "d1", LastModified: now.Add(-2 * 24 * time.Hour), IsDeleteMarker: true, IsLatest: true},
+		},
+		"key3": []*fileVersion{
+			&fileVersion{Key: "key3", VersionID: "v1", Size: 10, LastModified: now.Add(-time.Hour), IsLatest: true},
+		},
+	}
+
+	stats := computeVersionStats(fileVersions, now)
+
+	assert.Equal(t, 3, stats.keys)
+	assert.Equal(t, 5, stats.versions)
+	assert.Equal(t, 2, stats.currentVersions)
+	assert.Equal(t, 1, stats.deleteMarkers)
+	assert.Equal(t, 1, stats.currentDeleteMarkers)
+	assert.Equal(t, int64(660), stats.totalBytes)
+	assert.Equal(t, int64(310), stats.currentBytes)
+	assert.Equal(t, int64(350), stats.noncurrentBytes)
+	assert.Equal(t, []int{1, 2, 3}, stats.versionsPerKey)
+	assert.Equal(t, 2, stats.percentile(50))
+	assert.Equal(t, 3, stats.percentile(100))
+	// key1/v2 is noncurrent since 2 hours, key1/v1 since 40 days and key2/v1 since 2 days
+	assert.Equal(t, []int{1, 1, 0, 1, 0, 0}, stats.noncurrentAges)
+	assert.Equal(t, keyVersionsCount{Key: "key1", Versions: 3}, stats.topKeys[0])
+
+	total := newVersionStats()
+	total.merge("b1/", stats)
+	total.merge("b2/", stats)
+	assert.Equal(t, 6, total.keys)
+	assert.Equal(t, "b1/key1", total.topKeys[0].Key)
+	assert.Equal(t, "b2/key1", total.topKeys[1].Key)
+}
+
+func TestStats(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	out := &bytes.Buffer{}
+	s.out = out
+	s.config.Stats.TopKeys = 1
+
+	err := s.Stats()
+	require.Nil(t, err)
+
+	assert.Contains(t, out.String(), "Statistics for b1")
+	assert.Contains(t, out.String(), "Delete markers: 2 (current: 0, noncurrent: 2)")
+	assert.Contains(t, out.String(), "     4 key1")
+	assert.NotContains(t, out.String(), "     3 key2")
+	assert.Equal(t, 4, len(fakeBuckets["b1"].Objects["key1"]))
+}
@@ -0,0 +1,62 @@
+package versions
+
+import (
+	"github.com/dustin/go-humanize"
+)
+
+// deletionSummary counts what was actually deleted during a run
+type deletionSummary struct {
+	buckets          int
+	versionsDeleted  int
+	bytesDeleted     int64
+	errors           int
+	lockSkipped      int
+	protectedSkipped int
+
+	uploadsAborted int
+	uploadBytes    int64
+
+	// versioning-suspended buckets, also counted in the totals
+	suspendedBuckets         int
+	suspendedVersionsDeleted int
+	suspendedBytesDeleted    int64
+}
+
+func (s *deletionSummary) add(versionsDeleted int, bytesDeleted int64, errors int) {
+	s.versionsDeleted += versionsDeleted
+	s.bytesDeleted += bytesDeleted
+	s.errors += errors
+}
+
+// addSuspended records versions deleted from a bucket with versioning suspended
+func (s *deletionSummary) addSuspended(versionsDeleted int, bytesDeleted int64) {
+	s.suspendedVersionsDeleted += versionsDeleted
+	s.suspendedBytesDeleted += bytesDeleted
+}
+
+// addMultipart records aborted multipart uploads, their errors are counted as deletion errors
+func (s *deletionSummary) addMultipart(uploadsAborted int, uploadBytes int64, errors int) {
+	s.uploadsAborted += uploadsAborted
+	s.uploadBytes += uploadBytes
+	s.errors += errors
+}
+
+func (s *deletionSummary) print(logger Logger) {
+	logger.Printf("Deleted %d versions (%s) in %d completed buckets, %d deletion errors",
+		s.versionsDeleted, humanize.Bytes(uint64(s.bytesDeleted)), s.buckets, s.errors)
+	if s.suspendedBuckets > 0 {
+		logger.Printf("Including %d versions (%s) deleted from %d buckets with versioning suspended",
+			s.suspendedVersionsDeleted, humanize.Bytes(uint64(s.suspendedBytesDeleted)), s.suspendedBuckets)
+	}
+	if s.uploadsAborted > 0 {
+		logger.Printf("Aborted %d incomplete multipart uploads (%s)", s.uploadsAborted, humanize.Bytes(uint64(s.uploadBytes)))
+	}
+	s.printSkipped(logger)
+}
+
+// printSkipped prints how many versions were eligible for deletion but skipped
+func (s *deletionSummary) printSkipped(logger Logger) {
+	if s.protectedSkipped > 0 || s.lockSkipped > 0 {
+		logger.Printf("Skipped %d versions of protected keys and %d versions under object locks", s.protectedSkipped, s.lockSkipped)
+	}
+}
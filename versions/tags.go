@@ -0,0 +1,112 @@
+package versions
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// tagCache caches the tags of the file versions fetched during a run
+type tagCache struct {
+	mu   sync.Mutex
+	tags map[string]map[string]string
+}
+
+func newTagCache() *tagCache {
+	return &tagCache{
+		tags: map[string]map[string]string{},
+	}
+}
+
+func (c *tagCache) get(key string) (map[string]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tags, ok := c.tags[key]
+	return tags, ok
+}
+
+func (c *tagCache) put(key string, tags map[string]string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tags[key] = tags
+}
+
+// getVersionTags returns the tags of a file version, delete markers have no tags
+func (v *s3Versions) getVersionTags(ctx context.Context, bucket string, version *fileVersion) (map[string]string, error) {
+	if version.IsDeleteMarker {
+		return map[string]string{}, nil
+	}
+
+	cacheKey := bucket + "\x00" + version.Key + "\x00" + version.VersionID
+	if tags, ok := v.tags.get(cacheKey); ok {
+		return tags, nil
+	}
+
+	response, err := v.s3.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(bucket),
+		Key:       aws.String(version.Key),
+		VersionId: aws.String(version.VersionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tags := map[string]string{}
+	for _, tag := range response.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	v.tags.put(cacheKey, tags)
+
+	return tags, nil
+}
+
+func parseKeepTags(conditions []string) []tagCondition {
+	keepTags := []tagCondition{}
+	for _, condition := range conditions {
+		keepTags = append(keepTags, parseTagCondition(condition))
+	}
+
+	return keepTags
+}
+
+// pinnedVersions returns the given versions kept because they have a --keep-tag tag, with the matching tag.
+// The tags of the versions are fetched concurrently.
+func (v *s3Versions) pinnedVersions(ctx context.Context, bucket string, fileVersions map[string][]*fileVersion) (map[*fileVersion]string, error) {
+	pinned := map[*fileVersion]string{}
+	if len(v.keepTags) == 0 {
+		return pinned, nil
+	}
+
+	objectVersions := []*fileVersion{}
+	for _, versions := range fileVersions {
+		for _, version := range versions {
+			if !version.IsDeleteMarker {
+				objectVersions = append(objectVersions, version)
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	err := forEachVersion(objectVersions, v.config.CheckConcurrency, func(version *fileVersion) error {
+		tags, err := v.getVersionTags(ctx, bucket, version)
+		if err != nil {
+			return err
+		}
+
+		for _, condition := range v.keepTags {
+			if condition.matches(tags) {
+				mu.Lock()
+				pinned[version] = condition.String()
+				mu.Unlock()
+				break
+			}
+		}
+		return nil
+	})
+
+	return pinned, err
+}
@@ -0,0 +1,65 @@
+package versions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupTaggedBuckets() map[string]*fakeBucket {
+	fakeBuckets := setupBucketsAndObjects()
+
+	tags := map[string]map[string]string{
+		"b1-key1-v3": {"keep": "true"},
+		"b1-key2-v1": {"release": "v1.2"},
+		"b1-key2-v2": {"keep": "false"},
+	}
+	for _, versions := range fakeBuckets["b1"].Objects {
+		for _, version := range versions {
+			version.Tags = tags[version.VersionID]
+		}
+	}
+
+	return fakeBuckets
+}
+
+func TestFindAndDelete_KeepTag(t *testing.T) {
+	fakeBuckets := setupTaggedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	s.config.KeepTag = []string{"keep=true", "release"}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	// b1-key1-v3 is pinned but kept anyway as the newest version, b1-key2-v1 is kept on top of the newest version
+	assert.Equal(t, []string{"b1-key1-v3"}, versionIDs(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, []string{"b1-key2-v1", "b1-key2-v2"}, versionIDs(fakeBuckets["b1"].Objects["key2"]))
+	// Only the tags of the versions beyond the count are fetched
+	assert.Equal(t, 3, s.s3.(*s3apiMock).tagChecks)
+}
+
+func TestFindAndDelete_KeepTagNoMatch(t *testing.T) {
+	fakeBuckets := setupTaggedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	s.config.KeepTag = []string{"keep=forever"}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key1"]))
+	assert.Equal(t, 1, len(fakeBuckets["b1"].Objects["key2"]))
+}
+
+func TestFindAndDelete_TagsCached(t *testing.T) {
+	fakeBuckets := setupTaggedBuckets()
+	s := getBasicTestService(fakeBuckets)
+	s.config.KeepTag = []string{"keep=true"}
+	s.config.ProtectTag = []string{"signed"}
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	// The versions beyond the count are checked for --keep-tag, the current versions for --protect-tag, each once
+	assert.Equal(t, 5, s.s3.(*s3apiMock).tagChecks)
+}
@@ -0,0 +1,100 @@
+package versions
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+type recordingExporter struct {
+	spans     []*tracing.Span
+	flushes   int
+	shutdowns int
+}
+
+func (e *recordingExporter) Export(spans []*tracing.Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Flush(ctx context.Context) error {
+	e.flushes++
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(ctx context.Context) error {
+	e.shutdowns++
+	return nil
+}
+
+func (e *recordingExporter) spanNames() []string {
+	names := []string{}
+	for _, span := range e.spans {
+		names = append(names, span.Name)
+	}
+	return names
+}
+
+func TestTracing(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	exporter := &recordingExporter{}
+	s.tracer = tracing.NewTracer(exporter)
+
+	err := s.Delete()
+	require.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"ListObjectVersions", "ListObjectVersions", "ListObjectVersions",
+		"ComputeVersions", "DeleteObjects", "Bucket", "Delete",
+	}, exporter.spanNames())
+
+	root := exporter.spans[len(exporter.spans)-1]
+	bucket := exporter.spans[len(exporter.spans)-2]
+	for _, span := range exporter.spans[:len(exporter.spans)-2] {
+		assert.Equal(t, root.TraceID, span.TraceID)
+		assert.Equal(t, bucket.SpanID, span.ParentSpanID)
+	}
+	assert.Equal(t, root.SpanID, bucket.ParentSpanID)
+	assert.Contains(t, bucket.Attributes, tracing.String("bucket", "b1"))
+}
+
+func TestTracing_SeveralCommands(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	exporter := &recordingExporter{}
+	s := NewWithOptions(
+		WithConfig(getBasicTestService(fakeBuckets).config),
+		WithS3(newS3ApiMock(fakeBuckets, 3)),
+		WithTracer(tracing.NewTracer(exporter)),
+	)
+
+	// The commands flush the spans, the tracer is still used by the next commands
+	plan, err := s.Plan(context.Background())
+	require.Nil(t, err)
+	_, err = s.Execute(context.Background(), plan)
+	require.Nil(t, err)
+
+	assert.Equal(t, 2, exporter.flushes)
+	assert.Equal(t, 0, exporter.shutdowns)
+	assert.Equal(t, "Execute", exporter.spans[len(exporter.spans)-1].Name)
+}
+
+func TestTracing_RemoteParent(t *testing.T) {
+	fakeBuckets := setupBucketsAndObjects()
+	s := getBasicTestService(fakeBuckets)
+	exporter := &recordingExporter{}
+	s.tracer = tracing.NewTracer(exporter)
+
+	ctx, err := tracing.ContextWithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Nil(t, err)
+	require.Nil(t, s.DeleteWithContext(ctx))
+
+	root := exporter.spans[len(exporter.spans)-1]
+	assert.Equal(t, "Delete", root.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", root.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+}
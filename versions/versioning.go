@@ -0,0 +1,250 @@
+package versions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/croman/delete-s3-versions/tracing"
+)
+
+// versioningDisabled is the status reported for the buckets on which versioning was never enabled
+const versioningDisabled = "Disabled"
+
+// bucketVersioning is the versioning posture of a bucket
+type bucketVersioning struct {
+	Bucket    string `json:"bucket"`
+	Status    string `json:"status"`
+	MFADelete bool   `json:"mfaDelete"`
+	Required  bool   `json:"required"`
+	Compliant bool   `json:"compliant"`
+	// Action is the planned change, "enable" or "suspend"
+	Action  string `json:"action,omitempty"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Versioning reports the versioning status of the buckets, and enables or suspends it when requested
+func (v *s3Versions) Versioning() error {
+	return v.VersioningWithContext(context.Background())
+}
+
+// VersioningWithContext reports the versioning status of the buckets, and enables or suspends it when requested
+func (v *s3Versions) VersioningWithContext(ctx context.Context) error {
+	ctx, span := v.tracer.Start(ctx, "Versioning", tracing.String("region", v.region()))
+	defer v.flushTraces()
+	defer span.End()
+
+	c := v.config.Versioning
+	if c.Enable && c.Suspend {
+		return errors.New("--enable and --suspend can't be used together")
+	}
+
+	required, err := compileBucketGlobs(c.Require)
+	if err != nil {
+		return err
+	}
+
+	buckets, err := v.getBuckets(ctx)
+	if err != nil {
+		return err
+	}
+
+	report := []*bucketVersioning{}
+	failed := 0
+	for _, bucket := range buckets {
+		posture, err := v.getBucketVersioning(ctx, bucket, required)
+		if err != nil {
+			return err
+		}
+		if posture == nil {
+			continue
+		}
+
+		posture.Action = v.versioningAction(posture, c.Enable, c.Suspend, len(required) > 0)
+		if len(posture.Action) > 0 && v.config.Confirm {
+			if err = v.putBucketVersioning(ctx, posture); err != nil {
+				v.logger.Printf("Failed to %s versioning on %s: %v", posture.Action, bucket, err)
+				posture.Error = err.Error()
+				failed++
+			}
+		}
+
+		posture.Compliant = !posture.Required || posture.Status == s3.BucketVersioningStatusEnabled
+		report = append(report, posture)
+	}
+
+	if err = printVersioningReport(v.out, v.config.Versioning.Format, v.config.Confirm, report); err != nil {
+		return err
+	}
+	v.logVersioningSummary(report, v.config.Confirm)
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to change the versioning of %d buckets", failed)
+	}
+
+	return nil
+}
+
+func compileBucketGlobs(globs []string) ([]*regexp.Regexp, error) {
+	patterns := []*regexp.Regexp{}
+	for _, glob := range globs {
+		pattern, err := globToRegexp(glob)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid --require glob %q: %v", glob, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns, nil
+}
+
+// getBucketVersioning returns the versioning posture of the bucket, nil for the buckets of other regions
+func (v *s3Versions) getBucketVersioning(ctx context.Context, bucket string, required []*regexp.Regexp) (*bucketVersioning, error) {
+	response, err := v.s3.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "BucketRegionError" {
+			v.logger.Printf("Skipping %s, it is in another region", bucket)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	posture := &bucketVersioning{
+		Bucket:    bucket,
+		Status:    aws.StringValue(response.Status),
+		MFADelete: aws.StringValue(response.MFADelete) == s3.MFADeleteStatusEnabled,
+	}
+	if len(posture.Status) == 0 {
+		posture.Status = versioningDisabled
+	}
+	for _, pattern := range required {
+		if pattern.MatchString(bucket) {
+			posture.Required = true
+		}
+	}
+
+	return posture, nil
+}
+
+// versioningAction returns the change to make on the bucket. With required buckets, only these are enabled
+// and they are never suspended.
+func (v *s3Versions) versioningAction(posture *bucketVersioning, enable bool, suspend bool, requirePolicy bool) string {
+	switch {
+	case enable && posture.Status != s3.BucketVersioningStatusEnabled && (posture.Required || !requirePolicy):
+		return "enable"
+	case suspend && posture.Status == s3.BucketVersioningStatusEnabled && posture.Required:
+		v.logger.Printf("Keeping versioning enabled on %s, it is required", posture.Bucket)
+	case suspend && posture.Status == s3.BucketVersioningStatusEnabled:
+		return "suspend"
+	}
+
+	return ""
+}
+
+// putBucketVersioning applies the action of the posture, the MFA Delete status is kept unchanged
+func (v *s3Versions) putBucketVersioning(ctx context.Context, posture *bucketVersioning) error {
+	status := s3.BucketVersioningStatusEnabled
+	if posture.Action == "suspend" {
+		status = s3.BucketVersioningStatusSuspended
+	}
+
+	input := &s3.PutBucketVersioningInput{
+		Bucket: aws.String(posture.Bucket),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(status),
+		},
+	}
+
+	if posture.MFADelete {
+		if v.mfa == nil {
+			return errors.New("MFA Delete is enabled, --mfa-serial is required")
+		}
+		header, err := v.mfa.header()
+		if err != nil {
+			return err
+		}
+		input.MFA = aws.String(header)
+		input.VersioningConfiguration.MFADelete = aws.String(s3.MFADeleteEnabled)
+	}
+
+	if _, err := v.s3.PutBucketVersioningWithContext(ctx, input); err != nil {
+		return err
+	}
+
+	v.logger.Printf("Versioning of %s is now %s", posture.Bucket, strings.ToLower(status))
+	posture.Status = status
+	posture.Applied = true
+
+	return nil
+}
+
+func printVersioningReport(w io.Writer, format string, confirm bool, report []*bucketVersioning) error {
+	if format == "json" {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(content, '\n'))
+		return err
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "BUCKET\tVERSIONING\tMFA DELETE\tREQUIRED\tCOMPLIANT\tACTION")
+	for _, posture := range report {
+		action := "-"
+		switch {
+		case len(posture.Error) > 0:
+			action = posture.Action + " failed"
+		case posture.Applied:
+			action = posture.Action + "d"
+		case len(posture.Action) > 0 && !confirm:
+			action = posture.Action + " (dry run)"
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", posture.Bucket, posture.Status, yesNo(posture.MFADelete),
+			yesNo(posture.Required), yesNo(posture.Compliant), action)
+	}
+
+	return table.Flush()
+}
+
+func (v *s3Versions) logVersioningSummary(report []*bucketVersioning, confirm bool) {
+	enabled, noncompliant, planned := 0, 0, 0
+	for _, posture := range report {
+		if posture.Status == s3.BucketVersioningStatusEnabled {
+			enabled++
+		}
+		if !posture.Compliant {
+			noncompliant++
+			v.logger.Printf("Warning: versioning is required on %s but it is %s", posture.Bucket, strings.ToLower(posture.Status))
+		}
+		if len(posture.Action) > 0 && !posture.Applied {
+			planned++
+		}
+	}
+
+	v.logger.Printf("%d buckets, %d with versioning enabled, %d noncompliant", len(report), enabled, noncompliant)
+	if planned > 0 && !confirm {
+		v.logger.Printf("%d versioning changes planned, run with --confirm to apply them", planned)
+	}
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+
+	return "no"
+}
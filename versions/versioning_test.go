@@ -0,0 +1,118 @@
+package versions
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testMFASerial = "arn:aws:iam::123456789012:mfa/user"
+
+func getVersioningTestService() (map[string]*fakeBucket, *s3Versions, *bytes.Buffer) {
+	fakeBuckets := setupBucketsAndObjects()
+	fakeBuckets["b3"] = &fakeBucket{
+		VersioningStatus: aws.String(s3.BucketVersioningStatusSuspended),
+		MFA:              testMFASerial + " 123456",
+	}
+
+	out := &bytes.Buffer{}
+	s := getBasicTestService(fakeBuckets)
+	s.out = out
+	s.config.Confirm = false
+	s.config.Versioning.Format = "json"
+
+	return fakeBuckets, s, out
+}
+
+func TestVersioning_Report(t *testing.T) {
+	_, s, out := getVersioningTestService()
+	s.config.Versioning.Require = []string{"b1", "b3"}
+
+	err := s.Versioning()
+	require.Nil(t, err)
+
+	report := []*bucketVersioning{}
+	require.Nil(t, json.Unmarshal(out.Bytes(), &report))
+	// The bucket in the wrong region is skipped
+	require.Equal(t, 3, len(report))
+
+	byBucket := map[string]*bucketVersioning{}
+	for _, posture := range report {
+		byBucket[posture.Bucket] = posture
+	}
+	assert.Equal(t, &bucketVersioning{Bucket: "b1", Status: "Enabled", Required: true, Compliant: true}, byBucket["b1"])
+	assert.Equal(t, &bucketVersioning{Bucket: "b2", Status: "Disabled", Compliant: true}, byBucket["b2"])
+	assert.Equal(t, &bucketVersioning{Bucket: "b3", Status: "Suspended", MFADelete: true, Required: true}, byBucket["b3"])
+}
+
+func TestVersioning_EnableDryRun(t *testing.T) {
+	fakeBuckets, s, out := getVersioningTestService()
+	s.config.Versioning.Enable = true
+	s.config.Versioning.Format = "text"
+
+	err := s.Versioning()
+	require.Nil(t, err)
+
+	assert.Nil(t, fakeBuckets["b2"].VersioningStatus)
+	assert.Regexp(t, `b2\s+Disabled\s+no\s+no\s+yes\s+enable \(dry run\)`, out.String())
+	assert.Regexp(t, `b1\s+Enabled\s+no\s+no\s+yes\s+-`, out.String())
+}
+
+func TestVersioning_EnableRequired(t *testing.T) {
+	fakeBuckets, s, _ := getVersioningTestService()
+	s.config.Confirm = true
+	s.config.Versioning.Enable = true
+	s.config.Versioning.Require = []string{"b2"}
+
+	err := s.Versioning()
+	require.Nil(t, err)
+
+	assert.Equal(t, s3.BucketVersioningStatusEnabled, *fakeBuckets["b2"].VersioningStatus)
+	assert.Equal(t, s3.BucketVersioningStatusSuspended, *fakeBuckets["b3"].VersioningStatus)
+}
+
+func TestVersioning_EnableMFA(t *testing.T) {
+	fakeBuckets, s, _ := getVersioningTestService()
+	s.config.Confirm = true
+	s.config.Versioning.Enable = true
+
+	err := s.Versioning()
+	require.NotNil(t, err)
+	assert.Equal(t, "Failed to change the versioning of 1 buckets", err.Error())
+	assert.Equal(t, s3.BucketVersioningStatusEnabled, *fakeBuckets["b2"].VersioningStatus)
+	assert.Equal(t, s3.BucketVersioningStatusSuspended, *fakeBuckets["b3"].VersioningStatus)
+
+	s.mfa = newMFACode(testMFASerial, "123456", &fakePrompter{})
+	err = s.Versioning()
+	require.Nil(t, err)
+	assert.Equal(t, s3.BucketVersioningStatusEnabled, *fakeBuckets["b3"].VersioningStatus)
+}
+
+func TestVersioning_SuspendKeepsRequired(t *testing.T) {
+	fakeBuckets, s, _ := getVersioningTestService()
+	fakeBuckets["b2"].VersioningStatus = aws.String(s3.BucketVersioningStatusEnabled)
+	s.config.Confirm = true
+	s.config.Versioning.Suspend = true
+	s.config.Versioning.Require = []string{"b1"}
+
+	err := s.Versioning()
+	require.Nil(t, err)
+
+	assert.Equal(t, s3.BucketVersioningStatusEnabled, *fakeBuckets["b1"].VersioningStatus)
+	assert.Equal(t, s3.BucketVersioningStatusSuspended, *fakeBuckets["b2"].VersioningStatus)
+}
+
+func TestVersioning_EnableAndSuspend(t *testing.T) {
+	_, s, _ := getVersioningTestService()
+	s.config.Versioning.Enable = true
+	s.config.Versioning.Suspend = true
+
+	err := s.Versioning()
+	require.NotNil(t, err)
+}